@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+/*
+A read-only JSON API over what the exporter currently knows, so scripts can read table
+sizes from here instead of asking the controllers.
+
+	GET /api/v1/clusters
+	GET /api/v1/clusters/{name}/tables
+	GET /api/v1/clusters/{name}/tables/{table}
+
+Cluster names may contain slashes (e.g. controller URLs), so they must be URL-escaped.
+*/
+func registerAPIHandlers(mux *http.ServeMux, m *PinotManager) {
+	mux.HandleFunc("GET /api/v1/clusters", apiClustersHandler(m))
+	mux.HandleFunc("GET /api/v1/clusters/{name}/tables", apiClusterTablesHandler(m))
+	mux.HandleFunc("GET /api/v1/clusters/{name}/tables/{table}", apiClusterTableHandler(m))
+}
+
+// Return the table cache of a known cluster
+func (m *PinotManager) clusterTableCache(name string) (*TableCache, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	tableCache, ok := m.tableCaches[name]
+	return tableCache, ok
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logger.Errorf("Failed writing API response: %s", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+func apiClustersHandler(m *PinotManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clusters := m.Status()
+		if clusters == nil {
+			clusters = []ClusterStatusReport{}
+		}
+		writeJSON(w, http.StatusOK, clusters)
+	}
+}
+
+func apiClusterTablesHandler(m *PinotManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		tableCache, ok := m.clusterTableCache(name)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "unknown cluster %s", name)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"cluster": name,
+			"tables":  tableCache.GetTablesInfo(),
+		})
+	}
+}
+
+func apiClusterTableHandler(m *PinotManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		table := r.PathValue("table")
+		tableCache, ok := m.clusterTableCache(name)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "unknown cluster %s", name)
+			return
+		}
+		info, ok := tableCache.GetTableInfo(table)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "unknown table %s in cluster %s", table, name)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	}
+}
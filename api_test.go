@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIHandlers(t *testing.T) {
+	server := newFakeTablesController("trololo", "skata")
+	defer server.Close()
+	// Named after its URL, like discovered clusters are
+	controller := NewPinotController("", server.URL)
+	manager, err := NewPinotManager(2, 1, NewStaticPinotControllerCache(controller))
+	assert.Nil(t, err)
+	manager.updateKnownPinotsCache([]*PinotController{controller})
+	defer manager.updateKnownPinotsCache(nil)
+
+	mux := http.NewServeMux()
+	registerAPIHandlers(mux, manager)
+	get := func(path string, out interface{}) int {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if out != nil {
+			assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), out))
+		}
+		return recorder.Code
+	}
+
+	var clusters []ClusterStatusReport
+	assert.Equal(t, http.StatusOK, get("/api/v1/clusters", &clusters))
+	assert.Len(t, clusters, 1)
+	assert.Equal(t, server.URL, clusters[0].Name)
+
+	escapedName := url.PathEscape(server.URL)
+	// Wait for sizes to be collected
+	assert.Eventually(t, func() bool {
+		var info TableInfo
+		get("/api/v1/clusters/"+escapedName+"/tables/trololo", &info)
+		return !info.LastCollection.IsZero()
+	}, 5*time.Second, 20*time.Millisecond)
+
+	var info TableInfo
+	assert.Equal(t, http.StatusOK, get("/api/v1/clusters/"+escapedName+"/tables/trololo", &info))
+	assert.Equal(t, "trololo", info.Name)
+	assert.Equal(t, 1, info.SizeBytes)
+
+	var tables struct {
+		Cluster string      `json:"cluster"`
+		Tables  []TableInfo `json:"tables"`
+	}
+	assert.Equal(t, http.StatusOK, get("/api/v1/clusters/"+escapedName+"/tables", &tables))
+	assert.Equal(t, server.URL, tables.Cluster)
+	assert.Len(t, tables.Tables, 2)
+
+	assert.Equal(t, http.StatusNotFound, get("/api/v1/clusters/"+escapedName+"/tables/missing", nil))
+	assert.Equal(t, http.StatusNotFound, get("/api/v1/clusters/missing/tables", nil))
+}
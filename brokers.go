@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A broker serving a table
+type BrokerInfo struct {
+	InstanceName string `json:"instanceName"`
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+}
+
+// Where a hybrid table splits queries between its offline and realtime segments, from the broker
+type TimeBoundary struct {
+	TimeColumn string `json:"timeColumn"`
+	// In the unit of the time column
+	TimeValue string `json:"timeValue"`
+}
+
+// The segments each server is queried for: table name with type -> server -> segments
+type RoutingTable map[string]map[string][]string
+
+/*
+List the live brokers of a table, from GET /v2/brokers/tables/{tableName}.
+Releases before the v2 API only list host_port names, from GET /brokers/tables/{tableName}.
+*/
+func (c *PinotController) ListBrokersForTable(ctx context.Context, tableName string) ([]BrokerInfo, error) {
+	var brokers []BrokerInfo
+	err := c.getJSON(ctx, "", fmt.Sprintf("/v2/brokers/tables/%s", url.PathEscape(tableName)), &brokers)
+	var statusErr *PinotStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		var hostPorts []string
+		err = c.getJSON(ctx, "", fmt.Sprintf("/brokers/tables/%s", url.PathEscape(tableName)), &hostPorts)
+		brokers = nil
+		for _, hostPort := range hostPorts {
+			separator := strings.LastIndex(hostPort, "_")
+			if separator < 0 {
+				continue
+			}
+			port, convErr := strconv.Atoi(hostPort[separator+1:])
+			if convErr != nil {
+				continue
+			}
+			brokers = append(brokers, BrokerInfo{InstanceName: "Broker_" + hostPort, Host: hostPort[:separator], Port: port})
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed listing brokers of table %s from %s: %w", tableName, c, err)
+	}
+	return brokers, nil
+}
+
+// Brokers and servers are reached with the scheme of the controllers
+func (c *PinotController) instanceURL(host string, port int) string {
+	scheme := "http"
+	if parsed, err := url.Parse(c.URL); err == nil && parsed.Scheme != "" {
+		scheme = parsed.Scheme
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+func (c *PinotController) brokerURL(broker BrokerInfo) string {
+	return c.instanceURL(broker.Host, broker.Port)
+}
+
+// GET from a broker or server, within the rate limits of the cluster
+func (c *PinotController) getInstanceJSON(ctx context.Context, instanceURL string, apiPath string, out interface{}) error {
+	release, err := c.waitForLimiter(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return getJSONFrom(ctx, instanceURL, apiPath, out)
+}
+
+func (c *PinotController) getBrokerJSON(ctx context.Context, broker BrokerInfo, apiPath string, out interface{}) error {
+	return c.getInstanceJSON(ctx, c.brokerURL(broker), apiPath, out)
+}
+
+// Get the time boundary of a hybrid table from a broker. Nil when the broker has none
+func (c *PinotController) GetTimeBoundary(ctx context.Context, broker BrokerInfo, tableName string) (*TimeBoundary, error) {
+	var boundary TimeBoundary
+	err := c.getBrokerJSON(ctx, broker, fmt.Sprintf("/debug/timeBoundary/%s", url.PathEscape(tableName)), &boundary)
+	var statusErr *PinotStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed getting time boundary of table %s from broker %s: %w", tableName, broker.InstanceName, err)
+	}
+	return &boundary, nil
+}
+
+func (c *PinotController) GetRoutingTable(ctx context.Context, broker BrokerInfo, tableName string) (RoutingTable, error) {
+	var routing RoutingTable
+	err := c.getBrokerJSON(ctx, broker, fmt.Sprintf("/debug/routingTable/%s", url.PathEscape(tableName)), &routing)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting routing table of table %s from broker %s: %w", tableName, broker.InstanceName, err)
+	}
+	return routing, nil
+}
+
+/*
+Export the time boundary of a hybrid table and the segments routed to each server,
+as seen by every broker of the table. Brokers disagreeing, or a boundary that stops
+moving, mean queries miss data or count it twice.
+Tables that are not hybrid have none of these series.
+*/
+func collectBrokers(ctx context.Context, controller PinotControllerInterface, table string, configs TableConfigs) error {
+	cluster := controller.String()
+	if configs.Offline == nil || configs.Realtime == nil {
+		deleteBrokerMetrics(cluster, table)
+		return nil
+	}
+	brokers, err := controller.ListBrokersForTable(ctx, table)
+	if err != nil {
+		return err
+	}
+	type routed struct{ broker, tableType, server string }
+	boundaries := make(map[string]float64)
+	segments := make(map[routed]int)
+	for _, broker := range brokers {
+		boundary, err := controller.GetTimeBoundary(ctx, broker, table)
+		if err != nil {
+			return err
+		}
+		if boundary != nil {
+			value, err := strconv.ParseFloat(boundary.TimeValue, 64)
+			if err != nil {
+				logger.Warnf("Invalid time boundary %q of table %s on broker %s: %s", boundary.TimeValue, table, broker.InstanceName, err)
+			} else {
+				boundaries[broker.InstanceName] = value
+			}
+		}
+		routing, err := controller.GetRoutingTable(ctx, broker, table)
+		if err != nil {
+			return err
+		}
+		for tableWithType, servers := range routing {
+			tableType := "OFFLINE"
+			if strings.HasSuffix(tableWithType, "_REALTIME") {
+				tableType = "REALTIME"
+			}
+			for server, serverSegments := range servers {
+				segments[routed{broker.InstanceName, tableType, server}] += len(serverSegments)
+			}
+		}
+	}
+
+	// Brokers and servers come and go
+	tableLabels := prometheus.Labels{"cluster": cluster, "table": table}
+	var boundarySeries, segmentSeries []gaugeSeries
+	for broker, value := range boundaries {
+		boundarySeries = append(boundarySeries, gaugeSeries{prometheus.Labels{"cluster": cluster, "table": table, "broker": broker}, value})
+	}
+	for key, count := range segments {
+		labels := prometheus.Labels{"cluster": cluster, "table": table, "table_type": key.tableType, "broker": key.broker, "server": key.server}
+		segmentSeries = append(segmentSeries, gaugeSeries{labels, float64(count)})
+	}
+	replaceSeries(TableTimeBoundary, tableLabels, boundarySeries)
+	replaceSeries(TableRoutedSegments, tableLabels, segmentSeries)
+	return nil
+}
+
+func deleteBrokerMetrics(cluster string, table string) {
+	for _, metric := range []*prometheus.GaugeVec{TableTimeBoundary, TableRoutedSegments} {
+		metric.DeletePartialMatch(prometheus.Labels{"cluster": cluster, "table": table})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectBrokers(t *testing.T) {
+	fake := newFakePinot(t, fakePinotFixture)
+	controller := NewPinotController("brokers", fake.URL())
+	ctx := context.Background()
+
+	configs, err := controller.GetTableConfigs(ctx, "airlineStats")
+	assert.Nil(t, err)
+	err = collectBrokers(ctx, controller, "airlineStats", configs)
+	assert.Nil(t, err)
+	assert.Equal(t, 16072.0, testutil.ToFloat64(TableTimeBoundary.WithLabelValues("brokers", "airlineStats", "Broker_pinot-broker-0_8099")))
+	assert.Equal(t, 16072.0, testutil.ToFloat64(TableTimeBoundary.WithLabelValues("brokers", "airlineStats", "Broker_pinot-broker-1_8099")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(TableRoutedSegments.WithLabelValues("brokers", "airlineStats", "OFFLINE", "Broker_pinot-broker-0_8099", "Server_pinot-server-0_8098")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(TableRoutedSegments.WithLabelValues("brokers", "airlineStats", "OFFLINE", "Broker_pinot-broker-0_8099", "Server_pinot-server-1_8098")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(TableRoutedSegments.WithLabelValues("brokers", "airlineStats", "REALTIME", "Broker_pinot-broker-1_8099", "Server_pinot-server-1_8098")))
+
+	// A broker leaves
+	fake.update(func(cluster *fakePinotCluster) {
+		table := cluster.Tables["airlineStats"]
+		table.Brokers = []string{"Broker_pinot-broker-0_8099"}
+		cluster.Tables["airlineStats"] = table
+	})
+	err = collectBrokers(ctx, controller, "airlineStats", configs)
+	assert.Nil(t, err)
+	assert.False(t, TableTimeBoundary.DeleteLabelValues("brokers", "airlineStats", "Broker_pinot-broker-1_8099"))
+
+	// Tables that are not hybrid have no time boundary
+	configs.Offline = nil
+	err = collectBrokers(ctx, controller, "airlineStats", configs)
+	assert.Nil(t, err)
+	assert.False(t, TableTimeBoundary.DeleteLabelValues("brokers", "airlineStats", "Broker_pinot-broker-0_8099"))
+}
+
+func TestListBrokersForTableBeforeV2(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/brokers/tables/airlineStats" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode([]string{"pinot-broker-0.pinot-broker-headless_8099"})
+	}))
+	defer server.Close()
+	controller := NewPinotController("legacy", server.URL)
+
+	brokers, err := controller.ListBrokersForTable(context.Background(), "airlineStats")
+	assert.Nil(t, err)
+	assert.Equal(t, []BrokerInfo{{InstanceName: "Broker_pinot-broker-0.pinot-broker-headless_8099", Host: "pinot-broker-0.pinot-broker-headless", Port: 8099}}, brokers)
+	assert.Equal(t, "http://pinot-broker-0.pinot-broker-headless:8099", controller.brokerURL(brokers[0]))
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+Collects the metrics of one table. Every table collector of a cluster runs in turn
+each time the table is due, unless it ran less than its interval ago.
+*/
+type TableCollector struct {
+	Name             string
+	EnabledByDefault bool
+	Collect          func(ctx context.Context, target *TableTarget) error
+	// The series it exports, removed from a cluster it is disabled for
+	Metrics []*prometheus.GaugeVec
+}
+
+// Collects the metrics of a whole cluster, on its own schedule
+type ClusterCollector struct {
+	Name             string
+	EnabledByDefault bool
+	Collect          func(ctx context.Context, target *ClusterTarget) error
+	Metrics          []*prometheus.GaugeVec
+}
+
+// The table collectors, in the order they run
+var tableCollectors = []TableCollector{
+	{Name: "size", EnabledByDefault: true, Collect: collectSize,
+		Metrics: []*prometheus.GaugeVec{TableSizeBytes, TableServerBytes, TableServerSegments, ServerBytes, ServerSegments}},
+	{Name: "config", EnabledByDefault: true, Collect: collectTableConfigOf,
+		Metrics: []*prometheus.GaugeVec{TableConfigInfo, TableSchemaColumns, TableReplication, TableRetentionSeconds, TableIndexColumns}},
+	{Name: "replication", EnabledByDefault: true, Collect: collectReplicationOf,
+		Metrics: []*prometheus.GaugeVec{TableSegments, TableSegmentsUnderReplicated, TableSegmentsOverReplicated}},
+	{Name: "retention", EnabledByDefault: true, Collect: collectRetentionOf,
+		Metrics: []*prometheus.GaugeVec{TableDataTimeMinSeconds, TableDataTimeMaxSeconds, TableNewestSegmentAgeSeconds,
+			TableSegmentsOutOfRetention, TableSegmentsOutOfRetentionBytes}},
+	{Name: "jobs", EnabledByDefault: true, Collect: collectJobsOf,
+		Metrics: []*prometheus.GaugeVec{TableJobsInProgress, TableJobOldestAgeSeconds, TableJobSegmentsPending}},
+	{Name: "ingestion", EnabledByDefault: true, Collect: collectIngestionOf, Metrics: ingestionMetrics()},
+	{Name: "brokers", EnabledByDefault: true, Collect: collectBrokersOf,
+		Metrics: []*prometheus.GaugeVec{TableTimeBoundary, TableRoutedSegments}},
+}
+
+var clusterCollectors = []ClusterCollector{
+	{Name: "instances", EnabledByDefault: true, Collect: collectInstances,
+		Metrics: []*prometheus.GaugeVec{Instances, InstancesDisabled}},
+	{Name: "tasks", EnabledByDefault: true, Collect: collectMinionTasks,
+		Metrics: []*prometheus.GaugeVec{MinionTasks}},
+	// Needs controller_metrics, so only when asked for
+	{Name: "periodic_tasks", EnabledByDefault: false, Collect: collectPeriodicTasks, Metrics: periodicTaskMetrics()},
+	// Sends requests to every server, so only when asked for
+	{Name: "server_admin", EnabledByDefault: false, Collect: collectServerAdmin, Metrics: serverAdminMetrics()},
+}
+
+// Names of all collectors, table and cluster ones
+func collectorNames() []string {
+	var names []string
+	for _, collector := range tableCollectors {
+		names = append(names, collector.Name)
+	}
+	for _, collector := range clusterCollectors {
+		names = append(names, collector.Name)
+	}
+	return names
+}
+
+// A cluster being collected
+type ClusterTarget struct {
+	Controller PinotControllerInterface
+	// The tables that pass the table filter, as last listed
+	TableCache *TableCache
+	// Where the controllers serve their own metrics
+	ControllerMetrics *ControllerMetrics
+}
+
+/*
+A table being collected. What several collectors need, like the size and configs
+of the table, is fetched once, by the first collector that asks for it.
+*/
+type TableTarget struct {
+	Controller PinotControllerInterface
+	TableCache *TableCache
+	Table      string
+	Now        time.Time
+
+	mutex      sync.Mutex
+	size       *TableSize
+	sizeErr    error
+	configs    *TableConfigs
+	configsErr error
+}
+
+func (t *TableTarget) Size(ctx context.Context) (TableSize, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.size == nil {
+		size, err := t.Controller.GetTableSize(ctx, t.Table)
+		t.size, t.sizeErr = &size, err
+	}
+	return *t.size, t.sizeErr
+}
+
+func (t *TableTarget) Configs(ctx context.Context) (TableConfigs, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.configs == nil {
+		configs, err := t.Controller.GetTableConfigs(ctx, t.Table)
+		t.configs, t.configsErr = &configs, err
+	}
+	return *t.configs, t.configsErr
+}
+
+// Collect the size of a table and its share of each server, and record it in the table cache
+func collectSize(ctx context.Context, target *TableTarget) error {
+	tableSize, err := target.Size(ctx)
+	size := tableSize.ReportedRealtimeBytes()
+	target.TableCache.RecordCollection(target.Table, size, err)
+	if err != nil {
+		return err
+	}
+	TableSizeBytes.WithLabelValues(target.Controller.String(), target.Table).Set(float64(size))
+	collectServerUsage(target.Controller.String(), target.TableCache, target.Table, tableSize)
+	return nil
+}
+
+func collectTableConfigOf(ctx context.Context, target *TableTarget) error {
+	configs, err := target.Configs(ctx)
+	if err != nil {
+		return err
+	}
+	return collectTableConfig(ctx, target.Controller, target.TableCache, target.Table, configs)
+}
+
+func collectReplicationOf(ctx context.Context, target *TableTarget) error {
+	configs, err := target.Configs(ctx)
+	if err != nil {
+		return err
+	}
+	return collectReplication(ctx, target.Controller, target.Table, configs)
+}
+
+func collectRetentionOf(ctx context.Context, target *TableTarget) error {
+	configs, err := target.Configs(ctx)
+	if err != nil {
+		return err
+	}
+	size, err := target.Size(ctx)
+	if err != nil {
+		return err
+	}
+	return collectRetention(ctx, target.Controller, target.Table, configs, size, target.Now)
+}
+
+func collectJobsOf(ctx context.Context, target *TableTarget) error {
+	return collectJobs(ctx, target.Controller, target.TableCache, target.Table, target.Now)
+}
+
+func collectIngestionOf(ctx context.Context, target *TableTarget) error {
+	configs, err := target.Configs(ctx)
+	if err != nil {
+		return err
+	}
+	return collectIngestion(ctx, target.Controller, target.Table, configs, target.Now)
+}
+
+func collectBrokersOf(ctx context.Context, target *TableTarget) error {
+	configs, err := target.Configs(ctx)
+	if err != nil {
+		return err
+	}
+	return collectBrokers(ctx, target.Controller, target.Table, configs)
+}
+
+// A collector enabled for a cluster, with when and for how long it runs
+type scheduledTableCollector struct {
+	TableCollector
+	// Zero runs it every time the table is collected
+	interval time.Duration
+	// Zero uses the timeout of the pool
+	timeout time.Duration
+}
+
+type scheduledClusterCollector struct {
+	ClusterCollector
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// The table collectors enabled for a cluster
+func enabledTableCollectors(config CollectorsConfig, cluster string) []scheduledTableCollector {
+	var enabled []scheduledTableCollector
+	for _, collector := range tableCollectors {
+		if !config.Enabled(collector.Name, cluster, collector.EnabledByDefault) {
+			continue
+		}
+		collectorConfig := config[collector.Name]
+		enabled = append(enabled, scheduledTableCollector{collector, collectorConfig.Interval(), collectorConfig.Timeout()})
+	}
+	return enabled
+}
+
+// The cluster collectors enabled for a cluster. Those without an interval run every defaultInterval
+func enabledClusterCollectors(config CollectorsConfig, cluster string, defaultInterval time.Duration, defaultTimeout time.Duration) []scheduledClusterCollector {
+	var enabled []scheduledClusterCollector
+	for _, collector := range clusterCollectors {
+		if !config.Enabled(collector.Name, cluster, collector.EnabledByDefault) {
+			continue
+		}
+		collectorConfig := config[collector.Name]
+		scheduled := scheduledClusterCollector{collector, collectorConfig.Interval(), collectorConfig.Timeout()}
+		if scheduled.interval == 0 {
+			scheduled.interval = defaultInterval
+		}
+		if scheduled.timeout == 0 {
+			scheduled.timeout = defaultTimeout
+		}
+		enabled = append(enabled, scheduled)
+	}
+	return enabled
+}
+
+// Remove the series of the collectors disabled for a cluster, which would never be updated again
+func deleteDisabledCollectorMetrics(config CollectorsConfig, cluster string) {
+	var metrics []*prometheus.GaugeVec
+	for _, collector := range tableCollectors {
+		if !config.Enabled(collector.Name, cluster, collector.EnabledByDefault) {
+			metrics = append(metrics, collector.Metrics...)
+		}
+	}
+	for _, collector := range clusterCollectors {
+		if !config.Enabled(collector.Name, cluster, collector.EnabledByDefault) {
+			metrics = append(metrics, collector.Metrics...)
+		}
+	}
+	for _, metric := range metrics {
+		metric.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+	}
+}
+
+// Run a cluster collector every interval, until ctx is cancelled
+func runClusterCollector(ctx context.Context, target *ClusterTarget, collector scheduledClusterCollector) {
+	controller := target.Controller
+	for {
+		collectCtx, cancel := ctx, context.CancelFunc(func() {})
+		if collector.timeout > 0 {
+			collectCtx, cancel = context.WithTimeout(ctx, collector.timeout)
+		}
+		start := time.Now()
+		err := collector.Collect(collectCtx, target)
+		cancel()
+		recordCollectorRun(controller.String(), collector.Name, time.Since(start), err)
+		if err != nil {
+			logger.Errorf("Collector %s failed for %s: %s", collector.Name, controller, err)
+		}
+		select {
+		case <-time.After(collector.interval):
+		case <-ctx.Done():
+			logger.Infof("Stopped collector %s of %s", collector.Name, controller)
+			return
+		}
+	}
+}
+
+func recordCollectorRun(cluster string, collector string, duration time.Duration, err error) {
+	CollectorDurationSeconds.WithLabelValues(cluster, collector).Observe(duration.Seconds())
+	if err != nil {
+		CollectorErrors.WithLabelValues(cluster, collector).Inc()
+	}
+}
+
+// Configuration of a collector, under collectors: in the config file
+type CollectorConfig struct {
+	// Unset means the collector's default
+	Enabled *bool `json:"enabled" yaml:"enabled"`
+	// Whether it runs for some clusters, by cluster name, overriding enabled
+	Clusters map[string]bool `json:"clusters" yaml:"clusters"`
+	// How often it runs. Table collectors run at most once per collection of the table
+	IntervalSeconds int `json:"interval_seconds" yaml:"interval_seconds"`
+	// How long a run may take
+	TimeoutSeconds int `json:"timeout_seconds" yaml:"timeout_seconds"`
+}
+
+// Collector configurations by collector name
+type CollectorsConfig map[string]CollectorConfig
+
+func (c CollectorConfig) Interval() time.Duration {
+	return time.Duration(c.IntervalSeconds) * time.Second
+}
+
+func (c CollectorConfig) Timeout() time.Duration {
+	return time.Duration(c.TimeoutSeconds) * time.Second
+}
+
+// Whether the named collector runs for the cluster
+func (c CollectorsConfig) Enabled(name string, cluster string, byDefault bool) bool {
+	config, ok := c[name]
+	if !ok {
+		return byDefault
+	}
+	if enabled, ok := config.Clusters[cluster]; ok {
+		return enabled
+	}
+	if config.Enabled != nil {
+		return *config.Enabled
+	}
+	return byDefault
+}
+
+func (c CollectorsConfig) IsValid() error {
+	names := collectorNames()
+	for name, config := range c {
+		if !slices.Contains(names, name) {
+			return fmt.Errorf("unknown collector %s - should be one of %v", name, names)
+		}
+		if config.IntervalSeconds < 0 || config.TimeoutSeconds < 0 {
+			return fmt.Errorf("interval_seconds and timeout_seconds of collector %s can't be negative", name)
+		}
+	}
+	return nil
+}
@@ -7,76 +7,282 @@ import (
 	"time"
 )
 
+// How often the pool checks which tables are due for collection
+const schedulerTick = time.Second
+
+// Defaults for the random delay before each collection and the time a collection may take
+const (
+	defaultCollectionJitter  = 500 * time.Millisecond
+	defaultCollectionTimeout = 30 * time.Second
+)
+
+// Source of time for the pool, so tests can control it
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
 /*
 A WorkerPool is Per-Pinot cluster
 Its job is to collect metrics from all tables in the cluster.
-Since there could be a lot of tables, we want to parallelize this task
+Since there could be a lot of tables, we want to parallelize this task.
+numWorkers workers collect one table at a time each, so at most numWorkers
+collections of the cluster are in flight.
 */
 type CollectorWorkerPool struct {
 	wg                 sync.WaitGroup
+	ctx                context.Context
 	controller         PinotControllerInterface
+	status             *ClusterStatus
+	tableCache         *TableCache
+	scheduler          *TableScheduler
 	incomingTablesChan <-chan []string
 	tables             chan string
-	semaphore          chan struct{}
 	numWorkers         int
+	tick               time.Duration
+	// Maximum random delay before each collection
+	jitter time.Duration
+	// Maximum duration of a collector run, unless the collector has its own. Zero means no limit
+	timeout time.Duration
+	clock   Clock
+	// Run in turn for every table that is due
+	collectors []scheduledTableCollector
+	// When each collector with an interval last ran for each table: collector -> table -> time
+	lastRunMutex sync.Mutex
+	lastRun      map[string]map[string]time.Time
+}
+
+type CollectorPoolOption func(*CollectorWorkerPool)
+
+// Delay each collection by a random duration up to jitter, so requests don't go out in bursts
+func WithCollectionJitter(jitter time.Duration) CollectorPoolOption {
+	return func(c *CollectorWorkerPool) {
+		c.jitter = jitter
+	}
+}
+
+// Give up on a collector run after timeout, unless the collector has its own. Zero means no limit
+func WithCollectionTimeout(timeout time.Duration) CollectorPoolOption {
+	return func(c *CollectorWorkerPool) {
+		c.timeout = timeout
+	}
+}
+
+// Run these collectors for every table, instead of the ones enabled by default
+func WithTableCollectors(collectors ...scheduledTableCollector) CollectorPoolOption {
+	return func(c *CollectorWorkerPool) {
+		c.collectors = collectors
+	}
+}
+
+func WithClock(clock Clock) CollectorPoolOption {
+	return func(c *CollectorWorkerPool) {
+		c.clock = clock
+	}
 }
 
-func NewCollectorWorkerPool(numWorkers int, controller PinotControllerInterface, incomingTablesChan <-chan []string) *CollectorWorkerPool {
+/*
+Create a pool and start its workers. Every table is collected once per interval.
+Once ctx is cancelled no new collections are started, while the ones in flight are left to finish.
+*/
+func NewCollectorWorkerPool(ctx context.Context, numWorkers int, interval time.Duration, controller PinotControllerInterface, status *ClusterStatus, tableCache *TableCache, incomingTablesChan <-chan []string, options ...CollectorPoolOption) *CollectorWorkerPool {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
 	pool := CollectorWorkerPool{
+		ctx:                ctx,
 		controller:         controller,
+		status:             status,
+		tableCache:         tableCache,
+		scheduler:          NewTableScheduler(interval),
 		incomingTablesChan: incomingTablesChan,
 		numWorkers:         numWorkers,
-		semaphore:          make(chan struct{}, numWorkers),
 		tables:             make(chan string),
+		tick:               schedulerTick,
+		jitter:             defaultCollectionJitter,
+		timeout:            defaultCollectionTimeout,
+		clock:              realClock{},
+		collectors:         enabledTableCollectors(nil, controller.String()),
+		lastRun:            make(map[string]map[string]time.Time),
+	}
+	for _, opt := range options {
+		opt(&pool)
 	}
 	// Start workers
 	for i := 1; i <= numWorkers; i++ {
-		ctx := context.Background()
 		pool.wg.Add(1)
-		go worker(i, ctx, pool.tables, pool.controller, pool.semaphore, &pool.wg)
+		go pool.worker(i)
 	}
 
 	return &pool
 }
 
+// Run a collector that is not per table alongside the workers, so Close waits for it as well
+func (c *CollectorWorkerPool) Go(run func()) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		run()
+	}()
+}
+
+/*
+Wait for the workers to return. Workers return once ctx is cancelled, or once the
+table updates channel given to SubscribeToTableUpdates is closed, after finishing
+the collection they are running.
+*/
 func (c *CollectorWorkerPool) Close() {
 	c.wg.Wait()
-	close(c.tables)
 }
 
-// Receive table array updates
+/*
+Receive table array updates and hand the tables to the workers as they become due.
+When the updates channel is closed, the workers are told to stop.
+*/
 func (c *CollectorWorkerPool) SubscribeToTableUpdates(tables <-chan []string) {
-	for newTables := range tables {
-		logger.Debugf("Pool received []table update: %+v\n", newTables)
-		for _, table := range newTables {
-			c.tables <- table
+	defer close(c.tables)
+	tick := c.clock.After(c.tick)
+	for {
+		select {
+		case newTables, ok := <-tables:
+			if !ok {
+				return
+			}
+			logger.Debugf("Pool received []table update: %+v\n", newTables)
+			c.scheduler.UpdateTables(c.clock.Now(), newTables)
+			c.forgetTables(newTables)
+		case <-tick:
+			tick = c.clock.After(c.tick)
+			// Keep draining updates after cancellation, so the sender is never blocked
+			if c.ctx.Err() != nil {
+				continue
+			}
+			c.dispatchDueTables()
 		}
-
 	}
 }
 
-// Worker function that fetches the metric from the REST API
-func worker(id int, ctx context.Context, tables <-chan string, controller PinotControllerInterface, semaphore chan struct{}, wg *sync.WaitGroup) {
-	defer wg.Done()
-	logger.Infof("Started collector worker with id %d for pinot %s", id, controller)
-	for table := range tables {
-		logger.Debugf("worker %d consumed table update '%+v' from channel.", id, table)
-		// Acquire semaphore
-		semaphore <- struct{}{}
+// Send the tables that are due to the workers
+func (c *CollectorWorkerPool) dispatchDueTables() {
+	due, skipped := c.scheduler.Due(c.clock.Now())
+	if skipped > 0 {
+		logger.Warnf("Skipped %d tables of %s as their previous collection is still running", skipped, c.controller)
+		CollectionsSkipped.WithLabelValues(c.controller.String()).Add(float64(skipped))
+	}
+	for i, table := range due {
+		select {
+		case c.tables <- table:
+		case <-c.ctx.Done():
+			for _, notSent := range due[i:] {
+				c.scheduler.Done(notSent)
+			}
+			return
+		}
+	}
+}
 
-		go func(table string) {
-			defer func() { <-semaphore }() // Release semaphore
-			// Introduce random jitter (0 to 500 ms)
-			jitter := time.Duration(rand.Intn(500)) * time.Millisecond
-			time.Sleep(jitter)
-			logger.Debugf("Worker %d of (%s) collecting size for table %s", id, controller, table)
-			size, err := controller.GetSizeForTable(ctx, table)
-			if err != nil {
-				logger.Errorf("Failed to get size for table %s with error %s\n", table, err)
+// Worker function that collects the tables it receives, one at a time
+func (c *CollectorWorkerPool) worker(id int) {
+	defer c.wg.Done()
+	logger.Infof("Started collector worker with id %d for pinot %s", id, c.controller)
+	for {
+		select {
+		case table, ok := <-c.tables:
+			if !ok {
+				logger.Infof("Worker with id %d, that was monitoring %s is returning", id, c.controller)
 				return
 			}
-			TableSizeBytes.WithLabelValues(table).Set(float64(size))
-		}(table)
+			logger.Debugf("worker %d consumed table update '%+v' from channel.", id, table)
+			c.collect(table)
+		case <-c.ctx.Done():
+			logger.Infof("Worker with id %d, that was monitoring %s is returning", id, c.controller)
+			return
+		}
+	}
+}
+
+// Run the collectors that are due for a table, and record the outcome
+func (c *CollectorWorkerPool) collect(table string) {
+	defer c.scheduler.Done(table)
+	if c.jitter > 0 {
+		select {
+		case <-c.clock.After(time.Duration(rand.Int63n(int64(c.jitter)))):
+		case <-c.ctx.Done():
+			return
+		}
+	}
+	logger.Debugf("Collecting table %s of %s", table, c.controller)
+	target := &TableTarget{Controller: c.controller, TableCache: c.tableCache, Table: table, Now: c.clock.Now()}
+	var firstErr error
+	for _, collector := range c.collectors {
+		if !c.due(collector, table, target.Now) {
+			continue
+		}
+		start := time.Now()
+		err := c.runCollector(collector, target)
+		recordCollectorRun(c.controller.String(), collector.Name, time.Since(start), err)
+		if err != nil {
+			logger.Errorf("Collector %s failed for table %s of %s: %s", collector.Name, table, c.controller, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	c.status.RecordCollection(table, firstErr)
+}
+
+func (c *CollectorWorkerPool) runCollector(collector scheduledTableCollector, target *TableTarget) error {
+	// Not bound to the pool's ctx, so a collection that started is allowed to finish during shutdown
+	ctx := context.Background()
+	timeout := c.timeout
+	if collector.timeout > 0 {
+		timeout = collector.timeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return collector.Collect(ctx, target)
+}
+
+// Whether a collector should run for the table now, recording that it does
+func (c *CollectorWorkerPool) due(collector scheduledTableCollector, table string, now time.Time) bool {
+	if collector.interval <= 0 {
+		return true
+	}
+	c.lastRunMutex.Lock()
+	defer c.lastRunMutex.Unlock()
+	lastRun, ok := c.lastRun[collector.Name]
+	if !ok {
+		lastRun = make(map[string]time.Time)
+		c.lastRun[collector.Name] = lastRun
+	}
+	if last, ok := lastRun[table]; ok && now.Sub(last) < collector.interval {
+		return false
+	}
+	lastRun[table] = now
+	return true
+}
+
+// Forget when collectors ran for tables that are gone
+func (c *CollectorWorkerPool) forgetTables(tables []string) {
+	current := make(map[string]struct{}, len(tables))
+	for _, table := range tables {
+		current[table] = struct{}{}
+	}
+	c.lastRunMutex.Lock()
+	defer c.lastRunMutex.Unlock()
+	for _, lastRun := range c.lastRun {
+		for table := range lastRun {
+			if _, exists := current[table]; !exists {
+				delete(lastRun, table)
+			}
+		}
 	}
-	logger.Infof("Worker with id %d, that was monitoring %s is returning", id, controller)
 }
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A PinotControllerInterface whose collections block until released
+type blockingController struct {
+	PinotControllerInterface
+	started  atomic.Int32
+	finished atomic.Int32
+	release  chan struct{}
+}
+
+func (b *blockingController) GetTableSize(ctx context.Context, tableName string) (TableSize, error) {
+	b.started.Add(1)
+	<-b.release
+	b.finished.Add(1)
+	return TableSize{RealtimeSegments: &TableTypeSize{ReportedSizeInBytes: 1}}, nil
+}
+
+func (b *blockingController) GetTableConfigs(ctx context.Context, tableName string) (TableConfigs, error) {
+	return TableConfigs{}, errors.New("no configs")
+}
+
+func (b *blockingController) String() string {
+	return "blocking"
+}
+
+// Run only the named table collectors, so fakes need only implement what they use
+func onlyTableCollectors(names ...string) CollectorPoolOption {
+	var collectors []scheduledTableCollector
+	for _, collector := range tableCollectors {
+		if slices.Contains(names, collector.Name) {
+			collectors = append(collectors, scheduledTableCollector{TableCollector: collector})
+		}
+	}
+	return WithTableCollectors(collectors...)
+}
+
+func TestCollectorWorkerPoolDrainsInFlightOnClose(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	controller := &blockingController{release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := NewCollectorWorkerPool(ctx, 2, 50*time.Millisecond, controller, &ClusterStatus{}, &TableCache{}, nil, onlyTableCollectors("size"))
+	pool.tick = 10 * time.Millisecond
+	updates := make(chan []string)
+	go pool.SubscribeToTableUpdates(updates)
+
+	updates <- []string{"trololo", "skata"}
+	assert.Eventually(t, func() bool { return controller.started.Load() == 2 }, 3*time.Second, 10*time.Millisecond)
+
+	// Stop the pool while both collections are in flight
+	cancel()
+	close(updates)
+	closed := make(chan struct{})
+	go func() {
+		pool.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned before in-flight collections finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(controller.release)
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Close did not return after collections finished")
+	}
+	assert.Equal(t, int32(2), controller.finished.Load())
+	assertGoroutinesReturnTo(t, baseline)
+}
+
+// A Clock that only moves when told to
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []fakeClockWaiter
+}
+
+type fakeClockWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- f.now
+		return ch
+	}
+	f.waiters = append(f.waiters, fakeClockWaiter{at: f.now.Add(d), ch: ch})
+	return ch
+}
+
+// Move the clock forward, firing the waiters that are due
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(d)
+	var pending []fakeClockWaiter
+	for _, w := range f.waiters {
+		if f.now.Before(w.at) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- f.now
+	}
+	f.waiters = pending
+}
+
+// A PinotControllerInterface that records how many collections run at once
+type countingController struct {
+	PinotControllerInterface
+	mutex     sync.Mutex
+	inFlight  int
+	maxFlight int
+	collected map[string]int
+	// how long each collection takes
+	delay time.Duration
+}
+
+func (c *countingController) GetTableSize(ctx context.Context, tableName string) (TableSize, error) {
+	c.mutex.Lock()
+	c.inFlight++
+	c.maxFlight = max(c.maxFlight, c.inFlight)
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		c.inFlight--
+		c.collected[tableName]++
+		c.mutex.Unlock()
+	}()
+	select {
+	case <-time.After(c.delay):
+		return TableSize{RealtimeSegments: &TableTypeSize{ReportedSizeInBytes: 42}}, nil
+	case <-ctx.Done():
+		return TableSize{}, ctx.Err()
+	}
+}
+
+func (c *countingController) GetTableConfigs(ctx context.Context, tableName string) (TableConfigs, error) {
+	return TableConfigs{}, errors.New("no configs")
+}
+
+func (c *countingController) String() string {
+	return "counting"
+}
+
+func (c *countingController) collections() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	total := 0
+	for _, n := range c.collected {
+		total += n
+	}
+	return total
+}
+
+func (c *countingController) collectedAll(tables []string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, table := range tables {
+		if c.collected[table] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *countingController) maxInFlight() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.maxFlight
+}
+
+func TestCollectorWorkerPoolBoundsConcurrency(t *testing.T) {
+	controller := &countingController{collected: make(map[string]int), delay: 20 * time.Millisecond}
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tables := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+	tableCache := &TableCache{Tables: tables}
+	pool := NewCollectorWorkerPool(ctx, 3, time.Minute, controller, &ClusterStatus{}, tableCache, nil,
+		WithClock(clock), WithCollectionJitter(0), onlyTableCollectors("size", "config"))
+	updates := make(chan []string)
+	go pool.SubscribeToTableUpdates(updates)
+
+	updates <- tables
+	// Every table is due once within the interval
+	assert.Eventually(t, func() bool {
+		clock.Advance(time.Second)
+		return controller.collectedAll(tables)
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.LessOrEqual(t, controller.maxInFlight(), 3)
+	info, ok := tableCache.GetTableInfo("a")
+	assert.True(t, ok)
+	assert.Equal(t, 42, info.SizeBytes)
+
+	cancel()
+	close(updates)
+	pool.Close()
+}
+
+func TestCollectorWorkerPoolTimesOutCollections(t *testing.T) {
+	controller := &countingController{collected: make(map[string]int), delay: time.Hour}
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	status := &ClusterStatus{}
+	tableCache := &TableCache{Tables: []string{"trololo"}}
+	pool := NewCollectorWorkerPool(ctx, 1, time.Second, controller, status, tableCache, nil,
+		WithClock(clock), WithCollectionJitter(0), WithCollectionTimeout(20*time.Millisecond), onlyTableCollectors("size"))
+	updates := make(chan []string)
+	go pool.SubscribeToTableUpdates(updates)
+
+	updates <- []string{"trololo"}
+	clock.Advance(time.Second)
+	assert.Eventually(t, func() bool { return controller.collections() == 1 }, 3*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		info, ok := tableCache.GetTableInfo("trololo")
+		return ok && info.LastCollectionError != ""
+	}, 3*time.Second, 10*time.Millisecond)
+
+	cancel()
+	close(updates)
+	pool.Close()
+}
+
+func TestCollectorWorkerPoolCloseWithoutSubscribing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := NewCollectorWorkerPool(ctx, 2, time.Second, &countingController{}, &ClusterStatus{}, &TableCache{}, nil)
+	cancel()
+	closed := make(chan struct{})
+	go func() {
+		pool.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Close did not return after the pool was cancelled")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectorsConfig(t *testing.T) {
+	config, err := NewConfigFromBytes([]byte(`
+collectors:
+  server_admin:
+    enabled: true
+    interval_seconds: 300
+    clusters:
+      staging: false
+  brokers:
+    enabled: false
+  retention:
+    clusters:
+      staging: false
+`))
+	assert.Nil(t, err)
+	collectors := config.Collectors
+	assert.Nil(t, collectors.IsValid())
+	assert.True(t, collectors.Enabled("server_admin", "prod", false))
+	assert.False(t, collectors.Enabled("server_admin", "staging", false))
+	assert.False(t, collectors.Enabled("brokers", "prod", true))
+	assert.True(t, collectors.Enabled("retention", "prod", true))
+	assert.False(t, collectors.Enabled("retention", "staging", true))
+	// Not configured
+	assert.True(t, collectors.Enabled("size", "prod", true))
+
+	var names []string
+	for _, collector := range enabledTableCollectors(collectors, "staging") {
+		names = append(names, collector.Name)
+	}
+	assert.Equal(t, []string{"size", "config", "replication", "jobs", "ingestion"}, names)
+	clusterCollectors := enabledClusterCollectors(collectors, "prod", time.Minute, 10*time.Second)
+	assert.Len(t, clusterCollectors, 3)
+	assert.Equal(t, "server_admin", clusterCollectors[2].Name)
+	assert.Equal(t, 5*time.Minute, clusterCollectors[2].interval)
+	assert.Equal(t, 10*time.Second, clusterCollectors[2].timeout)
+	assert.Equal(t, time.Minute, clusterCollectors[0].interval)
+
+	assert.NotNil(t, CollectorsConfig{"sizes": {}}.IsValid())
+	assert.NotNil(t, CollectorsConfig{"size": {TimeoutSeconds: -1}}.IsValid())
+}
+
+func TestDeleteDisabledCollectorMetrics(t *testing.T) {
+	TableTimeBoundary.WithLabelValues("disabled", "airlineStats", "Broker_pinot-broker-0_8099").Set(16072)
+	TableSegments.WithLabelValues("disabled", "airlineStats", "OFFLINE").Set(2)
+	disabled := false
+	deleteDisabledCollectorMetrics(CollectorsConfig{"brokers": {Enabled: &disabled}}, "disabled")
+	assert.False(t, TableTimeBoundary.DeleteLabelValues("disabled", "airlineStats", "Broker_pinot-broker-0_8099"))
+	assert.True(t, TableSegments.DeleteLabelValues("disabled", "airlineStats", "OFFLINE"))
+}
+
+func TestTableSizeBytesPerCluster(t *testing.T) {
+	TableSizeBytes.WithLabelValues("size-a", "airlineStats").Set(100)
+	TableSizeBytes.WithLabelValues("size-b", "airlineStats").Set(10)
+	deleteClusterMetrics("size-a")
+	assert.False(t, TableSizeBytes.DeleteLabelValues("size-a", "airlineStats"))
+	assert.Equal(t, 10.0, testutil.ToFloat64(TableSizeBytes.WithLabelValues("size-b", "airlineStats")))
+
+	disabled := false
+	deleteDisabledCollectorMetrics(CollectorsConfig{"size": {Enabled: &disabled}}, "size-b")
+	assert.False(t, TableSizeBytes.DeleteLabelValues("size-b", "airlineStats"))
+}
+
+func TestCollectorWorkerPoolCollectorIntervals(t *testing.T) {
+	var mutex sync.Mutex
+	runs := make(map[string]int)
+	counting := func(name string, interval time.Duration) scheduledTableCollector {
+		return scheduledTableCollector{
+			TableCollector: TableCollector{Name: name, Collect: func(ctx context.Context, target *TableTarget) error {
+				mutex.Lock()
+				defer mutex.Unlock()
+				runs[name]++
+				return nil
+			}},
+			interval: interval,
+		}
+	}
+	runsOf := func(name string) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return runs[name]
+	}
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := NewCollectorWorkerPool(ctx, 1, time.Second, &countingController{}, &ClusterStatus{}, &TableCache{Tables: []string{"trololo"}}, nil,
+		WithClock(clock), WithCollectionJitter(0), WithTableCollectors(counting("often", 0), counting("rarely", time.Hour)))
+	updates := make(chan []string)
+	go pool.SubscribeToTableUpdates(updates)
+
+	updates <- []string{"trololo"}
+	assert.Eventually(t, func() bool {
+		clock.Advance(time.Second)
+		return runsOf("often") >= 5
+	}, 3*time.Second, 10*time.Millisecond)
+	// Well under an hour went by on the clock
+	assert.Equal(t, 1, runsOf("rarely"))
+
+	// Tables that are gone are forgotten, once their last collection is done
+	assert.Eventually(t, func() bool {
+		updates <- []string{}
+		pool.lastRunMutex.Lock()
+		defer pool.lastRunMutex.Unlock()
+		return len(pool.lastRun["rarely"]) == 0
+	}, 3*time.Second, 10*time.Millisecond)
+
+	cancel()
+	close(updates)
+	pool.Close()
+}
+
+func TestClusterCollectors(t *testing.T) {
+	fake := newFakePinot(t, fakePinotFixture)
+	controller := NewPinotController("clustercollectors", fake.URL())
+
+	err := collectInstances(context.Background(), &ClusterTarget{Controller: controller})
+	assert.Nil(t, err)
+	assert.Equal(t, 2.0, testutil.ToFloat64(Instances.WithLabelValues("clustercollectors", "server")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(Instances.WithLabelValues("clustercollectors", "minion")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(InstancesDisabled.WithLabelValues("clustercollectors", "server")))
+
+	err = collectMinionTasks(context.Background(), &ClusterTarget{Controller: controller})
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(MinionTasks.WithLabelValues("clustercollectors", "RealtimeToOfflineSegmentsTask", "IN_PROGRESS")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(MinionTasks.WithLabelValues("clustercollectors", "RealtimeToOfflineSegmentsTask", "COMPLETED")))
+}
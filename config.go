@@ -3,6 +3,10 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -18,15 +22,44 @@ type KubernetesConfig struct {
 type ServiceDiscoveryConfigK8S struct {
 	Labels     map[string]string `json:"labelSelector" yaml:"labelSelector"`
 	KubeConfig KubernetesConfig  `json:"kubeconfig" yaml:"kubeconfig"`
+	// Labels and annotations of the Service copied onto all metrics of its cluster.
+	// Their names are made valid label names, e.g. app.kubernetes.io/part-of becomes app_kubernetes_io_part_of
+	CopyLabels      []string `json:"copyLabels" yaml:"copyLabels"`
+	CopyAnnotations []string `json:"copyAnnotations" yaml:"copyAnnotations"`
 }
 type Config struct {
-	ListenPort            int              `json:"port" yaml:"port"`
-	PinotController       *PinotController `json:"controller" yaml:"controller"`
-	PollFrequencySeconds  int              `json:"poll_freq_seconds" yaml:"poll_freq_seconds"`
-	MaxParallelCollectors int              `json:"max_parallel_collectors" yaml:"max_parallel_collectors"`
-	// Mode can be [ "kubernetes", "direct"]
-	Mode             string                    `json:"mode" yaml:"mode"`
-	ServiceDiscovery ServiceDiscoveryConfigK8S `json:"serviceDiscovery" yaml:"serviceDiscovery"`
+	ListenPort           int              `json:"port" yaml:"port"`
+	PinotController      *PinotController `json:"controller" yaml:"controller"`
+	PollFrequencySeconds int              `json:"poll_freq_seconds" yaml:"poll_freq_seconds"`
+	// How often to collect each table. Defaults to PollFrequencySeconds, which is how often tables are listed
+	CollectionIntervalSeconds int `json:"collection_interval_seconds" yaml:"collection_interval_seconds"`
+	MaxParallelCollectors     int `json:"max_parallel_collectors" yaml:"max_parallel_collectors"`
+	// Maximum random delay before each table collection, in milliseconds
+	CollectionJitterMillis int `json:"collection_jitter_ms" yaml:"collection_jitter_ms"`
+	// How long a single table collection may take
+	CollectionTimeoutSeconds int `json:"collection_timeout_seconds" yaml:"collection_timeout_seconds"`
+	// Send per-table requests to the lead controller of each table, for every cluster
+	LeaderRouting bool `json:"leader_routing" yaml:"leader_routing"`
+	// How long to wait for in-flight collections on shutdown
+	ShutdownTimeoutSeconds int `json:"shutdown_timeout_seconds" yaml:"shutdown_timeout_seconds"`
+	// Which tables are collected
+	Tables TableFilterConfig `json:"tables" yaml:"tables"`
+	// Which collectors run for which clusters, how often and for how long, by collector name
+	Collectors CollectorsConfig `json:"collectors" yaml:"collectors"`
+	// Limits on the number of exported series of each cluster
+	SeriesLimits SeriesLimitsConfig `json:"series_limits" yaml:"series_limits"`
+	// Rules applied to the labels of the exported series
+	RelabelConfigs []RelabelConfig `json:"relabel_configs" yaml:"relabel_configs"`
+	// Where the controllers serve their own metrics, read by the periodic_tasks collector
+	ControllerMetrics ControllerMetricsConfig `json:"controller_metrics" yaml:"controller_metrics"`
+	// Limits on the requests sent to Pinot controllers
+	RateLimits RateLimitsConfig `json:"rate_limits" yaml:"rate_limits"`
+	// Mode can be [ "kubernetes", "direct", "file", "dns", "zookeeper"]
+	Mode             string                     `json:"mode" yaml:"mode"`
+	ServiceDiscovery ServiceDiscoveryConfigK8S  `json:"serviceDiscovery" yaml:"serviceDiscovery"`
+	FileDiscovery    ServiceDiscoveryConfigFile `json:"fileDiscovery" yaml:"fileDiscovery"`
+	DNSDiscovery     ServiceDiscoveryConfigDNS  `json:"dnsDiscovery" yaml:"dnsDiscovery"`
+	ZKDiscovery      ServiceDiscoveryConfigZK   `json:"zookeeperDiscovery" yaml:"zookeeperDiscovery"`
 }
 
 type Option func(*Config)
@@ -35,9 +68,12 @@ func NewConfig(options ...func(*Config)) *Config {
 
 	// Start with some defaults where possible
 	config := &Config{
-		ListenPort:            8080,
-		PollFrequencySeconds:  30,
-		MaxParallelCollectors: 5,
+		ListenPort:               8080,
+		PollFrequencySeconds:     30,
+		MaxParallelCollectors:    5,
+		CollectionJitterMillis:   int(defaultCollectionJitter / time.Millisecond),
+		CollectionTimeoutSeconds: int(defaultCollectionTimeout / time.Second),
+		ShutdownTimeoutSeconds:   20,
 		//PinotController:       &pinotDefault,
 		Mode: "direct",
 	}
@@ -50,13 +86,18 @@ func NewConfig(options ...func(*Config)) *Config {
 
 func (c *Config) IsValid() error {
 
-	if (c.Mode != "direct") && (c.Mode != "kubernetes") {
-		return fmt.Errorf("unknown mode %s - should be one of 'direct' or 'kubernetes'", c.Mode)
+	if !slices.Contains([]string{"direct", "kubernetes", "file", "dns", "zookeeper"}, c.Mode) {
+		return fmt.Errorf("unknown mode %s - should be one of 'direct', 'kubernetes', 'file', 'dns' or 'zookeeper'", c.Mode)
 	}
 	if c.Mode == "direct" {
 		if c.PinotController == nil {
 			return fmt.Errorf("Pinot controller config missing")
 		}
+		for name := range c.PinotController.Labels {
+			if !labelNameRegexp.MatchString(name) {
+				return fmt.Errorf("invalid controller label name %s", name)
+			}
+		}
 	}
 	if c.Mode == "kubernetes" {
 		// First, make sure we have labels defined
@@ -64,6 +105,55 @@ func (c *Config) IsValid() error {
 			return fmt.Errorf("serviceDiscovery.labels is not defined")
 		}
 	}
+	if c.Mode == "file" {
+		if c.FileDiscovery.Path == "" {
+			return fmt.Errorf("fileDiscovery.path is not defined")
+		}
+	}
+	if c.Mode == "dns" {
+		if len(c.DNSDiscovery.Names) == 0 {
+			return fmt.Errorf("dnsDiscovery.names is not defined")
+		}
+		recordType := strings.ToUpper(c.DNSDiscovery.Type)
+		if (recordType != "SRV") && (recordType != "A") {
+			return fmt.Errorf("unknown dnsDiscovery.type %s - should be one of 'SRV' or 'A'", c.DNSDiscovery.Type)
+		}
+		if (recordType == "A") && (c.DNSDiscovery.Port == 0) {
+			return fmt.Errorf("dnsDiscovery.port is required for A records")
+		}
+	}
+	if c.Mode == "zookeeper" {
+		if c.ZKDiscovery.ConnectString == "" {
+			return fmt.Errorf("zookeeperDiscovery.connectString is not defined")
+		}
+	}
+	if c.MaxParallelCollectors < 1 {
+		return fmt.Errorf("max_parallel_collectors must be at least 1")
+	}
+	if c.PollFrequencySeconds < 1 {
+		return fmt.Errorf("poll_freq_seconds must be at least 1")
+	}
+	if c.CollectionIntervalSeconds < 0 || c.CollectionJitterMillis < 0 || c.CollectionTimeoutSeconds < 0 {
+		return fmt.Errorf("collection_interval_seconds, collection_jitter_ms and collection_timeout_seconds can't be negative")
+	}
+	if err := c.RateLimits.IsValid(); err != nil {
+		return err
+	}
+	if err := c.Collectors.IsValid(); err != nil {
+		return err
+	}
+	if err := c.Tables.IsValid(); err != nil {
+		return err
+	}
+	if err := validateRelabelConfigs(c.RelabelConfigs); err != nil {
+		return err
+	}
+	if err := c.SeriesLimits.IsValid(); err != nil {
+		return err
+	}
+	if err := c.ControllerMetrics.IsValid(); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -95,16 +185,49 @@ func WithPollFrequencySeconds(frequencySeconds int) Option {
 	}
 }
 
+// How often each table is collected
+func (c *Config) CollectionInterval() time.Duration {
+	if c.CollectionIntervalSeconds > 0 {
+		return time.Duration(c.CollectionIntervalSeconds) * time.Second
+	}
+	return time.Duration(c.PollFrequencySeconds) * time.Second
+}
+
+// Maximum random delay before each table collection
+func (c *Config) CollectionJitter() time.Duration {
+	return time.Duration(c.CollectionJitterMillis) * time.Millisecond
+}
+
+// How long a single table collection may take. Zero means no limit
+func (c *Config) CollectionTimeout() time.Duration {
+	return time.Duration(c.CollectionTimeoutSeconds) * time.Second
+}
+
 // Create a new Config from a YAML file
 func NewConfigFromFile(filename string) (*Config, error) {
-	config := NewConfig()
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return config, err
+		return NewConfig(), err
 	}
-	err = yaml.Unmarshal(data, config)
+	return NewConfigFromBytes(data)
+}
+
+// Create a new Config from YAML content
+func NewConfigFromBytes(data []byte) (*Config, error) {
+	config := NewConfig()
+	err := yaml.Unmarshal(data, config)
 	if err != nil {
 		return config, err
 	}
 	return config, nil
 }
+
+// Whether the two configs discover Pinot clusters differently
+func (c *Config) DiscoveryChanged(other *Config) bool {
+	return c.Mode != other.Mode ||
+		!reflect.DeepEqual(c.PinotController, other.PinotController) ||
+		!reflect.DeepEqual(c.ServiceDiscovery, other.ServiceDiscovery) ||
+		!reflect.DeepEqual(c.FileDiscovery, other.FileDiscovery) ||
+		!reflect.DeepEqual(c.DNSDiscovery, other.DNSDiscovery) ||
+		!reflect.DeepEqual(c.ZKDiscovery, other.ZKDiscovery)
+}
@@ -51,6 +51,20 @@ func TestConfigIsValid(t *testing.T) {
 
 	assert.Nil(t, config.IsValid())
 
+	controller.Labels = map[string]string{"app.kubernetes.io/team": "ingestion"}
+	assert.NotNil(t, config.IsValid())
+	controller.Labels = map[string]string{"team": "ingestion"}
+	assert.Nil(t, config.IsValid())
+
+	// Intervals that would stop the tickers
+	config.PollFrequencySeconds = 0
+	assert.NotNil(t, config.IsValid())
+	config.PollFrequencySeconds = 30
+	config.CollectionIntervalSeconds = -1
+	assert.NotNil(t, config.IsValid())
+	config.CollectionIntervalSeconds = 0
+	assert.Nil(t, config.IsValid())
+
 	// switch to kubernetes mode
 	config.Mode = "kubernetes"
 	// validation should fail as we have no Labels
@@ -67,3 +81,23 @@ func TestConfigIsValid(t *testing.T) {
 	assert.Nil(t, config.IsValid())
 
 }
+
+func TestConfigIsValidDiscoveryModes(t *testing.T) {
+
+	config := NewConfig()
+	config.Mode = "file"
+	assert.NotNil(t, config.IsValid())
+	config.FileDiscovery.Path = "testdata/files/targets.sample.yaml"
+	assert.Nil(t, config.IsValid())
+
+	config.Mode = "dns"
+	assert.NotNil(t, config.IsValid())
+	config.DNSDiscovery.Names = []string{"pinot.example.com"}
+	config.DNSDiscovery.Type = "A"
+	// A records need a port
+	assert.NotNil(t, config.IsValid())
+	config.DNSDiscovery.Port = 9000
+	assert.Nil(t, config.IsValid())
+	config.DNSDiscovery.Type = "MX"
+	assert.NotNil(t, config.IsValid())
+}
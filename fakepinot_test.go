@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+/*
+An in-memory Pinot controller for integration tests, serving the cluster described
+by a fixture under testdata/fakepinot. Tests can change the cluster while it is served.
+*/
+type fakePinot struct {
+	mutex   sync.Mutex
+	cluster fakePinotCluster
+	// Requests received, by path
+	requests map[string]int
+	server   *httptest.Server
+}
+
+// Responses of the controller API, as Pinot returns them
+type fakePinotCluster struct {
+	Version   json.RawMessage                 `json:"version"`
+	Tables    map[string]fakePinotTable       `json:"tables"`
+	Schemas   map[string]json.RawMessage      `json:"schemas"`
+	Instances map[string]json.RawMessage      `json:"instances"`
+	Tenants   json.RawMessage                 `json:"tenants"`
+	Tasks     map[string]map[string]string    `json:"tasks"`
+	Leaders   map[string]fakePinotLeaderEntry `json:"leaders"`
+	// Names from /periodictask/names, and the metrics the controller serves in the text format
+	PeriodicTasks     []string `json:"periodicTasks"`
+	ControllerMetrics string   `json:"controllerMetrics"`
+	// Status of rebalance and reload jobs, by job id
+	RebalanceStatus map[string]json.RawMessage `json:"rebalanceStatus"`
+	ReloadStatus    map[string]json.RawMessage `json:"reloadStatus"`
+}
+
+type fakePinotTable struct {
+	Config                json.RawMessage `json:"config"`
+	Size                  json.RawMessage `json:"size"`
+	Segments              json.RawMessage `json:"segments"`
+	ConsumingSegmentsInfo json.RawMessage `json:"consumingSegmentsInfo"`
+	PauseStatus           json.RawMessage `json:"pauseStatus"`
+	ExternalView          json.RawMessage `json:"externalView"`
+	// Segment metadata by table type
+	SegmentsMetadata map[string]json.RawMessage `json:"segmentsMetadata"`
+	Jobs             json.RawMessage            `json:"jobs"`
+	// Instance names of the brokers of the table, all served by the fake itself
+	Brokers      []string        `json:"brokers"`
+	TimeBoundary json.RawMessage `json:"timeBoundary"`
+	RoutingTable json.RawMessage `json:"routingTable"`
+}
+
+type fakePinotLeaderEntry struct {
+	LeadControllerId string   `json:"leadControllerId"`
+	TableNames       []string `json:"tableNames"`
+}
+
+// Start a fake controller serving the given fixture. It is stopped when the test ends.
+func newFakePinot(t *testing.T, fixture string) *fakePinot {
+	data, err := os.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakePinot{requests: make(map[string]int)}
+	err = json.Unmarshal(data, &f.cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("GET /version", func(w http.ResponseWriter, r *http.Request) {
+		f.writeRaw(w, f.cluster.Version)
+	})
+	mux.HandleFunc("GET /tables", f.handleTables)
+	mux.HandleFunc("GET /tables/{$}", f.handleTables)
+	mux.HandleFunc("GET /tables/{table}", f.tableHandler(func(table fakePinotTable) json.RawMessage { return table.Config }))
+	mux.HandleFunc("GET /tables/{table}/size", f.tableHandler(func(table fakePinotTable) json.RawMessage { return table.Size }))
+	mux.HandleFunc("GET /tables/{table}/consumingSegmentsInfo", f.tableHandler(func(table fakePinotTable) json.RawMessage { return table.ConsumingSegmentsInfo }))
+	mux.HandleFunc("GET /tables/{table}/pauseStatus", f.tableHandler(func(table fakePinotTable) json.RawMessage { return table.PauseStatus }))
+	mux.HandleFunc("GET /tables/{table}/externalview", f.tableHandler(func(table fakePinotTable) json.RawMessage { return table.ExternalView }))
+	// Reload status shares its path pattern with the segments of a table
+	mux.HandleFunc("GET /segments/{table}/{resource}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("table") == "segmentReloadStatus" {
+			f.writeRaw(w, f.cluster.ReloadStatus[r.PathValue("resource")])
+			return
+		}
+		table, ok := f.cluster.Tables[r.PathValue("table")]
+		if !ok || r.PathValue("resource") != "metadata" {
+			http.Error(w, `{"code": 404, "error": "Table not found"}`, http.StatusNotFound)
+			return
+		}
+		metadata, ok := table.SegmentsMetadata[r.URL.Query().Get("type")]
+		if !ok {
+			metadata = json.RawMessage(`{}`)
+		}
+		f.writeRaw(w, metadata)
+	})
+	mux.HandleFunc("GET /segments/{table}", f.tableHandler(func(table fakePinotTable) json.RawMessage { return table.Segments }))
+	mux.HandleFunc("GET /table/{table}/jobs", f.tableHandler(func(table fakePinotTable) json.RawMessage { return table.Jobs }))
+	mux.HandleFunc("GET /rebalanceStatus/{jobId}", func(w http.ResponseWriter, r *http.Request) {
+		f.writeRaw(w, f.cluster.RebalanceStatus[r.PathValue("jobId")])
+	})
+	mux.HandleFunc("GET /tableConfigs/{table}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("table")
+		table, ok := f.cluster.Tables[name]
+		if !ok {
+			http.Error(w, `{"code": 404, "error": "Table not found"}`, http.StatusNotFound)
+			return
+		}
+		var configs map[string]json.RawMessage
+		json.Unmarshal(table.Config, &configs)
+		f.writeJSON(w, map[string]interface{}{
+			"tableName": name,
+			"offline":   configs["OFFLINE"],
+			"realtime":  configs["REALTIME"],
+			"schema":    f.cluster.Schemas[name],
+		})
+	})
+	mux.HandleFunc("GET /schemas", func(w http.ResponseWriter, r *http.Request) {
+		f.writeJSON(w, sortedKeys(f.cluster.Schemas))
+	})
+	mux.HandleFunc("GET /schemas/{schema}", func(w http.ResponseWriter, r *http.Request) {
+		f.writeRaw(w, f.cluster.Schemas[r.PathValue("schema")])
+	})
+	mux.HandleFunc("GET /instances", func(w http.ResponseWriter, r *http.Request) {
+		f.writeJSON(w, map[string][]string{"instances": sortedKeys(f.cluster.Instances)})
+	})
+	mux.HandleFunc("GET /instances/{instance}", func(w http.ResponseWriter, r *http.Request) {
+		f.writeRaw(w, f.cluster.Instances[r.PathValue("instance")])
+	})
+	mux.HandleFunc("GET /tenants", func(w http.ResponseWriter, r *http.Request) {
+		f.writeRaw(w, f.cluster.Tenants)
+	})
+	mux.HandleFunc("GET /tenants/{tenant}/tables", func(w http.ResponseWriter, r *http.Request) {
+		// Listed with their type, as some releases do
+		tables := []string{}
+		for _, name := range sortedKeys(f.cluster.Tables) {
+			for tableType, config := range f.tableConfigs(name) {
+				if config.Tenants.Server == r.PathValue("tenant") {
+					tables = append(tables, name+"_"+tableType)
+				}
+			}
+		}
+		f.writeJSON(w, map[string][]string{"tables": tables})
+	})
+	mux.HandleFunc("GET /tasks/tasktypes", func(w http.ResponseWriter, r *http.Request) {
+		f.writeJSON(w, sortedKeys(f.cluster.Tasks))
+	})
+	mux.HandleFunc("GET /tasks/{taskType}/taskstates", func(w http.ResponseWriter, r *http.Request) {
+		states, ok := f.cluster.Tasks[r.PathValue("taskType")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		f.writeJSON(w, states)
+	})
+	mux.HandleFunc("GET /periodictask/names", func(w http.ResponseWriter, r *http.Request) {
+		f.writeJSON(w, f.cluster.PeriodicTasks)
+	})
+	// The metrics of the controller, served on the same port
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(f.cluster.ControllerMetrics))
+	})
+	mux.HandleFunc("GET /v2/brokers/tables/{table}", func(w http.ResponseWriter, r *http.Request) {
+		host, port, _ := net.SplitHostPort(strings.TrimPrefix(f.server.URL, "http://"))
+		portNumber, _ := strconv.Atoi(port)
+		brokers := []BrokerInfo{}
+		for _, name := range f.cluster.Tables[r.PathValue("table")].Brokers {
+			brokers = append(brokers, BrokerInfo{InstanceName: name, Host: host, Port: portNumber})
+		}
+		f.writeJSON(w, brokers)
+	})
+	mux.HandleFunc("GET /debug/timeBoundary/{table}", f.tableHandler(func(table fakePinotTable) json.RawMessage { return table.TimeBoundary }))
+	mux.HandleFunc("GET /debug/routingTable/{table}", f.tableHandler(func(table fakePinotTable) json.RawMessage { return table.RoutingTable }))
+	mux.HandleFunc("GET /leader/tables", func(w http.ResponseWriter, r *http.Request) {
+		f.writeJSON(w, map[string]interface{}{
+			"leadControllerResourceEnabled": true,
+			"leadControllerEntryMap":        f.cluster.Leaders,
+		})
+	})
+
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Serve one request at a time, so tests can change the cluster safely
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		f.requests[r.URL.Path]++
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakePinot) URL() string {
+	return f.server.URL
+}
+
+// Change the cluster while it is served
+func (f *fakePinot) update(change func(cluster *fakePinotCluster)) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	change(&f.cluster)
+}
+
+// How many requests were made for the given path
+func (f *fakePinot) requestCount(path string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.requests[path]
+}
+
+// List the tables, or those of a type with ?type=offline or ?type=realtime
+func (f *fakePinot) handleTables(w http.ResponseWriter, r *http.Request) {
+	tableType := strings.ToUpper(r.URL.Query().Get("type"))
+	tables := []string{}
+	for _, name := range sortedKeys(f.cluster.Tables) {
+		if _, ok := f.tableConfigs(name)[tableType]; ok || tableType == "" {
+			tables = append(tables, name)
+		}
+	}
+	f.writeJSON(w, map[string][]string{"tables": tables})
+}
+
+// The configs of a table by type
+func (f *fakePinot) tableConfigs(name string) map[string]TableConfig {
+	var configs map[string]TableConfig
+	json.Unmarshal(f.cluster.Tables[name].Config, &configs)
+	return configs
+}
+
+// Serve one of the responses of the table in the path, or 404 if there is no such table
+func (f *fakePinot) tableHandler(response func(table fakePinotTable) json.RawMessage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		table, ok := f.cluster.Tables[r.PathValue("table")]
+		if !ok {
+			http.Error(w, `{"code": 404, "error": "Table not found"}`, http.StatusNotFound)
+			return
+		}
+		f.writeRaw(w, response(table))
+	}
+}
+
+func (f *fakePinot) writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.writeRaw(w, data)
+}
+
+func (f *fakePinot) writeRaw(w http.ResponseWriter, data json.RawMessage) {
+	if data == nil {
+		http.Error(w, `{"code": 404, "error": "Not found"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
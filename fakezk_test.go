@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// ZooKeeper opcodes and error codes used by the discovery
+const (
+	zkOpGetData      = 4
+	zkOpPing         = 11
+	zkOpGetChildren2 = 12
+	zkOpSetWatches   = 101
+	zkOpClose        = -11
+
+	zkErrNoNode        = -101
+	zkErrUnimplemented = -6
+
+	zkEventNodeChildrenChanged = 4
+	zkStateSyncConnected       = 3
+)
+
+/*
+An in-process ZooKeeper server that speaks enough of the wire protocol for the discovery:
+sessions, getChildren2, getData, pings and child watches, which are registered again
+by setWatches after a reconnect. Sessions can be expired, like a real server does
+when a client is partitioned for longer than its session timeout.
+*/
+type fakeZKServer struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	// node data by full path
+	nodes       map[string][]byte
+	lastSession int64
+	// the connection of each live session
+	sessions map[int64]net.Conn
+	// sessions watching the children of each path
+	childWatches map[string][]int64
+}
+
+func newFakeZKServer(t *testing.T, paths map[string]string) *fakeZKServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeZKServer{
+		listener:     listener,
+		nodes:        map[string][]byte{"/": nil},
+		sessions:     make(map[int64]net.Conn),
+		childWatches: make(map[string][]int64),
+	}
+	for nodePath, data := range paths {
+		server.create(nodePath, data)
+	}
+	go server.serve()
+	t.Cleanup(server.close)
+	return server
+}
+
+func (s *fakeZKServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeZKServer) close() {
+	s.listener.Close()
+	s.ExpireSessions()
+}
+
+// Create a node and its parents, firing the child watches of its parent
+func (s *fakeZKServer) Create(nodePath string, data string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.create(nodePath, data)
+	parent := path.Dir(nodePath)
+	for _, session := range s.childWatches[parent] {
+		if conn, ok := s.sessions[session]; ok {
+			var event bytes.Buffer
+			writeZKInt32(&event, zkEventNodeChildrenChanged)
+			writeZKInt32(&event, zkStateSyncConnected)
+			writeZKString(&event, parent)
+			writeZKReply(conn, -1, 0, event.Bytes())
+		}
+	}
+	delete(s.childWatches, parent)
+}
+
+func (s *fakeZKServer) create(nodePath string, data string) {
+	for p := nodePath; p != "/"; p = path.Dir(p) {
+		if _, exists := s.nodes[p]; !exists {
+			s.nodes[p] = nil
+		}
+	}
+	s.nodes[nodePath] = []byte(data)
+}
+
+// Expire all sessions, dropping their connections and watches
+func (s *fakeZKServer) ExpireSessions() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for session, conn := range s.sessions {
+		conn.Close()
+		delete(s.sessions, session)
+	}
+	s.childWatches = make(map[string][]int64)
+}
+
+// The sessions watching the children of a path
+func (s *fakeZKServer) ChildWatches(nodePath string) []int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return slices.Clone(s.childWatches[nodePath])
+}
+
+func (s *fakeZKServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeZKServer) handle(conn net.Conn) {
+	defer conn.Close()
+	packet, err := readZKPacket(conn)
+	if err != nil {
+		return
+	}
+	// connect request: protocol version, last zxid, timeout, session id, password
+	timeout := int32(binary.BigEndian.Uint32(packet[12:16]))
+	session := int64(binary.BigEndian.Uint64(packet[16:24]))
+
+	s.mutex.Lock()
+	if _, live := s.sessions[session]; session != 0 && !live {
+		s.mutex.Unlock()
+		// a session id of 0 tells the client its session expired
+		var response bytes.Buffer
+		writeZKInt32(&response, 0)
+		writeZKInt32(&response, 0)
+		binary.Write(&response, binary.BigEndian, int64(0))
+		writeZKBuffer(&response, make([]byte, 16))
+		writeZKPacket(conn, response.Bytes())
+		return
+	}
+	if session == 0 {
+		s.lastSession++
+		session = s.lastSession
+	}
+	s.sessions[session] = conn
+	s.mutex.Unlock()
+
+	var response bytes.Buffer
+	writeZKInt32(&response, 0)
+	writeZKInt32(&response, timeout)
+	binary.Write(&response, binary.BigEndian, session)
+	writeZKBuffer(&response, make([]byte, 16))
+	if writeZKPacket(conn, response.Bytes()) != nil {
+		return
+	}
+
+	for {
+		packet, err := readZKPacket(conn)
+		if err != nil {
+			return
+		}
+		xid := int32(binary.BigEndian.Uint32(packet[0:4]))
+		opcode := int32(binary.BigEndian.Uint32(packet[4:8]))
+		body := bytes.NewReader(packet[8:])
+		s.mutex.Lock()
+		switch opcode {
+		case zkOpPing:
+			writeZKReply(conn, xid, 0, nil)
+		case zkOpGetChildren2, zkOpGetData:
+			nodePath := readZKString(body)
+			watch, _ := body.ReadByte()
+			data, exists := s.nodes[nodePath]
+			if !exists {
+				writeZKReply(conn, xid, zkErrNoNode, nil)
+				break
+			}
+			var reply bytes.Buffer
+			if opcode == zkOpGetData {
+				writeZKBuffer(&reply, data)
+			} else {
+				var children []string
+				for p := range s.nodes {
+					if p != "/" && path.Dir(p) == nodePath {
+						children = append(children, path.Base(p))
+					}
+				}
+				slices.Sort(children)
+				writeZKInt32(&reply, int32(len(children)))
+				for _, child := range children {
+					writeZKString(&reply, child)
+				}
+				if watch == 1 {
+					s.childWatches[nodePath] = append(s.childWatches[nodePath], session)
+				}
+			}
+			// an all zero stat
+			reply.Write(make([]byte, 68))
+			writeZKReply(conn, xid, 0, reply.Bytes())
+		case zkOpSetWatches:
+			// relative zxid, then data, exist and child watches
+			body.Seek(8, io.SeekCurrent)
+			for kind := 0; kind < 3; kind++ {
+				for _, nodePath := range readZKStrings(body) {
+					if kind == 2 {
+						s.childWatches[nodePath] = append(s.childWatches[nodePath], session)
+					}
+				}
+			}
+			writeZKReply(conn, xid, 0, nil)
+		case zkOpClose:
+			delete(s.sessions, session)
+			writeZKReply(conn, xid, 0, nil)
+			s.mutex.Unlock()
+			return
+		default:
+			writeZKReply(conn, xid, zkErrUnimplemented, nil)
+		}
+		s.mutex.Unlock()
+	}
+}
+
+func readZKPacket(conn net.Conn) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, binary.BigEndian.Uint32(length[:]))
+	_, err := io.ReadFull(conn, packet)
+	return packet, err
+}
+
+func writeZKPacket(conn net.Conn, packet []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(packet)))
+	_, err := conn.Write(append(length[:], packet...))
+	return err
+}
+
+// Reply with a header of xid, zxid and error code, followed by the body
+func writeZKReply(conn net.Conn, xid int32, errCode int32, body []byte) {
+	var reply bytes.Buffer
+	writeZKInt32(&reply, xid)
+	binary.Write(&reply, binary.BigEndian, int64(0))
+	writeZKInt32(&reply, errCode)
+	reply.Write(body)
+	writeZKPacket(conn, reply.Bytes())
+}
+
+func writeZKInt32(buf *bytes.Buffer, value int32) {
+	binary.Write(buf, binary.BigEndian, value)
+}
+
+func writeZKBuffer(buf *bytes.Buffer, data []byte) {
+	writeZKInt32(buf, int32(len(data)))
+	buf.Write(data)
+}
+
+func writeZKString(buf *bytes.Buffer, value string) {
+	writeZKBuffer(buf, []byte(value))
+}
+
+func readZKString(body *bytes.Reader) string {
+	var length int32
+	binary.Read(body, binary.BigEndian, &length)
+	if length <= 0 {
+		return ""
+	}
+	value := make([]byte, length)
+	io.ReadFull(body, value)
+	return string(value)
+}
+
+func readZKStrings(body *bytes.Reader) []string {
+	var count int32
+	binary.Read(body, binary.BigEndian, &count)
+	var values []string
+	for i := int32(0); i < count; i++ {
+		values = append(values, readZKString(body))
+	}
+	return values
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// Type of an instance from its name, e.g. Server_pinot-server-0_8098 is a server
+func instanceType(instanceName string) string {
+	for _, prefix := range []string{"Controller", "Broker", "Server", "Minion"} {
+		if strings.HasPrefix(instanceName, prefix+"_") {
+			return strings.ToLower(prefix)
+		}
+	}
+	return "unknown"
+}
+
+// Export the number of instances of each type in a cluster, and how many of them are disabled
+func collectInstances(ctx context.Context, target *ClusterTarget) error {
+	controller := target.Controller
+	cluster := controller.String()
+	names, err := controller.ListInstances(ctx)
+	if err != nil {
+		return err
+	}
+	total := map[string]int{"controller": 0, "broker": 0, "server": 0, "minion": 0}
+	disabled := map[string]int{"controller": 0, "broker": 0, "server": 0, "minion": 0}
+	for _, name := range names {
+		instance, err := controller.GetInstance(ctx, name)
+		if err != nil {
+			return err
+		}
+		instanceType := instanceType(name)
+		total[instanceType]++
+		if !instance.Enabled {
+			disabled[instanceType]++
+		}
+	}
+	for instanceType, count := range total {
+		Instances.WithLabelValues(cluster, instanceType).Set(float64(count))
+		InstancesDisabled.WithLabelValues(cluster, instanceType).Set(float64(disabled[instanceType]))
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Types of the controller jobs we follow
+const (
+	jobTypeRebalance = "TABLE_REBALANCE"
+	jobTypeReload    = "RELOAD_SEGMENT"
+)
+
+/*
+How long a reload is taken as running while some of its servers could not be asked for their
+status. Their segments are never accounted for, so it would otherwise never finish.
+*/
+const reloadUnaccountedGrace = 15 * time.Minute
+
+// A job submitted to the controller for a table, e.g. a rebalance or a segment reload
+type TableJob struct {
+	JobId          string
+	JobType        string
+	TableName      string
+	SubmissionTime time.Time
+}
+
+// The status of a rebalance job, from GET /rebalanceStatus/{jobId}
+type RebalanceStatus struct {
+	ProgressStats struct {
+		// IN_PROGRESS, DONE, FAILED, NO_OP, ABORTED or CANCELLED
+		Status                     string `json:"status"`
+		StartTimeMs                int64  `json:"startTimeMs"`
+		CurrentToTargetConvergence struct {
+			SegmentsToRebalance int `json:"_segmentsToRebalance"`
+		} `json:"currentToTargetConvergence"`
+	} `json:"tableRebalanceProgressStats"`
+}
+
+/*
+The status of a segment reload job, from GET /segments/segmentReloadStatus/{jobId}.
+Only newer releases report failureCount.
+*/
+type ReloadStatus struct {
+	TotalSegmentCount               int     `json:"totalSegmentCount"`
+	SuccessCount                    int     `json:"successCount"`
+	FailureCount                    int     `json:"failureCount"`
+	TotalServerCallsFailed          int     `json:"totalServerCallsFailed"`
+	EstimatedTimeRemainingInMinutes float64 `json:"estimatedTimeRemainingInMinutes"`
+}
+
+func (s RebalanceStatus) InProgress() bool {
+	return s.ProgressStats.Status == "IN_PROGRESS"
+}
+
+// Whether the rebalance ended, one way or another. Its status won't change anymore
+func (s RebalanceStatus) Finished() bool {
+	return s.ProgressStats.Status != "" && !s.InProgress()
+}
+
+// Segments yet to be reloaded. Those that failed to reload are done too
+func (s ReloadStatus) SegmentsPending() int {
+	return max(s.TotalSegmentCount-s.SuccessCount-s.FailureCount, 0)
+}
+
+/*
+Whether a reload submitted elapsed ago is still running. Once some servers could not be asked,
+the reload is only taken as running for reloadUnaccountedGrace.
+*/
+func (s ReloadStatus) InProgress(elapsed time.Duration) bool {
+	if s.SegmentsPending() == 0 {
+		return false
+	}
+	return s.TotalServerCallsFailed == 0 || elapsed < reloadUnaccountedGrace
+}
+
+/*
+List the rebalance and reload jobs of a table, from GET /table/{tableName}/jobs.
+Controllers older than the jobs API respond with 404, which is the same as no jobs.
+*/
+func (c *PinotController) GetTableJobs(ctx context.Context, tableName string) ([]TableJob, error) {
+	// Job metadata as stored by the controller, all values are strings
+	var pinotResponse map[string]map[string]string
+	apiPath := fmt.Sprintf("/table/%s/jobs?jobTypes=%s,%s", url.PathEscape(tableName), jobTypeRebalance, jobTypeReload)
+	err := c.getJSON(ctx, c.leaderFor(tableName), apiPath, &pinotResponse)
+	var statusErr *PinotStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == 404 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed listing jobs of table %s from %s: %w", tableName, c, err)
+	}
+	jobs := make([]TableJob, 0, len(pinotResponse))
+	for jobId, metadata := range pinotResponse {
+		job := TableJob{JobId: jobId, JobType: metadata["jobType"], TableName: metadata["tableName"]}
+		if submitted, err := strconv.ParseInt(metadata["submissionTimeMs"], 10, 64); err == nil {
+			job.SubmissionTime = time.UnixMilli(submitted)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (c *PinotController) GetRebalanceStatus(ctx context.Context, jobId string) (RebalanceStatus, error) {
+	var status RebalanceStatus
+	err := c.getJSON(ctx, "", fmt.Sprintf("/rebalanceStatus/%s", url.PathEscape(jobId)), &status)
+	if err != nil {
+		return status, fmt.Errorf("failed getting status of rebalance job %s from %s: %w", jobId, c, err)
+	}
+	return status, nil
+}
+
+func (c *PinotController) GetReloadStatus(ctx context.Context, jobId string) (ReloadStatus, error) {
+	var status ReloadStatus
+	err := c.getJSON(ctx, "", fmt.Sprintf("/segments/segmentReloadStatus/%s", url.PathEscape(jobId)), &status)
+	if err != nil {
+		return status, fmt.Errorf("failed getting status of reload job %s from %s: %w", jobId, c, err)
+	}
+	return status, nil
+}
+
+/*
+Export the rebalance and reload jobs of a table that are still running: how many,
+how long the oldest one has been running, and how many segments they have left.
+The controller keeps the last jobs of every table around long after they are done, so jobs
+found finished are remembered in the table cache and not checked again.
+*/
+func collectJobs(ctx context.Context, controller PinotControllerInterface, tableCache *TableCache, table string, now time.Time) error {
+	cluster := controller.String()
+	jobs, err := controller.GetTableJobs(ctx, table)
+	if err != nil {
+		return err
+	}
+	previouslyFinished := tableCache.FinishedJobs(table)
+	finished := make(map[string]bool)
+	inProgress := map[string]int{jobTypeRebalance: 0, jobTypeReload: 0}
+	oldest := map[string]time.Duration{jobTypeRebalance: 0, jobTypeReload: 0}
+	pending := map[string]int{jobTypeRebalance: 0, jobTypeReload: 0}
+	for _, job := range jobs {
+		if previouslyFinished[job.JobId] {
+			finished[job.JobId] = true
+			continue
+		}
+		age := now.Sub(job.SubmissionTime)
+		var running bool
+		var segments int
+		switch job.JobType {
+		case jobTypeRebalance:
+			status, err := controller.GetRebalanceStatus(ctx, job.JobId)
+			if isNotFound(err) {
+				finished[job.JobId] = true
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			running = status.InProgress()
+			finished[job.JobId] = status.Finished()
+			segments = status.ProgressStats.CurrentToTargetConvergence.SegmentsToRebalance
+		case jobTypeReload:
+			status, err := controller.GetReloadStatus(ctx, job.JobId)
+			if isNotFound(err) {
+				finished[job.JobId] = true
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			running = status.InProgress(age)
+			finished[job.JobId] = !running
+			segments = status.SegmentsPending()
+		default:
+			continue
+		}
+		if !running {
+			continue
+		}
+		inProgress[job.JobType]++
+		pending[job.JobType] += segments
+		oldest[job.JobType] = max(oldest[job.JobType], age)
+	}
+	tableCache.RecordFinishedJobs(table, finished)
+	for jobType, count := range inProgress {
+		TableJobsInProgress.WithLabelValues(cluster, table, jobType).Set(float64(count))
+		TableJobOldestAgeSeconds.WithLabelValues(cluster, table, jobType).Set(oldest[jobType].Seconds())
+		TableJobSegmentsPending.WithLabelValues(cluster, table, jobType).Set(float64(pending[jobType]))
+	}
+	return nil
+}
+
+// Whether the controller responded that what was asked for does not exist, e.g. a job it no longer keeps
+func isNotFound(err error) bool {
+	var statusErr *PinotStatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == 404
+}
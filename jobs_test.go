@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectJobs(t *testing.T) {
+	fake := newFakePinot(t, fakePinotFixture)
+	controller := NewPinotController("jobs", fake.URL())
+	tableCache := &TableCache{}
+	ctx := context.Background()
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	err := collectJobs(ctx, controller, tableCache, "airlineStats", now)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(TableJobsInProgress.WithLabelValues("jobs", "airlineStats", jobTypeRebalance)))
+	assert.Equal(t, 4.0, testutil.ToFloat64(TableJobSegmentsPending.WithLabelValues("jobs", "airlineStats", jobTypeRebalance)))
+	assert.Equal(t, 3600.0, testutil.ToFloat64(TableJobOldestAgeSeconds.WithLabelValues("jobs", "airlineStats", jobTypeRebalance)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(TableJobsInProgress.WithLabelValues("jobs", "airlineStats", jobTypeReload)))
+	assert.Equal(t, 3.0, testutil.ToFloat64(TableJobSegmentsPending.WithLabelValues("jobs", "airlineStats", jobTypeReload)))
+	assert.Equal(t, 1200.0, testutil.ToFloat64(TableJobOldestAgeSeconds.WithLabelValues("jobs", "airlineStats", jobTypeReload)))
+	// Finished jobs, and those the controller no longer has the status of, are not checked again
+	err = collectJobs(ctx, controller, tableCache, "airlineStats", now)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, fake.requestCount("/rebalanceStatus/rebalance-done"))
+	assert.Equal(t, 1, fake.requestCount("/segments/segmentReloadStatus/reload-old"))
+	assert.Equal(t, 2, fake.requestCount("/rebalanceStatus/rebalance-running"))
+
+	// Tables without jobs, or controllers without the jobs API, have nothing in progress
+	err = collectJobs(ctx, controller, tableCache, "githubEvents", now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, testutil.ToFloat64(TableJobsInProgress.WithLabelValues("jobs", "githubEvents", jobTypeRebalance)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(TableJobOldestAgeSeconds.WithLabelValues("jobs", "githubEvents", jobTypeReload)))
+
+	// Finished jobs are no longer counted, including reloads with failed segments
+	fake.update(func(cluster *fakePinotCluster) {
+		cluster.ReloadStatus["reload-running"] = []byte(`{"totalSegmentCount": 10, "successCount": 8, "failureCount": 2}`)
+	})
+	err = collectJobs(ctx, controller, tableCache, "airlineStats", now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, testutil.ToFloat64(TableJobsInProgress.WithLabelValues("jobs", "airlineStats", jobTypeReload)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(TableJobSegmentsPending.WithLabelValues("jobs", "airlineStats", jobTypeReload)))
+
+	// A rebalance stuck for days is still running
+	err = collectJobs(ctx, controller, tableCache, "airlineStats", now.Add(72*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(TableJobsInProgress.WithLabelValues("jobs", "airlineStats", jobTypeRebalance)))
+	assert.Equal(t, (73 * time.Hour).Seconds(), testutil.ToFloat64(TableJobOldestAgeSeconds.WithLabelValues("jobs", "airlineStats", jobTypeRebalance)))
+}
+
+func TestReloadStatusInProgress(t *testing.T) {
+	running := ReloadStatus{TotalSegmentCount: 10, SuccessCount: 7}
+	assert.True(t, running.InProgress(48*time.Hour))
+	assert.Equal(t, 3, running.SegmentsPending())
+	// Segments of servers that could not be asked are only waited for a while
+	unaccounted := ReloadStatus{TotalSegmentCount: 10, SuccessCount: 7, TotalServerCallsFailed: 1}
+	assert.True(t, unaccounted.InProgress(time.Minute))
+	assert.False(t, unaccounted.InProgress(reloadUnaccountedGrace))
+}
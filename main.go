@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	//_ "net/http/pprof"
 	"time"
@@ -13,6 +16,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"go.uber.org/zap"
 )
 
@@ -22,38 +26,407 @@ var (
 		Name: "pinotexporter_table_size_bytes",
 		Help: "Table size in bytes",
 	},
-		[]string{"table"},
+		[]string{"cluster", "table"},
 	)
+	ControllerUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_controller_up",
+		Help: "Whether the last request or health check to a Pinot controller succeeded",
+	},
+		[]string{"cluster", "controller"},
+	)
+	TablesExcluded = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_tables_excluded",
+		Help: "Tables of a cluster that are not collected, as they don't pass the table filters",
+	},
+		[]string{"cluster"},
+	)
+	CollectionsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pinotexporter_collections_skipped_total",
+		Help: "Table collections skipped because the previous collection of the table was still running",
+	},
+		[]string{"cluster"},
+	)
+	PinotVersionInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_pinot_version_info",
+		Help: "Version of the Pinot controllers of a cluster, as reported by /version. Always 1",
+	},
+		[]string{"cluster", "version"},
+	)
+	Instances = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_instances",
+		Help: "Instances of a cluster by type (controller, broker, server, minion)",
+	},
+		[]string{"cluster", "instance_type"},
+	)
+	InstancesDisabled = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_instances_disabled",
+		Help: "Disabled instances of a cluster by type",
+	},
+		[]string{"cluster", "instance_type"},
+	)
+	MinionTasks = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_minion_tasks",
+		Help: "Minion tasks of a cluster by task type and state",
+	},
+		[]string{"cluster", "task_type", "state"},
+	)
+	PeriodicTaskRuns = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_periodic_task_runs",
+		Help: "Runs of a periodic task of the controllers of a cluster, summed over the controllers since they started",
+	},
+		[]string{"cluster", "task"},
+	)
+	PeriodicTaskErrors = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_periodic_task_errors",
+		Help: "Failed runs of a periodic task of the controllers of a cluster, summed over the controllers since they started",
+	},
+		[]string{"cluster", "task"},
+	)
+	PeriodicTaskTablesProcessed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_periodic_task_tables_processed",
+		Help: "Tables processed by the last run of a periodic task, summed over the controllers, which each process the tables they lead",
+	},
+		[]string{"cluster", "task"},
+	)
+	PeriodicTaskLastRunTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_periodic_task_last_run_timestamp_seconds",
+		Help: "When the exporter last saw a periodic task run on a controller of a cluster, to within the interval of the periodic_tasks collector. Absent until a run is seen",
+	},
+		[]string{"cluster", "task"},
+	)
+	CollectorDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pinotexporter_collector_duration_seconds",
+		Help:    "How long the runs of a collector take, over all tables for table collectors",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+	},
+		[]string{"cluster", "collector"},
+	)
+	CollectorErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pinotexporter_collector_errors_total",
+		Help: "Runs of a collector that failed",
+	},
+		[]string{"cluster", "collector"},
+	)
+	SeriesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pinotexporter_series_dropped_total",
+		Help: "Series of a collector dropped or aggregated away to keep a cluster within its series limits, counted at every scrape",
+	},
+		[]string{"cluster", "collector"},
+	)
+	RateLimitWaitSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pinotexporter_rate_limit_wait_seconds_total",
+		Help: "Time requests to Pinot controllers spent waiting for the rate and concurrency limits",
+	},
+		[]string{"cluster"},
+	)
+	TableConfigInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_config_info",
+		Help: "Hashes of the config and schema of a table, changing whenever they do. Always 1",
+	},
+		[]string{"cluster", "table", "table_type", "config_hash", "schema_hash"},
+	)
+	TableSchemaColumns = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_schema_columns",
+		Help: "Number of columns in the schema of a table, by column type (dimension, metric, time)",
+	},
+		[]string{"cluster", "table", "column_type"},
+	)
+	TableReplication = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_replication",
+		Help: "Configured number of replicas of the segments of a table",
+	},
+		[]string{"cluster", "table", "table_type"},
+	)
+	TableRetentionSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_retention_seconds",
+		Help: "Configured retention of the segments of a table. 0 if they are kept forever",
+	},
+		[]string{"cluster", "table", "table_type"},
+	)
+	TableIndexColumns = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_index_columns",
+		Help: "Number of columns of a table with each kind of index",
+	},
+		[]string{"cluster", "table", "table_type", "index"},
+	)
+	TableSegments = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_segments",
+		Help: "Number of segments of a table in its external view",
+	},
+		[]string{"cluster", "table", "table_type"},
+	)
+	TableSegmentsUnderReplicated = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_segments_under_replicated",
+		Help: "Segments of a table served by fewer replicas than configured",
+	},
+		[]string{"cluster", "table", "table_type"},
+	)
+	TableSegmentsOverReplicated = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_segments_over_replicated",
+		Help: "Segments of a table served by more replicas than configured",
+	},
+		[]string{"cluster", "table", "table_type"},
+	)
+	TableDataTimeMinSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_data_time_min_seconds",
+		Help: "Start of the oldest data in the segments of a table, as a unix timestamp",
+	},
+		[]string{"cluster", "table", "table_type"},
+	)
+	TableDataTimeMaxSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_data_time_max_seconds",
+		Help: "End of the newest data in the completed segments of a table, as a unix timestamp",
+	},
+		[]string{"cluster", "table", "table_type"},
+	)
+	TableNewestSegmentAgeSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_newest_segment_age_seconds",
+		Help: "How long ago the newest data in the completed segments of a table ends",
+	},
+		[]string{"cluster", "table", "table_type"},
+	)
+	TableSegmentsOutOfRetention = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_segments_out_of_retention",
+		Help: "Segments of a table whose data is older than the configured retention",
+	},
+		[]string{"cluster", "table", "table_type"},
+	)
+	TableSegmentsOutOfRetentionBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_segments_out_of_retention_bytes",
+		Help: "Reported size of the segments of a table whose data is older than the configured retention",
+	},
+		[]string{"cluster", "table", "table_type"},
+	)
+	TableServerBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_server_bytes",
+		Help: "Bytes of the segments of a table on a server, as reported by the server",
+	},
+		[]string{"cluster", "table", "server"},
+	)
+	TableServerSegments = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_server_segments",
+		Help: "Number of segments of a table on a server",
+	},
+		[]string{"cluster", "table", "server"},
+	)
+	ServerBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_server_bytes",
+		Help: "Bytes of the segments of all collected tables on a server",
+	},
+		[]string{"cluster", "server"},
+	)
+	ServerSegments = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_server_segments",
+		Help: "Number of segments of all collected tables on a server",
+	},
+		[]string{"cluster", "server"},
+	)
+	TableJobsInProgress = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_jobs_in_progress",
+		Help: "Rebalance (TABLE_REBALANCE) and segment reload (RELOAD_SEGMENT) jobs of a table that are still running",
+	},
+		[]string{"cluster", "table", "job_type"},
+	)
+	TableJobOldestAgeSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_job_oldest_age_seconds",
+		Help: "Time since the oldest running job of a table was submitted. 0 if none is running",
+	},
+		[]string{"cluster", "table", "job_type"},
+	)
+	TableJobSegmentsPending = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_job_segments_pending",
+		Help: "Segments the running jobs of a table have yet to rebalance or reload",
+	},
+		[]string{"cluster", "table", "job_type"},
+	)
+	TableConsumptionPaused = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_consumption_paused",
+		Help: "Whether consumption of a realtime table is paused",
+	},
+		[]string{"cluster", "table"},
+	)
+	TableConsumptionPauseInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_consumption_pause_info",
+		Help: "Why consumption of a realtime table is paused, while it is. Always 1",
+	},
+		[]string{"cluster", "table", "reason"},
+	)
+	TableConsumptionPausedSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_consumption_paused_seconds",
+		Help: "How long consumption of a realtime table has been paused. 0 if it is not",
+	},
+		[]string{"cluster", "table"},
+	)
+	TableConsumingSegments = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_consuming_segments",
+		Help: "Replicas of the consuming segments of a realtime table, by consumer state",
+	},
+		[]string{"cluster", "table", "consumer_state"},
+	)
+	TableTimeBoundary = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_time_boundary",
+		Help: "Time boundary of a hybrid table on a broker, in the unit of its time column",
+	},
+		[]string{"cluster", "table", "broker"},
+	)
+	TableRoutedSegments = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_routed_segments",
+		Help: "Segments of a hybrid table a broker routes queries to on a server",
+	},
+		[]string{"cluster", "table", "table_type", "broker", "server"},
+	)
+	ServerAdminUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_server_admin_up",
+		Help: "Whether the last collection from the admin API of a server succeeded",
+	},
+		[]string{"cluster", "server"},
+	)
+	TableIndexBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_index_bytes",
+		Help: "Bytes of each kind of index of a table over all columns and replicas, as reported by the servers",
+	},
+		[]string{"cluster", "table", "table_type", "index"},
+	)
+	TableColumnBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_column_bytes",
+		Help: "Bytes of all indexes of a column of a table over all replicas, as reported by the servers",
+	},
+		[]string{"cluster", "table", "table_type", "column"},
+	)
+	TableRows = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_table_rows",
+		Help: "Rows of a table over all replicas, as reported by the servers",
+	},
+		[]string{"cluster", "table", "table_type"},
+	)
+	ServerConsumingSegments = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_server_consuming_segments",
+		Help: "Segments of a realtime table a server is consuming",
+	},
+		[]string{"cluster", "server", "table"},
+	)
+	ServerConsumerLagRecords = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pinotexporter_server_consumer_lag_records",
+		Help: "Records the consumers of a realtime table on a server are behind the stream, where reported",
+	},
+		[]string{"cluster", "server", "table"},
+	)
+	ConfigLastReloadSuccessful = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pinotexporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful",
+	})
+	ConfigLastReloadSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pinotexporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload",
+	})
+	ConfigHash = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pinotexporter_config_hash",
+		Help: "Hash of the configuration in use",
+	})
 )
 
-// yeah, yeah , this is a bad practice and we should pass logger explicitly everywhere..
-var logger *zap.SugaredLogger
+// Series with a table_type label, along with cluster and table
+func tableTypeMetrics() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{
+		TableConfigInfo, TableReplication, TableRetentionSeconds, TableIndexColumns,
+		TableSegments, TableSegmentsUnderReplicated, TableSegmentsOverReplicated,
+		TableDataTimeMinSeconds, TableDataTimeMaxSeconds, TableNewestSegmentAgeSeconds,
+		TableSegmentsOutOfRetention, TableSegmentsOutOfRetentionBytes,
+	}
+}
 
-/*
-FanOut consumer receives table updates from the tables channel and
-distributes messages to all interested recepients
-*/
+// Series with cluster and table labels, removed along with their table
+func tableMetrics() []*prometheus.GaugeVec {
+	metrics := append(tableTypeMetrics(), TableSizeBytes, TableSchemaColumns, TableServerBytes, TableServerSegments,
+		TableJobsInProgress, TableJobOldestAgeSeconds, TableJobSegmentsPending,
+		TableTimeBoundary, TableRoutedSegments)
+	return append(metrics, ingestionMetrics()...)
+}
 
-func tableFanOutConsumer(tables <-chan []string, tableCache TableCache, workerPool *CollectorWorkerPool) {
-	// First setup the refresh listener using another channel that this goroutine will copy into
-	tablesCopyForCache := make(chan []string)
-	tablesCopyForPool := make(chan []string)
-	go tableCache.TableRefreshChanListener(tablesCopyForCache)
-	go workerPool.SubscribeToTableUpdates(tablesCopyForPool)
+// Series of the realtime part of a table
+func ingestionMetrics() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{
+		TableConsumptionPaused, TableConsumptionPauseInfo, TableConsumptionPausedSeconds, TableConsumingSegments,
+	}
+}
 
-	for newTables := range tables {
-		// push record into the copy for TableRefreshChanListener
-		tablesCopyForCache <- newTables
-		// Inform the pool about table updates
-		tablesCopyForPool <- newTables
+// Remove the series of a table that is gone
+func deleteTableMetrics(cluster string, table string) {
+	for _, metric := range tableMetrics() {
+		metric.DeletePartialMatch(prometheus.Labels{"cluster": cluster, "table": table})
+	}
+}
 
+// Remove the series of a cluster that is no longer monitored
+func deleteClusterMetrics(cluster string) {
+	ControllerUp.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+	PinotVersionInfo.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+	TablesExcluded.DeleteLabelValues(cluster)
+	CollectionsSkipped.DeleteLabelValues(cluster)
+	RateLimitWaitSeconds.DeleteLabelValues(cluster)
+	CollectorDurationSeconds.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+	Instances.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+	InstancesDisabled.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+	MinionTasks.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+	CollectorErrors.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+	SeriesDropped.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+	ServerBytes.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+	ServerSegments.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+	deleteServerAdminMetrics(cluster)
+	deletePeriodicTaskMetrics(cluster)
+	for _, metric := range tableMetrics() {
+		metric.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
 	}
-	// Once the for loop ends, the channel is closed. Cleanup and return
-	close(tablesCopyForPool)
-	close(tablesCopyForCache)
-	return
+}
 
+// A series of a GaugeVec and its value
+type gaugeSeries struct {
+	labels prometheus.Labels
+	value  float64
 }
+
+/*
+Set the given series of metric, then delete its other series that match the given labels,
+e.g. of servers or brokers that are gone. Setting first means a scrape in between never
+misses a series that is still current.
+*/
+func replaceSeries(metric *prometheus.GaugeVec, match prometheus.Labels, series []gaugeSeries) {
+	current := make(map[string]bool)
+	for _, s := range series {
+		metric.With(s.labels).Set(s.value)
+		current[seriesKey("", labelPairs(s.labels))] = true
+	}
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		metric.Collect(metrics)
+		close(metrics)
+	}()
+	var stale []prometheus.Labels
+	for m := range metrics {
+		var pb dto.Metric
+		if m.Write(&pb) != nil {
+			continue
+		}
+		labels := make(prometheus.Labels)
+		for _, pair := range pb.GetLabel() {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		matches := true
+		for name, value := range match {
+			matches = matches && labels[name] == value
+		}
+		if matches && !current[seriesKey("", labelPairs(labels))] {
+			stale = append(stale, labels)
+		}
+	}
+	for _, labels := range stale {
+		metric.Delete(labels)
+	}
+}
+
+// yeah, yeah , this is a bad practice and we should pass logger explicitly everywhere..
+var logger *zap.SugaredLogger
+
 func main() {
 
 	// Seed the random number generator
@@ -75,43 +448,66 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	// IF Direct mode
-	if conf.Mode == "direct" {
-		logger.Info("Starting on Direct mode")
-		var tableCache TableCache
-		tables := make(chan []string)
-		workerPool := NewCollectorWorkerPool(conf.MaxParallelCollectors, conf.PinotController, tables)
-		defer workerPool.Close()
-
-		ctx := context.Background() // TODO set a timeout
-
-		go refreshTableCache(ctx, conf.PinotController, conf.PollFrequencySeconds, tables)
-		go tableFanOutConsumer(tables, tableCache, workerPool)
-
-		if err != nil {
-			panic(err)
-		}
+	logger.Infof("Starting on %s mode", conf.Mode)
+	discovery, err := NewPinotControllerDiscovery(conf)
+	if err != nil {
+		panic(err)
 	}
+	pinotManager, err := NewPinotManager(conf.MaxParallelCollectors, conf.PollFrequencySeconds, discovery)
+	if err != nil {
+		logger.Errorf("Can't create new PinotManager because: %s", err)
+		panic(err)
+	}
+	pinotManager.collectionInteval = conf.CollectionInterval()
+	pinotManager.collectionJitter = conf.CollectionJitter()
+	pinotManager.collectionTimeout = conf.CollectionTimeout()
+	pinotManager.leaderRouting = conf.LeaderRouting
+	pinotManager.collectors = conf.Collectors
+	pinotManager.SetRateLimits(conf.RateLimits)
+	pinotManager.SetTableFilter(conf.Tables)
+	pinotManager.SetRelabelConfigs(conf.RelabelConfigs)
+	pinotManager.SetSeriesLimits(conf.SeriesLimits)
+	pinotManager.SetControllerMetrics(conf.ControllerMetrics)
 
-	// IF Kubernetes MODE
-	if conf.Mode == "kubernetes" {
-		/*
-		   We need track know Pinot clusters and on each update:
-		   -
-		*/
-		logger.Info("Starting on Kubernetes mode")
-		kubeClient := NewKubePinotControllerCache(conf.ServiceDiscovery)
-		pinotManager, err := NewPinotManager(conf.MaxParallelCollectors, conf.PollFrequencySeconds, kubeClient)
-		if err != nil {
-			logger.Errorf("Can't create new PinotManager because: %s", err)
-			panic(err)
-		}
-		go pinotManager.refreshPinotsForever()
+	// Stop on SIGINT/SIGTERM, giving in-flight collections some time to finish
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go pinotManager.refreshPinotsForever(ctx)
 
+	// Reload the config on SIGHUP or when the file changes
+	reloader, err := NewConfigReloader(*configFilePath, conf, pinotManager)
+	if err != nil {
+		panic(err)
 	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go reloader.WatchForever(ctx, hup)
 
 	// Start serving metrics
-	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(fmt.Sprintf(":%d", conf.ListenPort), nil)
+	http.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(pinotManager.MetricsGatherer(prometheus.DefaultGatherer), promhttp.HandlerOpts{})))
+	http.HandleFunc("/-/healthy", healthyHandler)
+	http.HandleFunc("/-/ready", readyHandler(pinotManager))
+	http.HandleFunc("/status", statusHandler(pinotManager))
+	registerAPIHandlers(http.DefaultServeMux, pinotManager)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", conf.ListenPort)}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			logger.Errorf("HTTP server failed: %s", err)
+			stop()
+		}
+	}()
 
+	<-ctx.Done()
+	conf = reloader.Current()
+	logger.Infof("Shutting down, waiting up to %d seconds for collections to finish", conf.ShutdownTimeoutSeconds)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.ShutdownTimeoutSeconds)*time.Second)
+	defer cancel()
+	err = pinotManager.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.Warnf("Collections did not finish before shutdown: %s", err)
+	}
+	// Keep serving metrics while collections drain, so the last values can still be scraped
+	server.Shutdown(shutdownCtx)
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	// Most code logs through the package level logger, so make sure it is usable in tests
+	logger = zap.NewNop().Sugar()
+	os.Exit(m.Run())
+}
+
+func TestReplaceSeries(t *testing.T) {
+	metric := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_replace_series"}, []string{"cluster", "server"})
+	metric.WithLabelValues("a", "server-0").Set(1)
+	metric.WithLabelValues("a", "server-1").Set(1)
+	metric.WithLabelValues("b", "server-0").Set(1)
+
+	replaceSeries(metric, prometheus.Labels{"cluster": "a"}, []gaugeSeries{
+		{prometheus.Labels{"cluster": "a", "server": "server-0"}, 5},
+		{prometheus.Labels{"cluster": "a", "server": "server-2"}, 7},
+	})
+	assert.Equal(t, 5.0, testutil.ToFloat64(metric.WithLabelValues("a", "server-0")))
+	assert.Equal(t, 7.0, testutil.ToFloat64(metric.WithLabelValues("a", "server-2")))
+	// The stale series of the cluster is gone, other clusters are left alone
+	assert.False(t, metric.DeleteLabelValues("a", "server-1"))
+	assert.True(t, metric.DeleteLabelValues("b", "server-0"))
+}
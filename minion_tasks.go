@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Export the number of minion tasks of each type in each state, e.g. IN_PROGRESS or FAILED
+func collectMinionTasks(ctx context.Context, target *ClusterTarget) error {
+	controller := target.Controller
+	cluster := controller.String()
+	taskTypes, err := controller.ListTaskTypes(ctx)
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]map[string]int)
+	for _, taskType := range taskTypes {
+		states, err := controller.GetTaskStates(ctx, taskType)
+		if err != nil {
+			return err
+		}
+		counts[taskType] = make(map[string]int)
+		for _, state := range states {
+			counts[taskType][state]++
+		}
+	}
+	// Task types and states come and go
+	var series []gaugeSeries
+	for taskType, states := range counts {
+		for state, count := range states {
+			series = append(series, gaugeSeries{prometheus.Labels{"cluster": cluster, "task_type": taskType, "state": state}, float64(count)})
+		}
+	}
+	replaceSeries(MinionTasks, prometheus.Labels{"cluster": cluster}, series)
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectIngestion(t *testing.T) {
+	fake := newFakePinot(t, fakePinotFixture)
+	controller := NewPinotController("ingestion", fake.URL())
+	ctx := context.Background()
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	configs, err := controller.GetTableConfigs(ctx, "githubEvents")
+	assert.Nil(t, err)
+	err = collectIngestion(ctx, controller, "githubEvents", configs, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(TableConsumptionPaused.WithLabelValues("ingestion", "githubEvents")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(TableConsumptionPauseInfo.WithLabelValues("ingestion", "githubEvents", "ADMINISTRATIVE")))
+	assert.Equal(t, (12 * time.Hour).Seconds(), testutil.ToFloat64(TableConsumptionPausedSeconds.WithLabelValues("ingestion", "githubEvents")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(TableConsumingSegments.WithLabelValues("ingestion", "githubEvents", "CONSUMING")))
+
+	// Resumed
+	fake.update(func(cluster *fakePinotCluster) {
+		table := cluster.Tables["githubEvents"]
+		table.PauseStatus = []byte(`{"pauseFlag": false, "consumingSegments": [], "timestamp": "2024-01-01T18:00:00Z"}`)
+		cluster.Tables["githubEvents"] = table
+	})
+	err = collectIngestion(ctx, controller, "githubEvents", configs, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, testutil.ToFloat64(TableConsumptionPaused.WithLabelValues("ingestion", "githubEvents")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(TableConsumptionPausedSeconds.WithLabelValues("ingestion", "githubEvents")))
+	assert.False(t, TableConsumptionPauseInfo.DeleteLabelValues("ingestion", "githubEvents", "ADMINISTRATIVE"))
+
+	// Offline tables are skipped
+	configs.Realtime = nil
+	err = collectIngestion(ctx, controller, "githubEvents", configs, now)
+	assert.Nil(t, err)
+	assert.False(t, TableConsumptionPaused.DeleteLabelValues("ingestion", "githubEvents"))
+	assert.Equal(t, 2, fake.requestCount("/tables/githubEvents/pauseStatus"))
+}
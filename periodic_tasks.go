@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+/*
+Where the controllers serve their own metrics, under controller_metrics: in the config file,
+e.g. the port of the JMX exporter agent of the Pinot images. The same port and path
+are used for every controller of every cluster, on the host of its controller URL.
+*/
+type ControllerMetricsConfig struct {
+	// 0 (the default) means the controller metrics are not read
+	Port int `json:"port" yaml:"port"`
+	// Defaults to /metrics
+	Path string `json:"path" yaml:"path"`
+}
+
+func (c ControllerMetricsConfig) IsValid() error {
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid controller_metrics.port %d", c.Port)
+	}
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("controller_metrics.path %s should start with /", c.Path)
+	}
+	return nil
+}
+
+/*
+The metrics endpoint of the controllers of every cluster.
+Shared by all clusters, and updated in place when the config is reloaded.
+*/
+type ControllerMetrics struct {
+	mutex sync.Mutex
+	port  int
+	path  string
+}
+
+// Create from a valid config
+func NewControllerMetrics(config ControllerMetricsConfig) *ControllerMetrics {
+	m := &ControllerMetrics{}
+	m.Update(config)
+	return m
+}
+
+// Apply a new valid config
+func (m *ControllerMetrics) Update(config ControllerMetricsConfig) {
+	path := config.Path
+	if path == "" {
+		path = "/metrics"
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.port = config.Port
+	m.path = path
+}
+
+// The port and path of the metrics endpoint. The port is 0 when it is not configured
+func (m *ControllerMetrics) Endpoint() (int, string) {
+	if m == nil {
+		return 0, ""
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.port, m.path
+}
+
+// List the periodic tasks the controllers run, e.g. RetentionManager, from GET /periodictask/names
+func (c *PinotController) ListPeriodicTasks(ctx context.Context) ([]string, error) {
+	var names []string
+	err := c.getJSON(ctx, "", "/periodictask/names", &names)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing periodic tasks of %s: %w", c, err)
+	}
+	return names, nil
+}
+
+// Read the metrics a controller serves on the given port and path of the host of its URL
+func (c *PinotController) GetControllerMetrics(ctx context.Context, controllerURL string, port int, metricsPath string) (map[string]*dto.MetricFamily, error) {
+	parsed, err := url.Parse(controllerURL)
+	if err != nil {
+		return nil, err
+	}
+	metricsURL := c.instanceURL(parsed.Hostname(), port) + metricsPath
+	release, err := c.waitForLimiter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	req, err := http.NewRequestWithContext(ctx, "GET", metricsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, &PinotStatusError{URL: metricsURL, StatusCode: res.StatusCode}
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing metrics from %s: %w", metricsURL, err)
+	}
+	return families, nil
+}
+
+// What the metrics of a controller report of each periodic task, by task name
+type periodicTaskReport struct {
+	runs            map[string]float64
+	errors          map[string]float64
+	tablesProcessed map[string]float64
+}
+
+/*
+The last report of each controller, by cluster and controller URL, kept for when a controller
+fails to respond, and when each task was last seen running, by cluster and task name.
+*/
+var periodicTaskState = struct {
+	sync.Mutex
+	reports map[string]map[string]*periodicTaskReport
+	lastRun map[string]map[string]time.Time
+}{reports: make(map[string]map[string]*periodicTaskReport), lastRun: make(map[string]map[string]time.Time)}
+
+/*
+Read what the metrics of a controller report of the given periodic tasks. Pinot names the
+series after the task, in a label such as table, of the controllerPeriodicTaskRun and
+controllerPeriodicTaskError meters and the periodicTaskNumTablesProcessed gauge. The exact
+metric names depend on the rules of the exporter serving them, so families are matched
+on those names, and only the count of the meters is read, not their rates.
+*/
+func newPeriodicTaskReport(families map[string]*dto.MetricFamily, tasks map[string]bool) *periodicTaskReport {
+	report := &periodicTaskReport{
+		runs:            make(map[string]float64),
+		errors:          make(map[string]float64),
+		tablesProcessed: make(map[string]float64),
+	}
+	for name, family := range families {
+		name = strings.ToLower(name)
+		isCount := strings.HasSuffix(name, "_count") || strings.HasSuffix(name, "_total")
+		var values map[string]float64
+		switch {
+		case strings.Contains(name, "periodictaskrun") && isCount:
+			values = report.runs
+		case strings.Contains(name, "periodictaskerror") && isCount:
+			values = report.errors
+		case strings.Contains(name, "periodictasknumtablesprocessed"):
+			values = report.tablesProcessed
+		default:
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if tasks[label.GetValue()] {
+					values[label.GetValue()] += metricValue(metric)
+					break
+				}
+			}
+		}
+	}
+	return report
+}
+
+func metricValue(metric *dto.Metric) float64 {
+	switch {
+	case metric.Counter != nil:
+		return metric.GetCounter().GetValue()
+	case metric.Gauge != nil:
+		return metric.GetGauge().GetValue()
+	case metric.Untyped != nil:
+		return metric.GetUntyped().GetValue()
+	}
+	return 0
+}
+
+/*
+Collect the housekeeping of the controllers of a cluster: how often each periodic task
+(e.g. RetentionManager or SegmentStatusChecker) ran and failed, how many tables its last run
+processed, and when it was last seen running. The controller API only lists the tasks, so the
+rest is read from the metrics the controllers serve, as configured under controller_metrics.
+Pinot does not report how long the runs take. Controllers that don't respond count
+with what they reported the last time they did.
+*/
+func collectPeriodicTasks(ctx context.Context, target *ClusterTarget) error {
+	controller := target.Controller
+	cluster := controller.String()
+	port, metricsPath := target.ControllerMetrics.Endpoint()
+	if port == 0 {
+		return fmt.Errorf("controller_metrics.port is not set, so the periodic tasks of %s can't be collected", cluster)
+	}
+	names, err := controller.ListPeriodicTasks(ctx)
+	if err != nil {
+		return err
+	}
+	tasks := make(map[string]bool)
+	for _, name := range names {
+		tasks[name] = true
+	}
+
+	periodicTaskState.Lock()
+	lastReports := periodicTaskState.reports[cluster]
+	periodicTaskState.Unlock()
+
+	reports := make(map[string]*periodicTaskReport)
+	read := 0
+	for _, controllerURL := range controller.AllURLs() {
+		families, err := controller.GetControllerMetrics(ctx, controllerURL, port, metricsPath)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logger.Warnf("Failed to read the metrics of controller %s of %s: %s", controllerURL, cluster, err)
+			// Controllers that are no longer listed are forgotten
+			if report, ok := lastReports[controllerURL]; ok {
+				reports[controllerURL] = report
+			}
+			continue
+		}
+		read++
+		reports[controllerURL] = newPeriodicTaskReport(families, tasks)
+	}
+	if read == 0 {
+		return fmt.Errorf("none of the controllers of %s served metrics on port %d", cluster, port)
+	}
+
+	now := time.Now()
+	total := &periodicTaskReport{runs: make(map[string]float64), errors: make(map[string]float64), tablesProcessed: make(map[string]float64)}
+	periodicTaskState.Lock()
+	lastRun := periodicTaskState.lastRun[cluster]
+	if lastRun == nil {
+		lastRun = make(map[string]time.Time)
+	}
+	for controllerURL, report := range reports {
+		for task, runs := range report.runs {
+			total.runs[task] += runs
+			// A count that went down means the controller restarted, and ran the task since if it is not 0
+			if last, ok := lastReports[controllerURL]; ok && runs != last.runs[task] && runs > 0 {
+				lastRun[task] = now
+			}
+		}
+		for task, errors := range report.errors {
+			total.errors[task] += errors
+		}
+		for task, tables := range report.tablesProcessed {
+			total.tablesProcessed[task] += tables
+		}
+	}
+	for task := range lastRun {
+		if !tasks[task] {
+			delete(lastRun, task)
+		}
+	}
+	periodicTaskState.reports[cluster] = reports
+	periodicTaskState.lastRun[cluster] = lastRun
+	periodicTaskState.Unlock()
+	if len(total.runs) == 0 && len(tasks) > 0 {
+		return fmt.Errorf("no periodic task runs in the metrics of the controllers of %s on port %d", cluster, port)
+	}
+
+	// Tasks come and go with the config of the controllers
+	var runSeries, errorSeries, tableSeries, lastRunSeries []gaugeSeries
+	for task, runs := range total.runs {
+		runSeries = append(runSeries, gaugeSeries{prometheus.Labels{"cluster": cluster, "task": task}, runs})
+	}
+	for task, errors := range total.errors {
+		errorSeries = append(errorSeries, gaugeSeries{prometheus.Labels{"cluster": cluster, "task": task}, errors})
+	}
+	for task, tables := range total.tablesProcessed {
+		tableSeries = append(tableSeries, gaugeSeries{prometheus.Labels{"cluster": cluster, "task": task}, tables})
+	}
+	for task, when := range lastRun {
+		lastRunSeries = append(lastRunSeries, gaugeSeries{prometheus.Labels{"cluster": cluster, "task": task}, float64(when.Unix())})
+	}
+	clusterLabels := prometheus.Labels{"cluster": cluster}
+	replaceSeries(PeriodicTaskRuns, clusterLabels, runSeries)
+	replaceSeries(PeriodicTaskErrors, clusterLabels, errorSeries)
+	replaceSeries(PeriodicTaskTablesProcessed, clusterLabels, tableSeries)
+	replaceSeries(PeriodicTaskLastRunTimestamp, clusterLabels, lastRunSeries)
+	return nil
+}
+
+func periodicTaskMetrics() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{PeriodicTaskRuns, PeriodicTaskErrors, PeriodicTaskTablesProcessed, PeriodicTaskLastRunTimestamp}
+}
+
+// Remove the series of a cluster and forget what its controllers reported
+func deletePeriodicTaskMetrics(cluster string) {
+	periodicTaskState.Lock()
+	delete(periodicTaskState.reports, cluster)
+	delete(periodicTaskState.lastRun, cluster)
+	periodicTaskState.Unlock()
+	for _, metric := range periodicTaskMetrics() {
+		metric.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+	}
+}
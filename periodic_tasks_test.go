@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectPeriodicTasks(t *testing.T) {
+	fake := newFakePinot(t, fakePinotFixture)
+	controller := NewPinotController("periodic", fake.URL())
+	parsed, _ := url.Parse(fake.URL())
+	port, _ := strconv.Atoi(parsed.Port())
+	target := &ClusterTarget{Controller: controller, ControllerMetrics: NewControllerMetrics(ControllerMetricsConfig{})}
+	defer deletePeriodicTaskMetrics("periodic")
+
+	// Nothing to read the runs from
+	assert.NotNil(t, collectPeriodicTasks(context.Background(), target))
+
+	target.ControllerMetrics.Update(ControllerMetricsConfig{Port: port})
+	err := collectPeriodicTasks(context.Background(), target)
+	assert.Nil(t, err)
+	assert.Equal(t, 3.0, testutil.ToFloat64(PeriodicTaskRuns.WithLabelValues("periodic", "RetentionManager")))
+	// Rates of the meter are not counted
+	assert.Equal(t, 12.0, testutil.ToFloat64(PeriodicTaskRuns.WithLabelValues("periodic", "SegmentStatusChecker")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(PeriodicTaskErrors.WithLabelValues("periodic", "SegmentStatusChecker")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(PeriodicTaskTablesProcessed.WithLabelValues("periodic", "RetentionManager")))
+	// No run seen yet
+	assert.Equal(t, 0, testutil.CollectAndCount(PeriodicTaskLastRunTimestamp))
+
+	// SegmentStatusChecker runs again
+	fake.update(func(cluster *fakePinotCluster) {
+		cluster.ControllerMetrics = strings.Replace(cluster.ControllerMetrics, `{table="SegmentStatusChecker"} 12`, `{table="SegmentStatusChecker"} 13`, 1)
+	})
+	err = collectPeriodicTasks(context.Background(), target)
+	assert.Nil(t, err)
+	assert.Equal(t, 13.0, testutil.ToFloat64(PeriodicTaskRuns.WithLabelValues("periodic", "SegmentStatusChecker")))
+	assert.Equal(t, 1, testutil.CollectAndCount(PeriodicTaskLastRunTimestamp))
+	assert.Less(t, 0.0, testutil.ToFloat64(PeriodicTaskLastRunTimestamp.WithLabelValues("periodic", "SegmentStatusChecker")))
+
+	// The controller stops responding: what it reported last is kept
+	fake.update(func(cluster *fakePinotCluster) {
+		cluster.PeriodicTasks = []string{"SegmentStatusChecker"}
+	})
+	target.ControllerMetrics.Update(ControllerMetricsConfig{Port: port, Path: "/notmetrics"})
+	assert.NotNil(t, collectPeriodicTasks(context.Background(), target))
+	assert.Equal(t, 13.0, testutil.ToFloat64(PeriodicTaskRuns.WithLabelValues("periodic", "SegmentStatusChecker")))
+}
+
+func TestControllerMetricsConfig(t *testing.T) {
+	config, err := NewConfigFromBytes([]byte(`
+controller_metrics:
+  port: 8008
+`))
+	assert.Nil(t, err)
+	assert.Nil(t, config.ControllerMetrics.IsValid())
+	port, path := NewControllerMetrics(config.ControllerMetrics).Endpoint()
+	assert.Equal(t, 8008, port)
+	assert.Equal(t, "/metrics", path)
+
+	assert.NotNil(t, ControllerMetricsConfig{Port: 70000}.IsValid())
+	assert.NotNil(t, ControllerMetricsConfig{Port: 8008, Path: "metrics"}.IsValid())
+}
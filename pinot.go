@@ -3,113 +3,553 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
 )
 
+// How long a controller that failed a request is skipped for, before it is tried again
+const controllerRetryAfter = 30 * time.Second
+
+/*
+A client of a Pinot cluster. Everything that talks to Pinot depends on this,
+so tests can replace the cluster with a fake.
+*/
 type PinotControllerInterface interface {
-	GetSizeForTable(ctx context.Context, tableName string) (int, error)
 	String() string
+	AllURLs() []string
+	GetVersion(ctx context.Context) (string, error)
+
+	// Controller health and routing
+	CheckHealth(ctx context.Context)
+	LeaderRouting() bool
+	RefreshLeaders(ctx context.Context) error
+
+	// Tables
+	ListTables(ctx context.Context) ([]string, error)
+	ListTablesOfType(ctx context.Context, tableType string) ([]string, error)
+	ListTenantTables(ctx context.Context, tenant string) ([]string, error)
+	GetSizeForTable(ctx context.Context, tableName string) (int, error)
+	GetTableSize(ctx context.Context, tableName string) (TableSize, error)
+	GetTableConfig(ctx context.Context, tableName string) (TableConfigs, error)
+	GetTableConfigs(ctx context.Context, tableName string) (TableConfigs, error)
+	GetConsumingSegmentsInfo(ctx context.Context, tableName string) ([]ConsumingSegmentInfo, error)
+	GetPauseStatus(ctx context.Context, tableName string) (PauseStatus, error)
+
+	// Schemas
+	ListSchemas(ctx context.Context) ([]string, error)
+	GetSchema(ctx context.Context, schemaName string) (Schema, error)
+
+	// Segments
+	ListSegments(ctx context.Context, tableName string) (map[string][]string, error)
+	GetExternalView(ctx context.Context, tableName string) (ExternalView, error)
+	GetSegmentsMetadata(ctx context.Context, tableName string, tableType string) (map[string]SegmentMetadata, error)
+
+	// Rebalance and reload jobs
+	GetTableJobs(ctx context.Context, tableName string) ([]TableJob, error)
+	GetRebalanceStatus(ctx context.Context, jobId string) (RebalanceStatus, error)
+	GetReloadStatus(ctx context.Context, jobId string) (ReloadStatus, error)
+
+	// Brokers
+	ListBrokersForTable(ctx context.Context, tableName string) ([]BrokerInfo, error)
+	GetTimeBoundary(ctx context.Context, broker BrokerInfo, tableName string) (*TimeBoundary, error)
+	GetRoutingTable(ctx context.Context, broker BrokerInfo, tableName string) (RoutingTable, error)
+
+	// Server admin API
+	ListServers(ctx context.Context) ([]ServerInfo, error)
+	ListServerTables(ctx context.Context, server ServerInfo) ([]string, error)
+	GetServerTableMetadata(ctx context.Context, server ServerInfo, tableNameWithType string) (ServerTableMetadata, error)
+	GetServerConsumingSegments(ctx context.Context, server ServerInfo, tableNameWithType string) ([]ServerConsumerInfo, error)
+
+	// Instances and tenants
+	ListInstances(ctx context.Context) ([]string, error)
+	GetInstance(ctx context.Context, instanceName string) (InstanceInfo, error)
+	ListTenants(ctx context.Context) (Tenants, error)
+
+	// Minion tasks
+	ListTaskTypes(ctx context.Context) ([]string, error)
+	GetTaskStates(ctx context.Context, taskType string) (map[string]string, error)
+
+	// Periodic tasks of the controllers
+	ListPeriodicTasks(ctx context.Context) ([]string, error)
+	GetControllerMetrics(ctx context.Context, controllerURL string, port int, metricsPath string) (map[string]*dto.MetricFamily, error)
 }
+
+var _ PinotControllerInterface = &PinotController{}
+
+/*
+A Pinot cluster, reached through one or more controllers.
+Requests go to the first healthy controller and fail over to the next one on errors.
+*/
 type PinotController struct {
-	URL string `json:"url" yaml:"url"`
+	// Name of the cluster. Defaults to the controller URL
+	Name string `json:"name" yaml:"name"`
+	URL  string `json:"url" yaml:"url"`
+	// Additional controllers of the same cluster, used for failover
+	URLs []string `json:"urls" yaml:"urls"`
+	// Labels added to all metrics of the cluster
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels"`
+
+	routing *controllerRouting
+}
+
+// Tracks controller health and table leadership for a cluster. Shared between copies of a PinotController.
+type controllerRouting struct {
+	mutex sync.Mutex
+	// controller URLs, kept here so they can be updated while the cluster is monitored
+	urls           []string
+	unhealthyUntil map[string]time.Time
+	// Send per-table requests to the lead controller of the table, as reported by /leader/tables
+	leaderRouting bool
+	// table name -> URL of the lead controller for the table
+	tableLeaders map[string]string
+	// rate and concurrency limits for requests to this cluster, if any
+	limiter *RequestLimiter
+}
+
+// An error response from a Pinot controller
+type PinotStatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *PinotStatusError) Error() string {
+	return fmt.Sprintf("pinot controller %s responded with status %d", e.URL, e.StatusCode)
+}
+
+// Create a PinotController for the cluster with the given name, reachable through the given controller URLs
+func NewPinotController(name string, urls ...string) *PinotController {
+	c := &PinotController{
+		Name: name,
+		routing: &controllerRouting{
+			unhealthyUntil: make(map[string]time.Time),
+			tableLeaders:   make(map[string]string),
+		},
+	}
+	if len(urls) > 0 {
+		c.URL = urls[0]
+		c.URLs = urls[1:]
+	}
+	c.routing.urls = c.configuredURLs()
+	return c
+}
+
+// Create a PinotController from one loaded from the config file, so it can track controller health
+func NewPinotControllerFromConfig(config PinotController) *PinotController {
+	controller := NewPinotController(config.Name, config.AllURLs()...)
+	controller.Labels = config.Labels
+	return controller
 }
 
 func (c *PinotController) String() string {
+	if c.Name != "" {
+		return c.Name
+	}
 	return c.URL
 }
 
+// All controller URLs of this cluster, in configured order
+func (c *PinotController) AllURLs() []string {
+	if c.routing != nil {
+		c.routing.mutex.Lock()
+		defer c.routing.mutex.Unlock()
+		return slices.Clone(c.routing.urls)
+	}
+	return c.configuredURLs()
+}
+
 /*
-Get the size of the given table name in Bytes, or error
+Replace the controller URLs of this cluster, e.g. when discovery finds a new controller.
+Controllers that are gone are forgotten, along with their series.
+*/
+func (c *PinotController) SetURLs(urls []string) {
+	if c.routing == nil {
+		return
+	}
+	c.routing.mutex.Lock()
+	defer c.routing.mutex.Unlock()
+	for _, u := range c.routing.urls {
+		if !slices.Contains(urls, u) {
+			delete(c.routing.unhealthyUntil, u)
+			ControllerUp.DeleteLabelValues(c.String(), u)
+		}
+	}
+	c.routing.urls = slices.Clone(urls)
+}
 
-Expects a context.Context to be passed as first parameter
+func (c *PinotController) configuredURLs() []string {
+	var urls []string
+	if c.URL != "" {
+		urls = append(urls, c.URL)
+	}
+	for _, u := range c.URLs {
+		if !slices.Contains(urls, u) {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+/*
+Return the controller URLs in the order they should be tried.
+The preferred URL (e.g. the table leader) goes first if given, then healthy controllers,
+then the ones that recently failed as a last resort.
 */
-func (c *PinotController) GetSizeForTable(ctx context.Context, tableName string) (int, error) {
-	var size int = 0
-	var err error
+func (c *PinotController) endpoints(preferred string) []string {
+	if c.routing == nil {
+		return c.configuredURLs()
+	}
+	var healthy, unhealthy []string
+	now := time.Now()
+	c.routing.mutex.Lock()
+	defer c.routing.mutex.Unlock()
+	// URLs may have changed since the leaders were refreshed
+	if !slices.Contains(c.routing.urls, preferred) {
+		preferred = ""
+	}
+	if preferred != "" && !now.Before(c.routing.unhealthyUntil[preferred]) {
+		healthy = append(healthy, preferred)
+	}
+	for _, u := range c.routing.urls {
+		if u == preferred {
+			continue
+		}
+		if now.Before(c.routing.unhealthyUntil[u]) {
+			unhealthy = append(unhealthy, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (c *PinotController) markHealthy(endpoint string, healthy bool) {
+	if healthy {
+		ControllerUp.WithLabelValues(c.String(), endpoint).Set(1)
+	} else {
+		ControllerUp.WithLabelValues(c.String(), endpoint).Set(0)
+	}
+	if c.routing == nil {
+		return
+	}
+	c.routing.mutex.Lock()
+	defer c.routing.mutex.Unlock()
+	if healthy {
+		delete(c.routing.unhealthyUntil, endpoint)
+	} else {
+		c.routing.unhealthyUntil[endpoint] = time.Now().Add(controllerRetryAfter)
+	}
+}
+
+/*
+Errors that mean the controller is unavailable, rather than the request being wrong.
+A cancelled or timed out request says nothing about the controller.
+*/
+func isFailoverError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var statusErr *PinotStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	return true
+}
 
-	type TableSizeResponse struct {
-		Name                          string `json:"tableName"`
-		ReportedSizeInBytes           int    `json:"reportedSizeInBytes"`
-		EstimatedSizeInBytes          int    `json:"estimatedSizeInBytes"`
-		ReportedSizePerReplicaInBytes int    `json:"reportedSizePerReplicaInBytes"`
-		//offlineSegments int
-		RealtimeSegments struct {
-			ReportedSizeInBytes           int `json:"reportedSizeInBytes"`
-			EstimatedSizeInBytes          int `json:"estimatedSizeInBytes"`
-			MissingSegments               int `json:"missingSegments"`
-			ReportedSizePerReplicaInBytes int `json:"reportedSizePerReplicaInBytes"`
-			//segments
+/*
+GET the given API path and decode the JSON response into out.
+Controllers are tried in turn until one responds.
+*/
+func (c *PinotController) getJSON(ctx context.Context, preferred string, apiPath string, out interface{}) error {
+	var err error
+	for _, endpoint := range c.endpoints(preferred) {
+		var release func()
+		release, err = c.waitForLimiter(ctx)
+		if err != nil {
+			return err
+		}
+		err = getJSONFrom(ctx, endpoint, apiPath, out)
+		release()
+		if err == nil {
+			c.markHealthy(endpoint, true)
+			return nil
 		}
+		if ctx.Err() != nil || !isFailoverError(err) {
+			return err
+		}
+		logger.Warnf("pinot client: request to %s%s failed, trying next controller: %s", endpoint, apiPath, err)
+		c.markHealthy(endpoint, false)
+	}
+	if err == nil {
+		err = fmt.Errorf("no controllers configured for %s", c)
 	}
-	var pinotResponse TableSizeResponse
+	return err
+}
 
-	url := fmt.Sprintf("%s/tables/%s/size", c.String(), tableName)
-	req, err := http.NewRequest("GET", url, nil)
+func getJSONFrom(ctx context.Context, endpoint string, apiPath string, out interface{}) error {
+	url := fmt.Sprintf("%s%s", strings.TrimSuffix(endpoint, "/"), apiPath)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		fmt.Printf("pinot client: Failed to create Request obj: %s", err)
-		return size, err
+		return err
 	}
-	req.WithContext(ctx)
 	req.Header.Add("Content-Type", "application/json")
 
 	client := http.Client{}
 
 	res, err := client.Do(req)
 	if err != nil {
-		fmt.Printf("pinot client: failed calling pinot endpoint at %s with error: %s", c.String(), err)
-		return size, err
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return &PinotStatusError{URL: url, StatusCode: res.StatusCode}
 	}
 
-	respBody, err := ioutil.ReadAll(res.Body)
+	respBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		log.Println(err)
+		return err
 	}
-	err = json.Unmarshal(respBody, &pinotResponse)
+	err = json.Unmarshal(respBody, out)
 	if err != nil {
-		log.Fatalf("Failed unmarshaling response from Pinot: %s\n", err)
+		return fmt.Errorf("failed unmarshaling response from %s: %w", url, err)
 	}
-	size = pinotResponse.RealtimeSegments.ReportedSizeInBytes
-	return size, err
+	return nil
 }
 
 /*
-List all tables in this cluster
+Check the health endpoint of every controller and record the result,
+so requests skip controllers that are down.
 */
-func (c *PinotController) ListTables(ctx context.Context) ([]string, error) {
-	type PinotTablesResponse struct {
-		Tables []string `json:"tables"`
+func (c *PinotController) CheckHealth(ctx context.Context) {
+	for _, endpoint := range c.AllURLs() {
+		url := fmt.Sprintf("%s/health", strings.TrimSuffix(endpoint, "/"))
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			c.markHealthy(endpoint, false)
+			continue
+		}
+		release, err := c.waitForLimiter(ctx)
+		if err != nil {
+			return
+		}
+		client := http.Client{}
+		res, err := client.Do(req)
+		release()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Warnf("Pinot controller %s of %s is not healthy: %s", endpoint, c, err)
+			c.markHealthy(endpoint, false)
+			continue
+		}
+		res.Body.Close()
+		c.markHealthy(endpoint, res.StatusCode == http.StatusOK)
 	}
-	var pinotResponse PinotTablesResponse
-	var tables []string
-	var err error
+}
+
+// Limit the rate and concurrency of requests to this cluster
+func (c *PinotController) SetLimiter(limiter *RequestLimiter) {
+	if c.routing == nil {
+		return
+	}
+	c.routing.mutex.Lock()
+	defer c.routing.mutex.Unlock()
+	c.routing.limiter = limiter
+}
+
+// Wait until the cluster's limits allow a request. The returned function must be called once it is done.
+func (c *PinotController) waitForLimiter(ctx context.Context) (func(), error) {
+	if c.routing == nil {
+		return func() {}, nil
+	}
+	c.routing.mutex.Lock()
+	limiter := c.routing.limiter
+	c.routing.mutex.Unlock()
+	if limiter == nil {
+		return func() {}, nil
+	}
+	return limiter.Wait(ctx)
+}
 
-	url := fmt.Sprintf("%s/tables/", c.String())
-	req, err := http.NewRequest("GET", url, nil)
+/*
+Refresh which controller leads each table, from /leader/tables.
+Leaders are only used when leader routing is enabled, and only if they are configured controllers.
+*/
+func (c *PinotController) RefreshLeaders(ctx context.Context) error {
+	type LeadControllerEntry struct {
+		LeadControllerId string   `json:"leadControllerId"`
+		TableNames       []string `json:"tableNames"`
+	}
+	type LeaderTablesResponse struct {
+		LeadControllerResourceEnabled bool                           `json:"leadControllerResourceEnabled"`
+		LeadControllerEntryMap        map[string]LeadControllerEntry `json:"leadControllerEntryMap"`
+	}
+	var pinotResponse LeaderTablesResponse
+	if c.routing == nil {
+		return nil
+	}
+	err := c.getJSON(ctx, "", "/leader/tables", &pinotResponse)
 	if err != nil {
-		fmt.Printf("pinot client: Failed to create Request obj: %s", err)
-		return tables, err
+		return err
 	}
-	req.WithContext(ctx)
-	req.Header.Add("Content-Type", "application/json")
 
-	client := http.Client{}
+	// Leaders are only routed to if they are one of the configured controllers, which we know how to reach
+	c.routing.mutex.Lock()
+	defer c.routing.mutex.Unlock()
+	configured := make(map[string]string)
+	for _, u := range c.routing.urls {
+		if parsed, err := url.Parse(u); err == nil && parsed.Host != "" {
+			configured[strings.ToLower(parsed.Host)] = u
+		}
+	}
+	tableLeaders := make(map[string]string)
+	for _, entry := range pinotResponse.LeadControllerEntryMap {
+		hostPort, err := controllerInstanceHostPort(entry.LeadControllerId)
+		if err != nil {
+			continue
+		}
+		leader, ok := configured[strings.ToLower(hostPort)]
+		if !ok {
+			logger.Debugf("Lead controller %s of %s is not a configured controller, not routing to it", entry.LeadControllerId, c)
+			continue
+		}
+		for _, table := range entry.TableNames {
+			tableLeaders[rawTableName(table)] = leader
+		}
+	}
+	c.routing.tableLeaders = tableLeaders
+	return nil
+}
 
-	res, err := client.Do(req)
+// Enable or disable routing per-table requests to the lead controller of each table
+func (c *PinotController) SetLeaderRouting(enabled bool) {
+	if c.routing == nil {
+		return
+	}
+	c.routing.mutex.Lock()
+	defer c.routing.mutex.Unlock()
+	c.routing.leaderRouting = enabled
+}
+
+func (c *PinotController) LeaderRouting() bool {
+	if c.routing == nil {
+		return false
+	}
+	c.routing.mutex.Lock()
+	defer c.routing.mutex.Unlock()
+	return c.routing.leaderRouting
+}
+
+// The URL of the lead controller for a table, if leader routing is enabled and the leader is known
+func (c *PinotController) leaderFor(tableName string) string {
+	if c.routing == nil {
+		return ""
+	}
+	c.routing.mutex.Lock()
+	defer c.routing.mutex.Unlock()
+	if !c.routing.leaderRouting {
+		return ""
+	}
+	return c.routing.tableLeaders[rawTableName(tableName)]
+}
+
+// Strip the _OFFLINE or _REALTIME suffix from a table name
+func rawTableName(tableName string) string {
+	tableName = strings.TrimSuffix(tableName, "_OFFLINE")
+	return strings.TrimSuffix(tableName, "_REALTIME")
+}
+
+// The size of a table, as returned by GET /tables/{tableName}/size
+type TableSize struct {
+	Name                          string         `json:"tableName"`
+	ReportedSizeInBytes           int            `json:"reportedSizeInBytes"`
+	EstimatedSizeInBytes          int            `json:"estimatedSizeInBytes"`
+	ReportedSizePerReplicaInBytes int            `json:"reportedSizePerReplicaInBytes"`
+	OfflineSegments               *TableTypeSize `json:"offlineSegments"`
+	RealtimeSegments              *TableTypeSize `json:"realtimeSegments"`
+}
+
+// The size of the offline or realtime part of a table
+type TableTypeSize struct {
+	ReportedSizeInBytes           int                    `json:"reportedSizeInBytes"`
+	EstimatedSizeInBytes          int                    `json:"estimatedSizeInBytes"`
+	MissingSegments               int                    `json:"missingSegments"`
+	ReportedSizePerReplicaInBytes int                    `json:"reportedSizePerReplicaInBytes"`
+	Segments                      map[string]SegmentSize `json:"segments"`
+}
+
+type SegmentSize struct {
+	ReportedSizeInBytes  int `json:"reportedSizeInBytes"`
+	EstimatedSizeInBytes int `json:"estimatedSizeInBytes"`
+	// Size of the segment on each server holding it
+	ServerInfo map[string]struct {
+		DiskSizeInBytes int `json:"diskSizeInBytes"`
+	} `json:"serverInfo"`
+}
+
+// The size of the offline or realtime part of the table, nil if the table has no such part
+func (s TableSize) ByType(tableType string) *TableTypeSize {
+	if tableType == "OFFLINE" {
+		return s.OfflineSegments
+	}
+	return s.RealtimeSegments
+}
+
+// Get the size of the given table, with the size of each of its segments
+func (c *PinotController) GetTableSize(ctx context.Context, tableName string) (TableSize, error) {
+	var size TableSize
+	err := c.getJSON(ctx, c.leaderFor(tableName), fmt.Sprintf("/tables/%s/size", tableName), &size)
 	if err != nil {
-		fmt.Printf("pinot client: failed calling pinot endpoint at %s with error: %s", c.String(), err)
-		return tables, err
+		logger.Errorf("pinot client: failed getting size of table %s from %s: %s", tableName, c, err)
+		return size, err
 	}
+	return size, nil
+}
+
+/*
+Get the size of the given table name in Bytes, or error
 
-	respBody, err := ioutil.ReadAll(res.Body)
+Expects a context.Context to be passed as first parameter
+*/
+func (c *PinotController) GetSizeForTable(ctx context.Context, tableName string) (int, error) {
+	size, err := c.GetTableSize(ctx, tableName)
 	if err != nil {
-		log.Println(err)
+		return 0, err
+	}
+	return size.ReportedRealtimeBytes(), nil
+}
+
+// The size we export for a table: the reported size of its realtime segments
+func (s TableSize) ReportedRealtimeBytes() int {
+	if s.RealtimeSegments == nil {
+		return 0
+	}
+	return s.RealtimeSegments.ReportedSizeInBytes
+}
+
+/*
+List all tables in this cluster
+*/
+func (c *PinotController) ListTables(ctx context.Context) ([]string, error) {
+	type PinotTablesResponse struct {
+		Tables []string `json:"tables"`
 	}
-	err = json.Unmarshal(respBody, &pinotResponse)
+	var pinotResponse PinotTablesResponse
+	var tables []string
+
+	err := c.getJSON(ctx, "", "/tables/", &pinotResponse)
 	if err != nil {
-		log.Fatalf("Failed unmarshaling response from Pinot: %s\n", err)
+		logger.Errorf("pinot client: failed listing tables of %s: %s", c, err)
+		return tables, err
 	}
 	tables = pinotResponse.Tables
 	return tables, err
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+/*
+The configs of a table, for each of its types, as returned by GET /tables/{tableName}.
+GET /tableConfigs/{tableName} also returns the schema, and uses lowercase keys,
+which decode the same as JSON keys are matched case-insensitively.
+*/
+type TableConfigs struct {
+	Offline  *TableConfig `json:"OFFLINE,omitempty"`
+	Realtime *TableConfig `json:"REALTIME,omitempty"`
+	Schema   *Schema      `json:"schema,omitempty"`
+}
+
+// The parts of a Pinot table config we use
+type TableConfig struct {
+	TableName        string           `json:"tableName"`
+	TableType        string           `json:"tableType"`
+	SegmentsConfig   SegmentsConfig   `json:"segmentsConfig"`
+	Tenants          TableTenants     `json:"tenants"`
+	TableIndexConfig TableIndexConfig `json:"tableIndexConfig"`
+	FieldConfigList  []FieldConfig    `json:"fieldConfigList"`
+
+	// The config as returned by Pinot, to detect any change
+	raw json.RawMessage
+}
+
+type TableIndexConfig struct {
+	LoadMode             string            `json:"loadMode"`
+	SortedColumn         []string          `json:"sortedColumn"`
+	InvertedIndexColumns []string          `json:"invertedIndexColumns"`
+	RangeIndexColumns    []string          `json:"rangeIndexColumns"`
+	BloomFilterColumns   []string          `json:"bloomFilterColumns"`
+	NoDictionaryColumns  []string          `json:"noDictionaryColumns"`
+	JSONIndexColumns     []string          `json:"jsonIndexColumns"`
+	StarTreeIndexConfigs []json.RawMessage `json:"starTreeIndexConfigs"`
+}
+
+// Per column settings, e.g. text, FST and H3 indexes
+type FieldConfig struct {
+	Name       string   `json:"name"`
+	IndexType  string   `json:"indexType"`
+	IndexTypes []string `json:"indexTypes"`
+}
+
+func (t *TableConfig) UnmarshalJSON(data []byte) error {
+	type plain TableConfig
+	err := json.Unmarshal(data, (*plain)(t))
+	if err != nil {
+		return err
+	}
+	t.raw = slices.Clone(data)
+	return nil
+}
+
+// A hash of the whole config, that only changes when the config does
+func (t *TableConfig) Hash() string {
+	return jsonHash(t.raw)
+}
+
+type SegmentsConfig struct {
+	SchemaName           string `json:"schemaName"`
+	TimeColumnName       string `json:"timeColumnName"`
+	Replication          string `json:"replication"`
+	ReplicasPerPartition string `json:"replicasPerPartition"`
+	RetentionTimeUnit    string `json:"retentionTimeUnit"`
+	RetentionTimeValue   string `json:"retentionTimeValue"`
+}
+
+type TableTenants struct {
+	Broker string `json:"broker"`
+	Server string `json:"server"`
+}
+
+type Schema struct {
+	SchemaName          string      `json:"schemaName"`
+	DimensionFieldSpecs []FieldSpec `json:"dimensionFieldSpecs"`
+	MetricFieldSpecs    []FieldSpec `json:"metricFieldSpecs"`
+	DateTimeFieldSpecs  []FieldSpec `json:"dateTimeFieldSpecs"`
+	// Deprecated single time column of older schemas
+	TimeFieldSpec     json.RawMessage `json:"timeFieldSpec,omitempty"`
+	PrimaryKeyColumns []string        `json:"primaryKeyColumns"`
+
+	// The schema as returned by Pinot, to detect any change
+	raw json.RawMessage
+}
+
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	type plain Schema
+	err := json.Unmarshal(data, (*plain)(s))
+	if err != nil {
+		return err
+	}
+	s.raw = slices.Clone(data)
+	return nil
+}
+
+// A hash of the whole schema, that only changes when the schema does
+func (s *Schema) Hash() string {
+	return jsonHash(s.raw)
+}
+
+// Number of time columns, counting the deprecated time field
+func (s *Schema) TimeColumns() int {
+	columns := len(s.DateTimeFieldSpecs)
+	if len(s.TimeFieldSpec) > 0 && string(s.TimeFieldSpec) != "null" {
+		columns++
+	}
+	return columns
+}
+
+/*
+Hash JSON content regardless of key order and formatting.
+Returns the first 16 hex digits of the SHA-256 of its canonical form.
+*/
+func jsonHash(data json.RawMessage) string {
+	if len(data) == 0 {
+		return ""
+	}
+	var v interface{}
+	canonical := []byte(data)
+	// Maps are marshalled with sorted keys
+	if json.Unmarshal(data, &v) == nil {
+		if marshalled, err := json.Marshal(v); err == nil {
+			canonical = marshalled
+		}
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:8])
+}
+
+type FieldSpec struct {
+	Name     string `json:"name"`
+	DataType string `json:"dataType"`
+}
+
+// A controller, broker, server or minion of a cluster, as returned by GET /instances/{instanceName}
+type InstanceInfo struct {
+	InstanceName string `json:"instanceName"`
+	HostName     string `json:"hostName"`
+	// Pinot returns the port as a string
+	Port      string   `json:"port"`
+	Enabled   bool     `json:"enabled"`
+	Tags      []string `json:"tags"`
+	GrpcPort  int      `json:"grpcPort"`
+	AdminPort int      `json:"adminPort"`
+}
+
+type Tenants struct {
+	ServerTenants []string `json:"SERVER_TENANTS"`
+	BrokerTenants []string `json:"BROKER_TENANTS"`
+}
+
+// Get the configs of a table, for each of its types
+func (c *PinotController) GetTableConfig(ctx context.Context, tableName string) (TableConfigs, error) {
+	var configs TableConfigs
+	err := c.getJSON(ctx, c.leaderFor(tableName), fmt.Sprintf("/tables/%s", url.PathEscape(tableName)), &configs)
+	if err != nil {
+		return configs, fmt.Errorf("failed getting config of table %s from %s: %w", tableName, c, err)
+	}
+	return configs, nil
+}
+
+// Get the configs of a table along with its schema, from GET /tableConfigs/{tableName}
+func (c *PinotController) GetTableConfigs(ctx context.Context, tableName string) (TableConfigs, error) {
+	var configs TableConfigs
+	err := c.getJSON(ctx, c.leaderFor(tableName), fmt.Sprintf("/tableConfigs/%s", url.PathEscape(tableName)), &configs)
+	if err != nil {
+		return configs, fmt.Errorf("failed getting table configs of %s from %s: %w", tableName, c, err)
+	}
+	return configs, nil
+}
+
+func (c *PinotController) ListSchemas(ctx context.Context) ([]string, error) {
+	var schemas []string
+	err := c.getJSON(ctx, "", "/schemas", &schemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing schemas of %s: %w", c, err)
+	}
+	return schemas, nil
+}
+
+func (c *PinotController) GetSchema(ctx context.Context, schemaName string) (Schema, error) {
+	var schema Schema
+	err := c.getJSON(ctx, "", fmt.Sprintf("/schemas/%s", url.PathEscape(schemaName)), &schema)
+	if err != nil {
+		return schema, fmt.Errorf("failed getting schema %s from %s: %w", schemaName, c, err)
+	}
+	return schema, nil
+}
+
+// List the segments of a table, by table type (OFFLINE or REALTIME)
+func (c *PinotController) ListSegments(ctx context.Context, tableName string) (map[string][]string, error) {
+	// One object per table type, e.g. [{"OFFLINE": ["segment_0"]}, {"REALTIME": []}]
+	var response []map[string][]string
+	err := c.getJSON(ctx, c.leaderFor(tableName), fmt.Sprintf("/segments/%s", url.PathEscape(tableName)), &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing segments of table %s from %s: %w", tableName, c, err)
+	}
+	segments := make(map[string][]string)
+	for _, byType := range response {
+		for tableType, names := range byType {
+			segments[tableType] = append(segments[tableType], names...)
+		}
+	}
+	return segments, nil
+}
+
+// List the names of all instances of the cluster
+func (c *PinotController) ListInstances(ctx context.Context) ([]string, error) {
+	type InstancesResponse struct {
+		Instances []string `json:"instances"`
+	}
+	var response InstancesResponse
+	err := c.getJSON(ctx, "", "/instances", &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing instances of %s: %w", c, err)
+	}
+	return response.Instances, nil
+}
+
+func (c *PinotController) GetInstance(ctx context.Context, instanceName string) (InstanceInfo, error) {
+	var instance InstanceInfo
+	err := c.getJSON(ctx, "", fmt.Sprintf("/instances/%s", url.PathEscape(instanceName)), &instance)
+	if err != nil {
+		return instance, fmt.Errorf("failed getting instance %s from %s: %w", instanceName, c, err)
+	}
+	return instance, nil
+}
+
+func (c *PinotController) ListTenants(ctx context.Context) (Tenants, error) {
+	var tenants Tenants
+	err := c.getJSON(ctx, "", "/tenants", &tenants)
+	if err != nil {
+		return tenants, fmt.Errorf("failed listing tenants of %s: %w", c, err)
+	}
+	return tenants, nil
+}
+
+// List the minion task types that have tasks in the cluster
+func (c *PinotController) ListTaskTypes(ctx context.Context) ([]string, error) {
+	var taskTypes []string
+	err := c.getJSON(ctx, "", "/tasks/tasktypes", &taskTypes)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing task types of %s: %w", c, err)
+	}
+	return taskTypes, nil
+}
+
+// Get the state of every task of the given type, by task name
+func (c *PinotController) GetTaskStates(ctx context.Context, taskType string) (map[string]string, error) {
+	var states map[string]string
+	err := c.getJSON(ctx, "", fmt.Sprintf("/tasks/%s/taskstates", url.PathEscape(taskType)), &states)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting states of %s tasks from %s: %w", taskType, c, err)
+	}
+	return states, nil
+}
+
+/*
+Get the version of the controller, from GET /version.
+The response maps components to their versions, e.g. {"pinot-controller": "1.2.0"}.
+The version is informational only: responses are parsed by the fields they have rather than
+by the version, as builds of the same release don't always agree on the shapes they return.
+*/
+func (c *PinotController) GetVersion(ctx context.Context) (string, error) {
+	var versions map[string]string
+	err := c.getJSON(ctx, "", "/version", &versions)
+	if err != nil {
+		return "", fmt.Errorf("failed getting version of %s: %w", c, err)
+	}
+	if version, ok := versions["pinot-controller"]; ok && version != "unknown" {
+		return version, nil
+	}
+	// Some releases only report the versions of other components
+	components := make([]string, 0, len(versions))
+	for component := range versions {
+		components = append(components, component)
+	}
+	slices.Sort(components)
+	for _, component := range components {
+		if versions[component] != "unknown" {
+			return versions[component], nil
+		}
+	}
+	return "", fmt.Errorf("no version reported by %s", c)
+}
+
+// A consuming segment of a realtime table, on one of its servers
+type ConsumingSegmentInfo struct {
+	Segment               string
+	Server                string
+	ConsumerState         string
+	LastConsumedTimestamp int64
+	// Offsets by partition. Latest upstream offsets and lag are only reported by Pinot 0.11 and later
+	CurrentOffsets        map[string]string
+	LatestUpstreamOffsets map[string]string
+	RecordsLag            map[string]string
+}
+
+/*
+Get the consuming segments of a realtime table, from GET /tables/{tableName}/consumingSegmentsInfo.
+Older releases only report partitionToOffsetMap, newer ones partitionOffsetInfo, and some both.
+*/
+func (c *PinotController) GetConsumingSegmentsInfo(ctx context.Context, tableName string) ([]ConsumingSegmentInfo, error) {
+	type PartitionOffsetInfo struct {
+		CurrentOffsetsMap       map[string]string `json:"currentOffsetsMap"`
+		LatestUpstreamOffsetMap map[string]string `json:"latestUpstreamOffsetMap"`
+		RecordsLagMap           map[string]string `json:"recordsLagMap"`
+	}
+	type ServerConsumingInfo struct {
+		ServerName            string               `json:"serverName"`
+		ConsumerState         string               `json:"consumerState"`
+		LastConsumedTimestamp int64                `json:"lastConsumedTimestamp"`
+		PartitionToOffsetMap  map[string]string    `json:"partitionToOffsetMap"`
+		PartitionOffsetInfo   *PartitionOffsetInfo `json:"partitionOffsetInfo"`
+	}
+	type ConsumingSegmentsInfoResponse struct {
+		SegmentToConsumingInfoMap map[string][]ServerConsumingInfo `json:"_segmentToConsumingInfoMap"`
+	}
+	var response ConsumingSegmentsInfoResponse
+	err := c.getJSON(ctx, c.leaderFor(tableName), fmt.Sprintf("/tables/%s/consumingSegmentsInfo", url.PathEscape(tableName)), &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting consuming segments of table %s from %s: %w", tableName, c, err)
+	}
+	var infos []ConsumingSegmentInfo
+	for segment, servers := range response.SegmentToConsumingInfoMap {
+		for _, server := range servers {
+			info := ConsumingSegmentInfo{
+				Segment:               segment,
+				Server:                server.ServerName,
+				ConsumerState:         server.ConsumerState,
+				LastConsumedTimestamp: server.LastConsumedTimestamp,
+				CurrentOffsets:        server.PartitionToOffsetMap,
+			}
+			if server.PartitionOffsetInfo != nil {
+				info.CurrentOffsets = server.PartitionOffsetInfo.CurrentOffsetsMap
+				info.LatestUpstreamOffsets = server.PartitionOffsetInfo.LatestUpstreamOffsetMap
+				info.RecordsLag = server.PartitionOffsetInfo.RecordsLagMap
+			}
+			infos = append(infos, info)
+		}
+	}
+	slices.SortFunc(infos, func(a, b ConsumingSegmentInfo) int {
+		return cmp.Or(strings.Compare(a.Segment, b.Segment), strings.Compare(a.Server, b.Server))
+	})
+	return infos, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fakePinotFixture = "testdata/fakepinot/cluster.json"
+
+func TestPinotClientAgainstFakeController(t *testing.T) {
+	fake := newFakePinot(t, fakePinotFixture)
+	var client PinotControllerInterface = NewPinotController("fake", fake.URL())
+	ctx := context.Background()
+
+	version, err := client.GetVersion(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.0", version)
+
+	tables, err := client.ListTables(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"airlineStats", "githubEvents"}, tables)
+
+	size, err := client.GetSizeForTable(ctx, "githubEvents")
+	assert.Nil(t, err)
+	assert.Equal(t, 4096, size)
+
+	consuming, err := client.GetConsumingSegmentsInfo(ctx, "githubEvents")
+	assert.Nil(t, err)
+	assert.Len(t, consuming, 2)
+	assert.Equal(t, "10", consuming[0].RecordsLag["0"])
+
+	configs, err := client.GetTableConfig(ctx, "airlineStats")
+	assert.Nil(t, err)
+	assert.Equal(t, "365", configs.Offline.SegmentsConfig.RetentionTimeValue)
+	assert.Equal(t, "2", configs.Realtime.SegmentsConfig.ReplicasPerPartition)
+	_, err = client.GetTableConfig(ctx, "missing")
+	assert.NotNil(t, err)
+
+	schemas, err := client.ListSchemas(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"airlineStats", "githubEvents"}, schemas)
+	schema, err := client.GetSchema(ctx, "airlineStats")
+	assert.Nil(t, err)
+	assert.Equal(t, "DaysSinceEpoch", schema.DateTimeFieldSpecs[0].Name)
+
+	segments, err := client.ListSegments(ctx, "airlineStats")
+	assert.Nil(t, err)
+	assert.Len(t, segments["OFFLINE"], 2)
+	assert.Len(t, segments["REALTIME"], 1)
+
+	instances, err := client.ListInstances(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, instances, 5)
+	server, err := client.GetInstance(ctx, "Server_pinot-server-0_8098")
+	assert.Nil(t, err)
+	assert.Equal(t, "pinot-server-0", server.HostName)
+	assert.Equal(t, 8097, server.AdminPort)
+	assert.True(t, server.Enabled)
+
+	tenants, err := client.ListTenants(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"DefaultTenant", "events"}, tenants.ServerTenants)
+
+	taskTypes, err := client.ListTaskTypes(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"RealtimeToOfflineSegmentsTask"}, taskTypes)
+	states, err := client.GetTaskStates(ctx, "RealtimeToOfflineSegmentsTask")
+	assert.Nil(t, err)
+	assert.Equal(t, "IN_PROGRESS", states["Task_RealtimeToOfflineSegmentsTask_1704153600000"])
+}
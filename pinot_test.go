@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A fake Pinot controller that counts requests and answers with the given size
+func newFakeSizeController(status int, size int, requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"tableName": "trololo", "realtimeSegments": {"reportedSizeInBytes": %d}}`, size)
+	}))
+}
+
+func TestGetSizeForTableFailover(t *testing.T) {
+	var downRequests, upRequests int
+	down := newFakeSizeController(http.StatusServiceUnavailable, 0, &downRequests)
+	defer down.Close()
+	up := newFakeSizeController(http.StatusOK, 1234, &upRequests)
+	defer up.Close()
+
+	controller := NewPinotController("test", down.URL, up.URL)
+	size, err := controller.GetSizeForTable(context.Background(), "trololo")
+	assert.Nil(t, err)
+	assert.Equal(t, 1234, size)
+	assert.Equal(t, 1, downRequests)
+
+	// The failed controller is skipped on the next request
+	_, err = controller.GetSizeForTable(context.Background(), "trololo")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, downRequests)
+	assert.Equal(t, 2, upRequests)
+	assert.Equal(t, []string{up.URL, down.URL}, controller.endpoints(""))
+}
+
+func TestGetSizeForTableNoFailoverOnClientError(t *testing.T) {
+	var missingRequests, upRequests int
+	missing := newFakeSizeController(http.StatusNotFound, 0, &missingRequests)
+	defer missing.Close()
+	up := newFakeSizeController(http.StatusOK, 1234, &upRequests)
+	defer up.Close()
+
+	controller := NewPinotController("test", missing.URL, up.URL)
+	_, err := controller.GetSizeForTable(context.Background(), "skata")
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, upRequests)
+}
+
+func TestLeaderRouting(t *testing.T) {
+	var followerRequests, leaderRequests int
+	leader := newFakeSizeController(http.StatusOK, 42, &leaderRequests)
+	defer leader.Close()
+	leaderHostPort := strings.TrimPrefix(leader.URL, "http://")
+	leaderInstance := "Controller_" + strings.Replace(leaderHostPort, ":", "_", 1)
+
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		followerRequests++
+		if r.URL.Path == "/leader/tables" {
+			fmt.Fprintf(w, `{"leadControllerResourceEnabled": true, "leadControllerEntryMap": {
+				"leadControllerResource_0": {"leadControllerId": "%s", "tableNames": ["trololo_REALTIME"]}}}`, leaderInstance)
+			return
+		}
+		fmt.Fprint(w, `{"realtimeSegments": {"reportedSizeInBytes": 1}}`)
+	}))
+	defer follower.Close()
+
+	controller := NewPinotController("test", follower.URL, leader.URL)
+	controller.SetLeaderRouting(true)
+	assert.Nil(t, controller.RefreshLeaders(context.Background()))
+	assert.Equal(t, leader.URL, controller.leaderFor("trololo"))
+
+	size, err := controller.GetSizeForTable(context.Background(), "trololo")
+	assert.Nil(t, err)
+	assert.Equal(t, 42, size)
+	assert.Equal(t, 1, leaderRequests)
+
+	// Tables without a known leader go to the configured controllers
+	size, err = controller.GetSizeForTable(context.Background(), "skata")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, size)
+	assert.Equal(t, 2, followerRequests)
+}
+
+func TestLeaderRoutingOnlyToConfiguredControllers(t *testing.T) {
+	var requests int
+	controllerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/leader/tables" {
+			fmt.Fprint(w, `{"leadControllerResourceEnabled": true, "leadControllerEntryMap": {
+				"leadControllerResource_0": {"leadControllerId": "Controller_pinot-controller-1.internal_9000", "tableNames": ["trololo_REALTIME"]}}}`)
+			return
+		}
+		fmt.Fprint(w, `{"realtimeSegments": {"reportedSizeInBytes": 1}}`)
+	}))
+	defer controllerServer.Close()
+
+	controller := NewPinotController("unconfiguredleader", controllerServer.URL)
+	controller.SetLeaderRouting(true)
+	assert.Nil(t, controller.RefreshLeaders(context.Background()))
+	assert.Equal(t, "", controller.leaderFor("trololo"))
+
+	size, err := controller.GetSizeForTable(context.Background(), "trololo")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, size)
+	assert.Equal(t, 2, requests)
+	// The leader we don't know how to reach gets no up series
+	assert.False(t, ControllerUp.DeleteLabelValues("unconfiguredleader", "http://pinot-controller-1.internal:9000"))
+}
+
+func TestNoFailoverOnCancelledRequest(t *testing.T) {
+	var firstRequests, secondRequests int
+	ctx, cancel := context.WithCancel(context.Background())
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		firstRequests++
+		// the collection is cancelled while the controller is answering
+		cancel()
+		<-r.Context().Done()
+	}))
+	defer first.Close()
+	second := newFakeSizeController(http.StatusOK, 1234, &secondRequests)
+	defer second.Close()
+
+	controller := NewPinotController("cancelled", first.URL, second.URL)
+	_, err := controller.GetSizeForTable(ctx, "trololo")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, firstRequests)
+	assert.Equal(t, 0, secondRequests)
+	// The controller is neither marked down nor skipped
+	assert.False(t, ControllerUp.DeleteLabelValues("cancelled", first.URL))
+	assert.Equal(t, []string{first.URL, second.URL}, controller.endpoints(""))
+}
+
+func TestSetURLsForgetsRemovedControllers(t *testing.T) {
+	controller := NewPinotController("seturls", "http://controller-a:9000", "http://controller-b:9000")
+	controller.markHealthy("http://controller-a:9000", true)
+	controller.markHealthy("http://controller-b:9000", false)
+
+	controller.SetURLs([]string{"http://controller-a:9000"})
+	assert.Equal(t, []string{"http://controller-a:9000"}, controller.endpoints(""))
+	// Only the series of the remaining controller is left to delete
+	assert.False(t, ControllerUp.DeleteLabelValues("seturls", "http://controller-b:9000"))
+	assert.True(t, ControllerUp.DeleteLabelValues("seturls", "http://controller-a:9000"))
+}
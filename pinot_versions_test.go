@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+Serve the recorded controller responses of a Pinot release, from testdata/pinotversions/{version}.
+The response to GET /some/path is in some/path.json.
+*/
+func newRecordedPinot(t *testing.T, version string) *httptest.Server {
+	return newRecordedServer(t, filepath.Join("testdata", "pinotversions", version))
+}
+
+// Serve the recorded responses in dir, the response to GET /some/path being in some/path.json
+func newRecordedServer(t *testing.T, dir string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(strings.Trim(r.URL.Path, "/"))+".json"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPinotVersions(t *testing.T) {
+	cases := []struct {
+		version string
+		size    int
+		// lag of partition 0, empty when the release does not report it
+		lag string
+	}{
+		{version: "0.10.0", size: 2048},
+		{version: "0.12.1", size: 4096, lag: "50"},
+		{version: "1.2.0", size: 8192, lag: "50"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.version, func(t *testing.T) {
+			server := newRecordedPinot(t, tc.version)
+			controller := NewPinotController("test", server.URL)
+			ctx := context.Background()
+
+			version, err := controller.GetVersion(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.version, version)
+
+			tables, err := controller.ListTables(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"events"}, tables)
+
+			size, err := controller.GetSizeForTable(ctx, "events")
+			assert.Nil(t, err)
+			assert.Equal(t, tc.size, size)
+
+			consuming, err := controller.GetConsumingSegmentsInfo(ctx, "events")
+			assert.Nil(t, err)
+			if assert.Len(t, consuming, 1) {
+				assert.Equal(t, "Server_pinot-server-0_8098", consuming[0].Server)
+				assert.Equal(t, "CONSUMING", consuming[0].ConsumerState)
+				assert.Equal(t, "1200", consuming[0].CurrentOffsets["0"])
+				assert.Equal(t, tc.lag, consuming[0].RecordsLag["0"])
+			}
+		})
+	}
+}
+
+func TestPinotVersionMetric(t *testing.T) {
+	status := &ClusterStatus{}
+	status.RecordVersion("versioned", "0.12.1")
+	status.RecordVersion("versioned", "1.2.0")
+	assert.Equal(t, 1.0, testutil.ToFloat64(PinotVersionInfo.WithLabelValues("versioned", "1.2.0")))
+	// The series of the previous version is gone
+	assert.False(t, PinotVersionInfo.DeleteLabelValues("versioned", "0.12.1"))
+}
@@ -2,88 +2,346 @@ package main
 
 import (
 	"context"
+	"maps"
+	"reflect"
+	"slices"
+	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// How long restarting the monitoring of the pinots waits for the collections already running
+const restartDrainTimeout = 30 * time.Second
+
 /*
 Manages a series of Pinot clusters
 handles management of discovery, mebmership , metrics collection
 */
 
 type PinotManager struct {
+	// protects the maps below, which are updated from the refresh goroutine
+	mutex sync.Mutex
 	// known pinots.
-	knownPinots map[string]PinotController
+	knownPinots map[string]*PinotController
 	// table caches per known endpoint
 	tableCaches map[string]*TableCache
 	workerPools map[string]*CollectorWorkerPool
+	// monitoring status per known endpoint, kept while the endpoint is known
+	statuses map[string]*ClusterStatus
 	// channels to get Table updates from, for each pinot service endpoint (key)
-	tableChannels       map[string](chan []string)
+	tableChannels map[string](chan []string)
+	// cancels the goroutines monitoring each pinot
+	cancelFuncs         map[string]context.CancelFunc
 	numConnectorWorkers int
 	// Seconds
 	refreshInteval int
-	// kuberneted controller cache
-	kubeCache *KubePinotControllerCache
+	// how often each table is collected
+	collectionInteval time.Duration
+	// maximum random delay before each collection
+	collectionJitter time.Duration
+	// how long a single collection may take
+	collectionTimeout time.Duration
+	// discovery mechanism for pinot controllers
+	discovery PinotControllerDiscovery
+	// route per-table requests to the lead controller of each table
+	leaderRouting bool
+	// rate and concurrency limits on requests to the pinots, shared by all of them
+	limits *APILimits
+	// which collectors run for each pinot
+	collectors CollectorsConfig
+	// which tables are collected, shared by all of them
+	tableFilter *TableFilter
+	// where the controllers of all of them serve their own metrics
+	controllerMetrics *ControllerMetrics
+	// limits the series of each pinot, then adds its labels and relabels them, when they are gathered
+	seriesLimiter *SeriesLimiter
+	relabeler     *Relabeler
+	// wakes up the refresh loop after the configuration changed
+	reconfigured chan struct{}
+	// whether discovery ran at least once
+	discovered bool
 }
 
-func NewPinotManager(numWorkers int, refreshInteval int, kubeCache *KubePinotControllerCache) (*PinotManager, error) {
+func NewPinotManager(numWorkers int, refreshInteval int, discovery PinotControllerDiscovery) (*PinotManager, error) {
 	// setup with defaults
 	mgr := &PinotManager{
-		knownPinots:         make(map[string]PinotController),
+		knownPinots:         make(map[string]*PinotController),
 		tableCaches:         make(map[string]*TableCache),
 		workerPools:         make(map[string]*CollectorWorkerPool),
+		statuses:            make(map[string]*ClusterStatus),
 		tableChannels:       make(map[string](chan []string)),
-		kubeCache:           kubeCache,
+		cancelFuncs:         make(map[string]context.CancelFunc),
+		discovery:           discovery,
 		numConnectorWorkers: numWorkers,
 		refreshInteval:      refreshInteval,
+		collectionInteval:   time.Duration(refreshInteval) * time.Second,
+		collectionJitter:    defaultCollectionJitter,
+		collectionTimeout:   defaultCollectionTimeout,
+		limits:              NewAPILimits(RateLimitsConfig{}),
+		tableFilter:         NewTableFilter(TableFilterConfig{}),
+		controllerMetrics:   NewControllerMetrics(ControllerMetricsConfig{}),
+		seriesLimiter:       NewSeriesLimiter(SeriesLimitsConfig{}),
+		relabeler:           NewRelabeler(nil),
+		reconfigured:        make(chan struct{}, 1),
 	}
 	// TODO some validation and sanity checks
 	return mgr, nil
 }
 
-func (m *PinotManager) refreshPinotsForever() {
+// Refresh the known pinots from discovery until ctx is cancelled
+func (m *PinotManager) refreshPinotsForever(ctx context.Context) {
 	// Refresh
-	logger.Infof("Starting the refreshPinotsForever goroutine with a refresh inteval of %d", m.refreshInteval)
-	err := m.kubeCache.Connect()
+	discovery, refreshInteval := m.currentDiscovery()
+	logger.Infof("Starting the refreshPinotsForever goroutine with a refresh inteval of %d", refreshInteval)
+	err := discovery.Connect()
 	if err != nil {
 		panic(err)
 	}
 	// Do a first update before the ticker starts
-	endpoints := m.kubeCache.refreshPinotClustersList()
+	endpoints := discovery.refreshPinotClustersList()
 	m.updateKnownPinotsCache(endpoints)
 	// now start the ticker loop
-	ticker := time.NewTicker(time.Duration(m.refreshInteval) * time.Second)
-	for range ticker.C {
-		// This call refreshes the internal cache of m.kubeCache but also returns the results to us
-		logger.Debugf("refreshPinotsForever waking up after %d and refreshing cluster list", m.refreshInteval)
-		endpoints := m.kubeCache.refreshPinotClustersList()
-		// This is very naive. We should *add* and *remove* entries gracefully as each entry has associated workers and goroutines
+	ticker := time.NewTicker(time.Duration(refreshInteval) * time.Second)
+	defer ticker.Stop()
+	for {
+		// Discoveries that watch for changes wake us up before the next tick
+		var changes <-chan struct{}
+		if watcher, ok := discovery.(interface{ Changes() <-chan struct{} }); ok {
+			changes = watcher.Changes()
+		}
+		select {
+		case <-ctx.Done():
+			logger.Infof("Stopped refreshing the list of Pinot clusters")
+			return
+		case <-ticker.C:
+		case <-changes:
+			logger.Debugf("Discovery reported a change, refreshing cluster list")
+		case <-m.reconfigured:
+			// Discovery or interval may have changed, so refresh right away
+			_, refreshInteval = m.currentDiscovery()
+			ticker.Reset(time.Duration(refreshInteval) * time.Second)
+		}
+		discovery, refreshInteval = m.currentDiscovery()
+		// This call refreshes the internal cache of the discovery but also returns the results to us
+		logger.Debugf("refreshPinotsForever waking up after %d and refreshing cluster list", refreshInteval)
+		endpoints := discovery.refreshPinotClustersList()
 		m.updateKnownPinotsCache(endpoints)
 	}
 }
 
+func (m *PinotManager) currentDiscovery() (PinotControllerDiscovery, int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.discovery, m.refreshInteval
+}
+
+/*
+Apply a new configuration to the running manager.
+A non-nil discovery replaces the current one, and must already be connected.
+Changing the number of workers or how tables are collected restarts the monitoring of every
+known pinot. Metrics are kept, so there is no gap in the exported series, apart from
+those of collectors that were disabled.
+*/
+func (m *PinotManager) Reconfigure(numWorkers int, refreshInteval int, collectionInteval time.Duration, collectionJitter time.Duration, collectionTimeout time.Duration, leaderRouting bool, collectors CollectorsConfig, discovery PinotControllerDiscovery) {
+	m.mutex.Lock()
+	restart := numWorkers != m.numConnectorWorkers || refreshInteval != m.refreshInteval || collectionInteval != m.collectionInteval ||
+		collectionJitter != m.collectionJitter || collectionTimeout != m.collectionTimeout || !reflect.DeepEqual(collectors, m.collectors)
+	m.numConnectorWorkers = numWorkers
+	m.refreshInteval = refreshInteval
+	m.collectionInteval = collectionInteval
+	m.collectionJitter = collectionJitter
+	m.collectionTimeout = collectionTimeout
+	m.collectors = collectors
+	m.leaderRouting = leaderRouting
+	var oldDiscovery PinotControllerDiscovery
+	if discovery != nil {
+		oldDiscovery = m.discovery
+		m.discovery = discovery
+	}
+	restarted := make(map[string]*PinotController)
+	var oldPools []*CollectorWorkerPool
+	for pinot, controller := range m.knownPinots {
+		controller.SetLeaderRouting(leaderRouting)
+		if !restart {
+			continue
+		}
+		if workerPool, ok := m.workerPools[pinot]; ok {
+			oldPools = append(oldPools, workerPool)
+		}
+		err := m.unmonitorPinot(pinot)
+		if err != nil {
+			logger.Errorf("Encountered error while stopping monitoring of endpoint  %s due to error %s", pinot, err)
+		}
+		restarted[pinot] = controller
+	}
+	m.mutex.Unlock()
+
+	if closer, ok := oldDiscovery.(interface{ Close() }); ok {
+		closer.Close()
+	}
+	/*
+		Let the collections of the old pools finish first, so they don't run along the new pools
+		or write series of collectors that were just disabled. The lock is not held meanwhile,
+		so scrapes and the status pages are not blocked.
+	*/
+	if !waitForPools(oldPools, restartDrainTimeout) {
+		logger.Warnf("Collections did not finish within %s, restarting monitoring anyway", restartDrainTimeout)
+	}
+	m.mutex.Lock()
+	for pinot, controller := range restarted {
+		// Skip pinots that were removed meanwhile, or started again by discovery
+		if _, monitored := m.cancelFuncs[pinot]; monitored || m.knownPinots[pinot] != controller {
+			continue
+		}
+		logger.Infof("Restarting monitoring of %s with %d workers, a refresh interval of %d and a collection interval of %s", pinot, m.numConnectorWorkers, m.refreshInteval, m.collectionInteval)
+		err := m.monitorPinot(controller)
+		if err != nil {
+			logger.Errorf("Unable to start monitoring %s due to error %s", controller, err)
+		}
+	}
+	m.mutex.Unlock()
+
+	// Wake up the refresh loop, unless it already has a pending wake up
+	select {
+	case m.reconfigured <- struct{}{}:
+	default:
+	}
+}
+
+// Wait for the in-flight collections of the pools to finish, for at most timeout. Returns whether they did
+func waitForPools(pools []*CollectorWorkerPool, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		for _, workerPool := range pools {
+			workerPool.Close()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Apply new request limits, to the pinots already monitored as well as new ones
+func (m *PinotManager) SetRateLimits(config RateLimitsConfig) {
+	m.limits.Update(config)
+}
+
+// Apply a new table filter, from the next listing of the tables of each pinot
+func (m *PinotManager) SetTableFilter(config TableFilterConfig) {
+	m.tableFilter.Update(config)
+}
+
+// Apply a new controller metrics endpoint, from the next run of the periodic_tasks collector
+func (m *PinotManager) SetControllerMetrics(config ControllerMetricsConfig) {
+	m.controllerMetrics.Update(config)
+}
+
+// Apply new relabel rules, from the next time the metrics are gathered
+func (m *PinotManager) SetRelabelConfigs(configs []RelabelConfig) {
+	m.relabeler.Update(configs)
+}
+
+// Apply new series limits, from the next time the metrics are gathered
+func (m *PinotManager) SetSeriesLimits(config SeriesLimitsConfig) {
+	m.seriesLimiter.Update(config)
+}
+
+// The labels to add to the metrics of each known pinot, by pinot name
+func (m *PinotManager) ClusterLabels() map[string]map[string]string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	labels := make(map[string]map[string]string)
+	for name, pinot := range m.knownPinots {
+		if len(pinot.Labels) > 0 {
+			labels[name] = pinot.Labels
+		}
+	}
+	return labels
+}
+
+/*
+Gather the metrics of gatherer within the series limits, with the labels of each pinot added
+and the relabel rules applied. Series are limited first, as relabeling may rename them or
+remove their cluster.
+*/
+func (m *PinotManager) MetricsGatherer(gatherer prometheus.Gatherer) prometheus.Gatherer {
+	return m.relabeler.Gatherer(m.seriesLimiter.Gatherer(gatherer), m.ClusterLabels)
+}
+
+/*
+Stop monitoring all pinots and wait for in-flight collections to finish,
+or until ctx is done, whichever comes first.
+*/
+func (m *PinotManager) Shutdown(ctx context.Context) error {
+	m.mutex.Lock()
+	var workerPools []*CollectorWorkerPool
+	for pinot := range m.knownPinots {
+		workerPools = append(workerPools, m.workerPools[pinot])
+		err := m.unmonitorPinot(pinot)
+		if err != nil {
+			logger.Errorf("Encountered error while stopping monitoring of endpoint  %s due to error %s", pinot, err)
+		}
+		delete(m.knownPinots, pinot)
+	}
+	m.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		for _, workerPool := range workerPools {
+			workerPool.Close()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		logger.Infof("All collections finished")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 /*
 Updates known pinots.
 Checks if a pinot in the arguments is:
-- existing: Does nothing
+- existing: Updates its controller URLs and labels, if they changed
 - New: Adds a new TableCache and CollectorPool
 - Deleted: Removes an existing TableCache and CollectorPool
 */
-func (m *PinotManager) updateKnownPinotsCache(pinots []string) {
+func (m *PinotManager) updateKnownPinotsCache(pinots []*PinotController) {
 	logger.Debugf("updateKnownPinotsCache refresh received with %+v", pinots)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.discovered = true
 	currentPinots := make(map[string]struct{})
 	for _, pinot := range pinots {
-		currentPinots[pinot] = struct{}{}
+		currentPinots[pinot.String()] = struct{}{}
 	}
 
 	// Add new pinots that are not already monitored
 	for _, pinot := range pinots {
-		if _, exists := m.knownPinots[pinot]; !exists {
-			controller, err := m.monitorPinot(pinot)
-			if err != nil {
-				logger.Errorf("Unable to start monitoring %s due to error %s", pinot, err)
+		name := pinot.String()
+		if known, exists := m.knownPinots[name]; exists {
+			if !slices.Equal(known.AllURLs(), pinot.AllURLs()) {
+				logger.Infof("Controllers of %s changed from %+v to %+v", name, known.AllURLs(), pinot.AllURLs())
+				known.SetURLs(pinot.AllURLs())
 			}
-			m.knownPinots[pinot] = controller
+			if !maps.Equal(known.Labels, pinot.Labels) {
+				logger.Infof("Labels of %s changed from %+v to %+v", name, known.Labels, pinot.Labels)
+				known.Labels = pinot.Labels
+			}
+			continue
+		}
+		err := m.monitorPinot(pinot)
+		if err != nil {
+			logger.Errorf("Unable to start monitoring %s due to error %s", name, err)
 		}
+		m.knownPinots[name] = pinot
 	}
 
 	// Unmonitor pinots that are no longer in the discovered list
@@ -94,34 +352,54 @@ func (m *PinotManager) updateKnownPinotsCache(pinots []string) {
 				logger.Errorf("Encountered error while stopping monitoring of endpoint  %s due to error %s", pinot, err)
 			}
 			delete(m.knownPinots, pinot)
+			delete(m.statuses, pinot)
+			m.limits.RemoveCluster(pinot)
+			deleteClusterMetrics(pinot)
 		}
 	}
 }
 
-func (m *PinotManager) monitorPinot(endpoint string) (PinotController, error) {
-	var controller PinotController
-	controller.URL = endpoint
-	logger.Infof("Setting up monitoring for newly discovered Pinot %s", endpoint)
+func (m *PinotManager) monitorPinot(controller *PinotController) error {
+	endpoint := controller.String()
+	controller.SetLeaderRouting(m.leaderRouting)
+	controller.SetLimiter(m.limits.ForCluster(endpoint))
+	logger.Infof("Setting up monitoring for newly discovered Pinot %s (%+v)", endpoint, controller.AllURLs())
 
 	// Add a channel for table updates for this endpoint
 	tablesChan := make(chan []string)
 	m.tableChannels[endpoint] = tablesChan
 	// setup a tablecache to refresh tables for this pinot
-	tableCache := &TableCache{}
+	tableCache := &TableCache{cluster: endpoint}
 	m.tableCaches[endpoint] = tableCache
+	// Keep the status if we are restarting monitoring, e.g. after a config reload
+	status, exists := m.statuses[endpoint]
+	if !exists {
+		status = &ClusterStatus{}
+		m.statuses[endpoint] = status
+	}
 
 	// Start refreshing tables via a goroutine.
-	// when the provided channel is closed, that goroutine will return
-	ctx, _ := context.WithTimeout(context.Background(), time.Second*4)
-	go refreshTableCache(ctx, &controller, m.refreshInteval, m.tableChannels[endpoint])
+	// when the context is cancelled, that goroutine will return and close the channel,
+	// which in turn stops the fanout, the table cache listener and the workers.
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancelFuncs[endpoint] = cancel
+	go refreshTableCache(ctx, controller, status, m.tableFilter, m.refreshInteval, m.tableChannels[endpoint])
+	deleteDisabledCollectorMetrics(m.collectors, endpoint)
 
 	// setup a collectorpool to collect metrics from this pinot
-	workerPool := NewCollectorWorkerPool(m.numConnectorWorkers, &controller, tablesChan)
+	workerPool := NewCollectorWorkerPool(ctx, m.numConnectorWorkers, m.collectionInteval, controller, status, tableCache, tablesChan,
+		WithCollectionJitter(m.collectionJitter), WithCollectionTimeout(m.collectionTimeout),
+		WithTableCollectors(enabledTableCollectors(m.collectors, endpoint)...))
 	m.workerPools[endpoint] = workerPool
+	// The cluster collectors run in the pool too, so stopping the pool waits for them
+	target := &ClusterTarget{Controller: controller, TableCache: tableCache, ControllerMetrics: m.controllerMetrics}
+	for _, collector := range enabledClusterCollectors(m.collectors, endpoint, m.collectionInteval, m.collectionTimeout) {
+		workerPool.Go(func() { runClusterCollector(ctx, target, collector) })
+	}
 	// Create fanout consumer
 	go m.tableFanOutConsumer(endpoint, m.tableChannels[endpoint], m.tableCaches[endpoint], workerPool)
 
-	return controller, nil
+	return nil
 }
 func (m *PinotManager) tableFanOutConsumer(endpoint string, tables <-chan []string, tableCache *TableCache, workerPool *CollectorWorkerPool) {
 	// First setup the refresh listener using another channel that this goroutine will copy into
@@ -151,11 +429,15 @@ func (m *PinotManager) tableFanOutConsumer(endpoint string, tables <-chan []stri
 func (m *PinotManager) unmonitorPinot(endpoint string) error {
 
 	/*
-	   - close channels which will stop goroutines for these channels
+	   - cancel the context which will stop the goroutines of this endpoint
 	   - delete entries in maps for this endpoint, and destroy relevant objects
 	*/
 	logger.Infof("Stopping monitoring of removed Pinot %s", endpoint)
-	close(m.tableChannels[endpoint])
+	// It may not be monitored while Reconfigure restarts it
+	if cancel, ok := m.cancelFuncs[endpoint]; ok {
+		cancel()
+	}
+	delete(m.cancelFuncs, endpoint)
 	delete(m.tableChannels, endpoint)
 	delete(m.tableCaches, endpoint)
 	delete(m.workerPools, endpoint)
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A fake Pinot controller serving a fixed list of tables
+func newFakeTablesController(tables ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			fmt.Fprint(w, "OK")
+		case "/tables/":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"tables": [`)
+			for i, table := range tables {
+				if i > 0 {
+					fmt.Fprint(w, ",")
+				}
+				fmt.Fprintf(w, "%q", table)
+			}
+			fmt.Fprint(w, `]}`)
+		default:
+			fmt.Fprint(w, `{"realtimeSegments": {"reportedSizeInBytes": 1}}`)
+		}
+	}))
+}
+
+// Wait until the number of goroutines drops back to at most n
+func assertGoroutinesReturnTo(t *testing.T, n int) {
+	// Not using assert.Eventually, as it runs the condition in a goroutine of its own
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+		if runtime.NumGoroutine() <= n {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	buf := make([]byte, 1<<20)
+	t.Errorf("goroutines leaked: %d running, expected at most %d\n%s", runtime.NumGoroutine(), n, buf[:runtime.Stack(buf, true)])
+}
+
+func TestUnmonitorPinotStopsGoroutines(t *testing.T) {
+	server := newFakeTablesController("trololo", "skata")
+	defer server.Close()
+	baseline := runtime.NumGoroutine()
+
+	controller := NewPinotController("test", server.URL)
+	manager, err := NewPinotManager(2, 1, NewStaticPinotControllerCache(controller))
+	assert.Nil(t, err)
+
+	manager.updateKnownPinotsCache([]*PinotController{controller})
+	tableCache := manager.tableCaches["test"]
+	assert.Eventually(t, func() bool { return len(tableCache.GetTables()) == 2 }, 3*time.Second, 20*time.Millisecond)
+
+	// Removing the pinot used to panic sending on a closed channel
+	manager.updateKnownPinotsCache(nil)
+	assert.Empty(t, manager.knownPinots)
+	assert.Empty(t, manager.cancelFuncs)
+	assertGoroutinesReturnTo(t, baseline)
+}
+
+func TestRefreshPinotsForeverAndShutdown(t *testing.T) {
+	server := newFakeTablesController("trololo")
+	defer server.Close()
+	baseline := runtime.NumGoroutine()
+
+	controller := NewPinotController("test", server.URL)
+	manager, err := NewPinotManager(2, 1, NewStaticPinotControllerCache(controller))
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go manager.refreshPinotsForever(ctx)
+	assert.Eventually(t, func() bool {
+		manager.mutex.Lock()
+		defer manager.mutex.Unlock()
+		return len(manager.knownPinots) == 1
+	}, 3*time.Second, 20*time.Millisecond)
+
+	cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer shutdownCancel()
+	assert.Nil(t, manager.Shutdown(shutdownCtx))
+	assert.Empty(t, manager.knownPinots)
+	assertGoroutinesReturnTo(t, baseline)
+}
+
+func TestPipelineAgainstFakeController(t *testing.T) {
+	fake := newFakePinot(t, fakePinotFixture)
+	manager, err := NewPinotManager(2, 1, NewStaticPinotControllerCache(NewPinotController("fake", fake.URL())))
+	assert.Nil(t, err)
+	manager.collectionJitter = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go manager.refreshPinotsForever(ctx)
+
+	// Tables are listed and collected
+	collected := func(table string, size int) func() bool {
+		return func() bool {
+			tableCache, ok := manager.clusterTableCache("fake")
+			if !ok {
+				return false
+			}
+			info, ok := tableCache.GetTableInfo(table)
+			return ok && info.SizeBytes == size && !info.LastCollection.IsZero()
+		}
+	}
+	assert.Eventually(t, collected("githubEvents", 4096), 5*time.Second, 50*time.Millisecond)
+	assert.Eventually(t, collected("airlineStats", 1000), 5*time.Second, 50*time.Millisecond)
+
+	// Tables dropped from the cluster are forgotten
+	fake.update(func(cluster *fakePinotCluster) {
+		delete(cluster.Tables, "githubEvents")
+	})
+	assert.Eventually(t, func() bool {
+		tableCache, _ := manager.clusterTableCache("fake")
+		_, ok := tableCache.GetTableInfo("githubEvents")
+		return !ok
+	}, 5*time.Second, 50*time.Millisecond)
+
+	cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	assert.Nil(t, manager.Shutdown(shutdownCtx))
+}
+
+func TestClusterLabelsFollowDiscovery(t *testing.T) {
+	server := newFakeTablesController("trololo")
+	defer server.Close()
+	manager, err := NewPinotManager(1, 1, NewStaticPinotControllerCache())
+	assert.Nil(t, err)
+	discovered := func(labels map[string]string) []*PinotController {
+		controller := NewPinotController("labelled", server.URL)
+		controller.Labels = labels
+		return []*PinotController{controller, NewPinotController("plain", server.URL)}
+	}
+
+	manager.updateKnownPinotsCache(discovered(map[string]string{"team": "ingestion"}))
+	defer manager.updateKnownPinotsCache(nil)
+	assert.Equal(t, map[string]map[string]string{"labelled": {"team": "ingestion"}}, manager.ClusterLabels())
+
+	// Label changes of a known pinot are picked up without restarting its monitoring
+	cancel := manager.cancelFuncs["labelled"]
+	manager.updateKnownPinotsCache(discovered(map[string]string{"team": "query"}))
+	assert.Equal(t, map[string]map[string]string{"labelled": {"team": "query"}}, manager.ClusterLabels())
+	assert.Equal(t, fmt.Sprintf("%p", cancel), fmt.Sprintf("%p", manager.cancelFuncs["labelled"]))
+}
+
+func TestReconfigureWaitsForInFlightCollections(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tables/":
+			fmt.Fprint(w, `{"tables": ["trololo"]}`)
+		case "/tables/trololo/size":
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+			fmt.Fprint(w, `{"realtimeSegments": {"reportedSizeInBytes": 1}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	manager, err := NewPinotManager(1, 1, NewStaticPinotControllerCache())
+	assert.Nil(t, err)
+	manager.collectionJitter = 0
+	manager.collectors = CollectorsConfig{}
+	for _, name := range collectorNames() {
+		if name != "size" {
+			disabled := false
+			manager.collectors[name] = CollectorConfig{Enabled: &disabled}
+		}
+	}
+	manager.updateKnownPinotsCache([]*PinotController{NewPinotController("reconfigure", server.URL)})
+	defer manager.updateKnownPinotsCache(nil)
+	<-started
+
+	reconfigured := make(chan struct{})
+	go func() {
+		manager.Reconfigure(2, 1, time.Second, 0, defaultCollectionTimeout, false, manager.collectors, nil)
+		close(reconfigured)
+	}()
+	select {
+	case <-reconfigured:
+		t.Fatal("Reconfigure returned while a collection of the old pool was in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Scrapes and the status page are not blocked meanwhile
+	answered := make(chan struct{})
+	go func() {
+		manager.ClusterLabels()
+		manager.Status()
+		close(answered)
+	}()
+	select {
+	case <-answered:
+	case <-time.After(time.Second):
+		t.Fatal("the manager was locked while Reconfigure waited for the old pool")
+	}
+	close(release)
+	select {
+	case <-reconfigured:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Reconfigure did not return after the collection finished")
+	}
+}
+
+func TestReconfigureWaitsForClusterCollectors(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tables/":
+			fmt.Fprint(w, `{"tables": []}`)
+		case "/instances":
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+			fmt.Fprint(w, `{"instances": ["Broker_broker-0_8099"]}`)
+		case "/instances/Broker_broker-0_8099":
+			fmt.Fprint(w, `{"instanceName": "Broker_broker-0_8099", "enabled": true}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	manager, err := NewPinotManager(1, 1, NewStaticPinotControllerCache())
+	assert.Nil(t, err)
+	manager.collectors = CollectorsConfig{}
+	for _, name := range collectorNames() {
+		if name != "instances" {
+			disabled := false
+			manager.collectors[name] = CollectorConfig{Enabled: &disabled}
+		}
+	}
+	manager.updateKnownPinotsCache([]*PinotController{NewPinotController("reconfigureinstances", server.URL)})
+	defer manager.updateKnownPinotsCache(nil)
+	<-started
+
+	// Disable the instances collector while it runs
+	collectors := maps.Clone(manager.collectors)
+	disabled := false
+	collectors["instances"] = CollectorConfig{Enabled: &disabled}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+	}()
+	manager.Reconfigure(1, 1, time.Second, 0, defaultCollectionTimeout, false, collectors, nil)
+	// The run that was in flight finished before the series of the disabled collector were deleted
+	assert.False(t, Instances.DeleteLabelValues("reconfigureinstances", "broker"))
+}
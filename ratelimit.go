@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// A token bucket. Zero requests per second means unlimited.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `json:"requests_per_second" yaml:"requests_per_second"`
+	// Defaults to the requests per second, rounded up
+	Burst int `json:"burst" yaml:"burst"`
+}
+
+/*
+Limits on the requests we send to Pinot controllers.
+The global limits are shared by all clusters. Every cluster also gets its own bucket,
+configured by per_cluster unless there is an entry for it (by name) in clusters.
+*/
+type RateLimitsConfig struct {
+	Global     RateLimitConfig            `json:"global" yaml:"global"`
+	PerCluster RateLimitConfig            `json:"per_cluster" yaml:"per_cluster"`
+	Clusters   map[string]RateLimitConfig `json:"clusters" yaml:"clusters"`
+	// Maximum requests in flight across all clusters. Zero means unlimited
+	MaxConcurrentRequests int `json:"max_concurrent_requests" yaml:"max_concurrent_requests"`
+}
+
+func (c RateLimitConfig) IsValid() error {
+	if c.RequestsPerSecond < 0 || c.Burst < 0 {
+		return fmt.Errorf("requests_per_second and burst can't be negative")
+	}
+	return nil
+}
+
+func (c RateLimitConfig) limit() rate.Limit {
+	if c.RequestsPerSecond == 0 {
+		return rate.Inf
+	}
+	return rate.Limit(c.RequestsPerSecond)
+}
+
+func (c RateLimitConfig) burst() int {
+	if c.Burst > 0 {
+		return c.Burst
+	}
+	return int(math.Max(1, math.Ceil(c.RequestsPerSecond)))
+}
+
+func (c RateLimitsConfig) IsValid() error {
+	if err := c.Global.IsValid(); err != nil {
+		return fmt.Errorf("rate_limits.global: %w", err)
+	}
+	if err := c.PerCluster.IsValid(); err != nil {
+		return fmt.Errorf("rate_limits.per_cluster: %w", err)
+	}
+	for name, cluster := range c.Clusters {
+		if err := cluster.IsValid(); err != nil {
+			return fmt.Errorf("rate_limits.clusters.%s: %w", name, err)
+		}
+	}
+	if c.MaxConcurrentRequests < 0 {
+		return fmt.Errorf("rate_limits.max_concurrent_requests can't be negative")
+	}
+	return nil
+}
+
+func (c RateLimitsConfig) forCluster(name string) RateLimitConfig {
+	if cluster, ok := c.Clusters[name]; ok {
+		return cluster
+	}
+	return c.PerCluster
+}
+
+// Bounds the number of requests in flight. The limit can be changed at any time.
+type ConcurrencyLimiter struct {
+	mutex sync.Mutex
+	slots chan struct{}
+}
+
+func (c *ConcurrencyLimiter) SetLimit(limit int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if limit == 0 {
+		c.slots = nil
+		return
+	}
+	if c.slots == nil || cap(c.slots) != limit {
+		// Requests in flight release the slots they took, so they don't count against the new limit
+		c.slots = make(chan struct{}, limit)
+	}
+}
+
+// Wait for a free slot. The returned function releases it.
+func (c *ConcurrencyLimiter) Acquire(ctx context.Context) (func(), error) {
+	c.mutex.Lock()
+	slots := c.slots
+	c.mutex.Unlock()
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+/*
+All the limits that apply to the requests of one cluster.
+Shares the global bucket and concurrency limiter with the other clusters.
+*/
+type RequestLimiter struct {
+	cluster     string
+	global      *rate.Limiter
+	perCluster  *rate.Limiter
+	concurrency *ConcurrencyLimiter
+}
+
+// Wait until a request is allowed. The returned function must be called when the request is done.
+func (l *RequestLimiter) Wait(ctx context.Context) (func(), error) {
+	start := time.Now()
+	err := l.perCluster.Wait(ctx)
+	if err == nil {
+		err = l.global.Wait(ctx)
+	}
+	var release func()
+	if err == nil {
+		release, err = l.concurrency.Acquire(ctx)
+	}
+	if waited := time.Since(start); waited > time.Millisecond {
+		RateLimitWaitSeconds.WithLabelValues(l.cluster).Add(waited.Seconds())
+	}
+	return release, err
+}
+
+// The request limits of every cluster, updated in place when the configuration changes
+type APILimits struct {
+	mutex       sync.Mutex
+	config      RateLimitsConfig
+	global      *rate.Limiter
+	concurrency *ConcurrencyLimiter
+	clusters    map[string]*RequestLimiter
+}
+
+func NewAPILimits(config RateLimitsConfig) *APILimits {
+	l := &APILimits{
+		config:      config,
+		global:      rate.NewLimiter(config.Global.limit(), config.Global.burst()),
+		concurrency: &ConcurrencyLimiter{},
+		clusters:    make(map[string]*RequestLimiter),
+	}
+	l.concurrency.SetLimit(config.MaxConcurrentRequests)
+	return l
+}
+
+// The limiter for the named cluster, created on first use
+func (l *APILimits) ForCluster(name string) *RequestLimiter {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if limiter, ok := l.clusters[name]; ok {
+		return limiter
+	}
+	clusterConfig := l.config.forCluster(name)
+	limiter := &RequestLimiter{
+		cluster:     name,
+		global:      l.global,
+		perCluster:  rate.NewLimiter(clusterConfig.limit(), clusterConfig.burst()),
+		concurrency: l.concurrency,
+	}
+	l.clusters[name] = limiter
+	return limiter
+}
+
+// Forget the limiter of a cluster that is no longer monitored
+func (l *APILimits) RemoveCluster(name string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.clusters, name)
+}
+
+// Apply new limits to the global and all existing cluster limiters
+func (l *APILimits) Update(config RateLimitsConfig) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.config = config
+	l.global.SetLimit(config.Global.limit())
+	l.global.SetBurst(config.Global.burst())
+	l.concurrency.SetLimit(config.MaxConcurrentRequests)
+	for name, limiter := range l.clusters {
+		clusterConfig := config.forCluster(name)
+		limiter.perCluster.SetLimit(clusterConfig.limit())
+		limiter.perCluster.SetBurst(clusterConfig.burst())
+	}
+}
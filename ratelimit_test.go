@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitsConfig(t *testing.T) {
+	conf, err := NewConfigFromBytes([]byte(`
+mode: direct
+controller:
+  url: http://localhost:9000
+rate_limits:
+  global:
+    requests_per_second: 50
+  per_cluster:
+    requests_per_second: 2.5
+    burst: 4
+  clusters:
+    big:
+      requests_per_second: 20
+  max_concurrent_requests: 10
+`))
+	assert.Nil(t, err)
+	assert.Nil(t, conf.IsValid())
+	assert.Equal(t, 50, conf.RateLimits.Global.burst())
+	assert.Equal(t, 4, conf.RateLimits.forCluster("small").burst())
+	assert.Equal(t, 20.0, conf.RateLimits.forCluster("big").RequestsPerSecond)
+	assert.Equal(t, 10, conf.RateLimits.MaxConcurrentRequests)
+
+	conf.RateLimits.Clusters["big"] = RateLimitConfig{RequestsPerSecond: -1}
+	assert.NotNil(t, conf.IsValid())
+}
+
+func TestRequestLimiterRate(t *testing.T) {
+	limits := NewAPILimits(RateLimitsConfig{
+		PerCluster: RateLimitConfig{RequestsPerSecond: 1000, Burst: 1},
+		Clusters:   map[string]RateLimitConfig{"slow": {RequestsPerSecond: 1, Burst: 1}},
+	})
+	// The burst allows the first request right away, the second one has to wait for a token
+	slow := limits.ForCluster("slow")
+	release, err := slow.Wait(context.Background())
+	assert.Nil(t, err)
+	release()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = slow.Wait(ctx)
+	assert.NotNil(t, err)
+
+	// Other clusters have their own bucket
+	fast := limits.ForCluster("fast")
+	for i := 0; i < 3; i++ {
+		release, err = fast.Wait(context.Background())
+		assert.Nil(t, err)
+		release()
+	}
+
+	// Lifting the limit applies to existing clusters
+	limits.Update(RateLimitsConfig{})
+	release, err = slow.Wait(context.Background())
+	assert.Nil(t, err)
+	release()
+}
+
+func TestConcurrencyLimitIsShared(t *testing.T) {
+	limits := NewAPILimits(RateLimitsConfig{MaxConcurrentRequests: 1})
+	releaseFirst, err := limits.ForCluster("first").Wait(context.Background())
+	assert.Nil(t, err)
+
+	// The only slot is taken by the other cluster
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = limits.ForCluster("second").Wait(ctx)
+	assert.NotNil(t, err)
+
+	releaseFirst()
+	releaseSecond, err := limits.ForCluster("second").Wait(context.Background())
+	assert.Nil(t, err)
+	releaseSecond()
+}
+
+func TestControllerRequestsAreLimited(t *testing.T) {
+	var requests int
+	server := newFakeSizeController(http.StatusOK, 1234, &requests)
+	defer server.Close()
+
+	limits := NewAPILimits(RateLimitsConfig{PerCluster: RateLimitConfig{RequestsPerSecond: 1, Burst: 1}})
+	controller := NewPinotController("test", server.URL)
+	controller.SetLimiter(limits.ForCluster("test"))
+	_, err := controller.GetSizeForTable(context.Background(), "trololo")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = controller.GetSizeForTable(ctx, "trololo")
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, requests)
+}
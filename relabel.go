@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	labelNameRegexp   = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+	invalidLabelChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+)
+
+/*
+A Prometheus-style relabel rule, under relabel_configs: in the config file.
+The rules are applied in order to the labels of every exported series, its name being
+in __name__, after the labels of its cluster were added. Labels starting with __ are
+removed afterwards, as are labels with an empty value.
+*/
+type RelabelConfig struct {
+	SourceLabels []string `json:"source_labels" yaml:"source_labels"`
+	// Joins the values of the source labels. Defaults to ;
+	Separator string `json:"separator" yaml:"separator"`
+	// Anchored at both ends. Defaults to (.*)
+	Regex       string `json:"regex" yaml:"regex"`
+	TargetLabel string `json:"target_label" yaml:"target_label"`
+	// Defaults to $1
+	Replacement string `json:"replacement" yaml:"replacement"`
+	// One of replace (the default), keep, drop or labelmap
+	Action string `json:"action" yaml:"action"`
+}
+
+// Set the defaults for what the rule does not set
+func (c *RelabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = RelabelConfig{Separator: ";", Regex: "(.*)", Replacement: "$1", Action: "replace"}
+	type plain RelabelConfig
+	return unmarshal((*plain)(c))
+}
+
+type relabelRule struct {
+	RelabelConfig
+	regex *regexp.Regexp
+}
+
+func (c RelabelConfig) compile() (*relabelRule, error) {
+	regex, err := regexp.Compile("^(?:" + c.Regex + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid relabel regex %s: %w", c.Regex, err)
+	}
+	switch c.Action {
+	case "replace":
+		if c.TargetLabel == "" {
+			return nil, fmt.Errorf("relabel action replace needs a target_label")
+		}
+	case "keep", "drop":
+		if len(c.SourceLabels) == 0 {
+			return nil, fmt.Errorf("relabel action %s needs source_labels", c.Action)
+		}
+	case "labelmap":
+	default:
+		return nil, fmt.Errorf("unknown relabel action %s - should be one of 'replace', 'keep', 'drop' or 'labelmap'", c.Action)
+	}
+	return &relabelRule{RelabelConfig: c, regex: regex}, nil
+}
+
+// Apply the rule to the labels, returning false when the series is dropped
+func (r *relabelRule) apply(labels map[string]string) bool {
+	values := make([]string, len(r.SourceLabels))
+	for i, name := range r.SourceLabels {
+		values[i] = labels[name]
+	}
+	value := strings.Join(values, r.Separator)
+	switch r.Action {
+	case "keep":
+		return r.regex.MatchString(value)
+	case "drop":
+		return !r.regex.MatchString(value)
+	case "replace":
+		match := r.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return true
+		}
+		target := string(r.regex.ExpandString(nil, r.TargetLabel, value, match))
+		if !labelNameRegexp.MatchString(target) {
+			return true
+		}
+		replacement := string(r.regex.ExpandString(nil, r.Replacement, value, match))
+		if replacement == "" {
+			delete(labels, target)
+		} else {
+			labels[target] = replacement
+		}
+	case "labelmap":
+		mapped := make(map[string]string)
+		for name, value := range labels {
+			if r.regex.MatchString(name) {
+				mapped[r.regex.ReplaceAllString(name, r.Replacement)] = value
+			}
+		}
+		for name, value := range mapped {
+			labels[name] = value
+		}
+	}
+	return true
+}
+
+// Apply the rules in order, returning false when one of them drops the series
+func applyRelabelRules(rules []*relabelRule, labels map[string]string) bool {
+	for _, rule := range rules {
+		if !rule.apply(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check the relabel rules of the config
+func validateRelabelConfigs(configs []RelabelConfig) error {
+	for i, config := range configs {
+		if _, err := config.compile(); err != nil {
+			return fmt.Errorf("relabel_configs[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Turn a Kubernetes label or annotation name, like app.kubernetes.io/part-of, into a valid label name
+func sanitizeLabelName(name string) string {
+	name = invalidLabelChars.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+/*
+Adds the labels of each cluster to its series and applies the relabel rules, when the
+metrics are gathered. Updated in place when the config is reloaded.
+*/
+type Relabeler struct {
+	mutex sync.Mutex
+	rules []*relabelRule
+}
+
+// Create a relabeler from valid rules
+func NewRelabeler(configs []RelabelConfig) *Relabeler {
+	r := &Relabeler{}
+	r.Update(configs)
+	return r
+}
+
+// Apply new valid rules
+func (r *Relabeler) Update(configs []RelabelConfig) {
+	var rules []*relabelRule
+	for _, config := range configs {
+		rule, err := config.compile()
+		if err != nil {
+			panic(err)
+		}
+		rules = append(rules, rule)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.rules = rules
+}
+
+// Relabel what gatherer returns, clusterLabels giving the labels to add to the series of each cluster
+func (r *Relabeler) Gatherer(gatherer prometheus.Gatherer, clusterLabels func() map[string]map[string]string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := gatherer.Gather()
+		return r.relabel(families, clusterLabels()), err
+	})
+}
+
+func (r *Relabeler) relabel(families []*dto.MetricFamily, clusterLabels map[string]map[string]string) []*dto.MetricFamily {
+	r.mutex.Lock()
+	rules := r.rules
+	r.mutex.Unlock()
+	if len(rules) == 0 && len(clusterLabels) == 0 {
+		return families
+	}
+
+	var relabeled []*dto.MetricFamily
+	byName := make(map[string]*dto.MetricFamily)
+	// Relabeling may turn different series into the same one, of which we keep the first
+	seen := make(map[string]struct{})
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			labels := map[string]string{"__name__": family.GetName()}
+			for _, pair := range metric.Label {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			for name, value := range clusterLabels[labels["cluster"]] {
+				if _, exists := labels[name]; !exists {
+					labels[name] = value
+				}
+			}
+			if !applyRelabelRules(rules, labels) {
+				continue
+			}
+			name := labels["__name__"]
+			pairs := labelPairs(labels)
+			key := seriesKey(name, pairs)
+			if _, exists := seen[key]; exists {
+				continue
+			}
+			out, exists := byName[name]
+			if !exists {
+				out = &dto.MetricFamily{Name: &name, Help: family.Help, Type: family.Type}
+				byName[name] = out
+				relabeled = append(relabeled, out)
+			} else if out.GetType() != family.GetType() {
+				logger.Debugf("Dropping series %s relabeled into %s of another type", family.GetName(), name)
+				continue
+			}
+			seen[key] = struct{}{}
+			metric.Label = pairs
+			out.Metric = append(out.Metric, metric)
+		}
+	}
+	// Sorted like the registry does, as the labels of the series changed
+	sort.Slice(relabeled, func(i, j int) bool { return relabeled[i].GetName() < relabeled[j].GetName() })
+	for _, family := range relabeled {
+		sortMetrics(family.Metric)
+	}
+	return relabeled
+}
+
+// Sort the series of a family like the registry does: fewer labels first, then by label values
+func sortMetrics(metrics []*dto.Metric) {
+	sort.SliceStable(metrics, func(i, j int) bool {
+		left, right := metrics[i].Label, metrics[j].Label
+		if len(left) != len(right) {
+			return len(left) < len(right)
+		}
+		for k := range left {
+			if left[k].GetValue() != right[k].GetValue() {
+				return left[k].GetValue() < right[k].GetValue()
+			}
+		}
+		return false
+	})
+}
+
+// The exported labels, sorted by name
+func labelPairs(labels map[string]string) []*dto.LabelPair {
+	var pairs []*dto.LabelPair
+	for _, name := range sortedKeys(labels) {
+		value := labels[name]
+		if strings.HasPrefix(name, "__") || value == "" {
+			continue
+		}
+		pairs = append(pairs, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	return pairs
+}
+
+func seriesKey(name string, pairs []*dto.LabelPair) string {
+	var key strings.Builder
+	key.WriteString(name)
+	for _, pair := range pairs {
+		key.WriteString("\xff" + pair.GetName() + "\xff" + pair.GetValue())
+	}
+	return key.String()
+}
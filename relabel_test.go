@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelabelConfigs(t *testing.T) {
+	config, err := NewConfigFromBytes([]byte(`
+relabel_configs:
+  - source_labels: [cluster]
+    target_label: env
+    regex: "pinot-(.*)-.*"
+  - source_labels: [__name__, table]
+    regex: "pinotexporter_table_size_bytes;tmp_.*"
+    action: drop
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, []RelabelConfig{
+		{SourceLabels: []string{"cluster"}, Separator: ";", Regex: "pinot-(.*)-.*", TargetLabel: "env", Replacement: "$1", Action: "replace"},
+		{SourceLabels: []string{"__name__", "table"}, Separator: ";", Regex: "pinotexporter_table_size_bytes;tmp_.*", Replacement: "$1", Action: "drop"},
+	}, config.RelabelConfigs)
+	assert.Nil(t, validateRelabelConfigs(config.RelabelConfigs))
+
+	assert.NotNil(t, validateRelabelConfigs([]RelabelConfig{{Regex: "(", Action: "replace", TargetLabel: "env"}}))
+	assert.NotNil(t, validateRelabelConfigs([]RelabelConfig{{Regex: "(.*)", Action: "replace"}}))
+	assert.NotNil(t, validateRelabelConfigs([]RelabelConfig{{Regex: "(.*)", Action: "keep"}}))
+	assert.NotNil(t, validateRelabelConfigs([]RelabelConfig{{Regex: "(.*)", Action: "hashmod"}}))
+}
+
+func TestRelabelRules(t *testing.T) {
+	rule := func(config RelabelConfig) *relabelRule {
+		if config.Regex == "" {
+			config.Regex = "(.*)"
+		}
+		if config.Separator == "" {
+			config.Separator = ";"
+		}
+		compiled, err := config.compile()
+		assert.Nil(t, err)
+		return compiled
+	}
+	series := func() map[string]string {
+		return map[string]string{"__name__": "pinotexporter_table_size_bytes", "cluster": "pinot-prod-eu", "table": "airlineStats"}
+	}
+
+	labels := series()
+	assert.True(t, rule(RelabelConfig{SourceLabels: []string{"cluster"}, Regex: "pinot-(.*)-(.*)", TargetLabel: "region", Replacement: "$2", Action: "replace"}).apply(labels))
+	assert.Equal(t, "eu", labels["region"])
+	// No match leaves the labels alone
+	assert.True(t, rule(RelabelConfig{SourceLabels: []string{"cluster"}, Regex: "kafka-.*", TargetLabel: "region", Replacement: "none", Action: "replace"}).apply(labels))
+	assert.Equal(t, "eu", labels["region"])
+	// An empty replacement removes the label
+	assert.True(t, rule(RelabelConfig{TargetLabel: "table", Action: "replace"}).apply(labels))
+	assert.NotContains(t, labels, "table")
+
+	assert.True(t, rule(RelabelConfig{SourceLabels: []string{"table"}, Regex: "airline.*", Action: "keep"}).apply(series()))
+	assert.False(t, rule(RelabelConfig{SourceLabels: []string{"table"}, Regex: "github.*", Action: "keep"}).apply(series()))
+	assert.False(t, rule(RelabelConfig{SourceLabels: []string{"__name__", "table"}, Regex: ".*size.*;airline.*", Action: "drop"}).apply(series()))
+	assert.True(t, rule(RelabelConfig{SourceLabels: []string{"table"}, Regex: "github.*", Action: "drop"}).apply(series()))
+
+	labels = map[string]string{"__k8s_team": "ingestion", "__k8s_env": "prod"}
+	assert.True(t, rule(RelabelConfig{Regex: "__k8s_(.*)", Replacement: "$1", Action: "labelmap"}).apply(labels))
+	assert.Equal(t, map[string]string{"__k8s_team": "ingestion", "__k8s_env": "prod", "team": "ingestion", "env": "prod"}, labels)
+}
+
+func TestSanitizeLabelName(t *testing.T) {
+	assert.Equal(t, "team", sanitizeLabelName("team"))
+	assert.Equal(t, "app_kubernetes_io_part_of", sanitizeLabelName("app.kubernetes.io/part-of"))
+	assert.Equal(t, "_1st", sanitizeLabelName("1st"))
+}
+
+func TestRelabelerGatherer(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	sizes := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "pinotexporter_table_size_bytes", Help: "Size of the table"}, []string{"cluster", "table"})
+	registry.MustRegister(sizes)
+	sizes.WithLabelValues("prod", "airlineStats").Set(100)
+	sizes.WithLabelValues("prod", "tmp_load").Set(5)
+	sizes.WithLabelValues("staging", "airlineStats").Set(10)
+	clusterLabels := func() map[string]map[string]string {
+		// The labels of the series win over those of the cluster
+		return map[string]map[string]string{"prod": {"team": "ingestion", "table": "ignored"}}
+	}
+
+	relabeler := NewRelabeler(nil)
+	gatherer := relabeler.Gatherer(registry, clusterLabels)
+	expected := `
+# HELP pinotexporter_table_size_bytes Size of the table
+# TYPE pinotexporter_table_size_bytes gauge
+pinotexporter_table_size_bytes{cluster="prod",table="airlineStats",team="ingestion"} 100
+pinotexporter_table_size_bytes{cluster="prod",table="tmp_load",team="ingestion"} 5
+pinotexporter_table_size_bytes{cluster="staging",table="airlineStats"} 10
+`
+	assert.Nil(t, testutil.GatherAndCompare(gatherer, strings.NewReader(expected)))
+
+	relabeler.Update([]RelabelConfig{
+		{SourceLabels: []string{"table"}, Separator: ";", Regex: "tmp_.*", Replacement: "$1", Action: "drop"},
+		{SourceLabels: []string{"__name__"}, Separator: ";", Regex: "pinotexporter_(.*)", TargetLabel: "__name__", Replacement: "pinot_$1", Action: "replace"},
+		// Removing the cluster and team makes the airlineStats series the same, of which the first is kept
+		{Separator: ";", Regex: "(.*)", TargetLabel: "cluster", Replacement: "", Action: "replace"},
+		{Separator: ";", Regex: "(.*)", TargetLabel: "team", Replacement: "", Action: "replace"},
+	})
+	expected = `
+# HELP pinot_table_size_bytes Size of the table
+# TYPE pinot_table_size_bytes gauge
+pinot_table_size_bytes{table="airlineStats"} 100
+`
+	assert.Nil(t, testutil.GatherAndCompare(gatherer, strings.NewReader(expected)))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the config file is checked for changes
+const configWatchInterval = 10 * time.Second
+
+/*
+Reloads the configuration file on SIGHUP or when its content changes,
+and applies it to the running PinotManager.
+*/
+type ConfigReloader struct {
+	mutex   sync.Mutex
+	path    string
+	manager *PinotManager
+	current *Config
+	// hash of the config in use
+	currentHash [sha256.Size]byte
+	// hash of the last file content we tried to load, successfully or not
+	lastAttemptedHash [sha256.Size]byte
+}
+
+// Create a reloader for the config file at path, which was loaded as current
+func NewConfigReloader(path string, current *Config, manager *PinotManager) (*ConfigReloader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &ConfigReloader{
+		path:              path,
+		manager:           manager,
+		current:           current,
+		currentHash:       sha256.Sum256(data),
+		lastAttemptedHash: sha256.Sum256(data),
+	}
+	r.recordReload(true)
+	return r, nil
+}
+
+// The configuration currently in use
+func (r *ConfigReloader) Current() *Config {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.current
+}
+
+/*
+Load and validate the config file, and apply the differences to the manager.
+On any error the current configuration stays in place.
+*/
+func (r *ConfigReloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		r.recordReload(false)
+		return err
+	}
+	r.lastAttemptedHash = sha256.Sum256(data)
+	conf, err := NewConfigFromBytes(data)
+	if err == nil {
+		err = conf.IsValid()
+	}
+	if err != nil {
+		r.recordReload(false)
+		return fmt.Errorf("invalid config %s: %w", r.path, err)
+	}
+
+	var discovery PinotControllerDiscovery
+	if conf.DiscoveryChanged(r.current) {
+		logger.Infof("Pinot discovery changed, switching to %s mode", conf.Mode)
+		discovery, err = NewPinotControllerDiscovery(conf)
+		if err == nil {
+			err = discovery.Connect()
+		}
+		if err != nil {
+			r.recordReload(false)
+			return fmt.Errorf("failed to set up discovery: %w", err)
+		}
+	}
+	if conf.ListenPort != r.current.ListenPort {
+		logger.Warnf("Changing the listen port from %d to %d requires a restart", r.current.ListenPort, conf.ListenPort)
+		conf.ListenPort = r.current.ListenPort
+	}
+	r.manager.SetRateLimits(conf.RateLimits)
+	r.manager.SetTableFilter(conf.Tables)
+	r.manager.SetRelabelConfigs(conf.RelabelConfigs)
+	r.manager.SetSeriesLimits(conf.SeriesLimits)
+	r.manager.SetControllerMetrics(conf.ControllerMetrics)
+	r.manager.Reconfigure(conf.MaxParallelCollectors, conf.PollFrequencySeconds, conf.CollectionInterval(), conf.CollectionJitter(), conf.CollectionTimeout(), conf.LeaderRouting, conf.Collectors, discovery)
+
+	r.current = conf
+	r.currentHash = r.lastAttemptedHash
+	r.recordReload(true)
+	logger.Infof("Reloaded config %s (sha256 %s)", r.path, hex.EncodeToString(r.currentHash[:]))
+	return nil
+}
+
+// Whether the config file content differs from the last one we tried to load
+func (r *ConfigReloader) fileChanged() bool {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		logger.Warnf("Failed to read config %s: %s", r.path, err)
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return sha256.Sum256(data) != r.lastAttemptedHash
+}
+
+/*
+Reload on every signal received from hup, and whenever the config file changes,
+until ctx is cancelled. The file is polled rather than watched, as mounted
+ConfigMaps are updated by swapping symlinks.
+*/
+func (r *ConfigReloader) WatchForever(ctx context.Context, hup <-chan os.Signal) {
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Infof("Received SIGHUP, reloading config %s", r.path)
+		case <-ticker.C:
+			if !r.fileChanged() {
+				continue
+			}
+			logger.Infof("Config %s changed, reloading", r.path)
+		}
+		err := r.Reload()
+		if err != nil {
+			logger.Errorf("Failed to reload config, keeping the current one: %s", err)
+		}
+	}
+}
+
+func (r *ConfigReloader) recordReload(success bool) {
+	if !success {
+		ConfigLastReloadSuccessful.Set(0)
+		return
+	}
+	ConfigLastReloadSuccessful.Set(1)
+	ConfigLastReloadSuccessTimestamp.SetToCurrentTime()
+	// A float64 holds 53 bits exactly, so use the first 48 bits of the hash
+	hash := binary.BigEndian.Uint64(r.currentHash[:8]) >> 16
+	ConfigHash.Set(float64(hash))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, path string, content string) {
+	err := os.WriteFile(path, []byte(content), 0644)
+	assert.Nil(t, err)
+}
+
+func TestConfigReloaderReload(t *testing.T) {
+	server := newFakeTablesController("trololo")
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "pinotexporter.yaml")
+	writeConfig(t, path, fmt.Sprintf("mode: direct\ncontroller:\n  url: %s\n", server.URL))
+
+	conf, err := NewConfigFromFile(path)
+	assert.Nil(t, err)
+	discovery, err := NewPinotControllerDiscovery(conf)
+	assert.Nil(t, err)
+	manager, err := NewPinotManager(conf.MaxParallelCollectors, conf.PollFrequencySeconds, discovery)
+	assert.Nil(t, err)
+	manager.updateKnownPinotsCache(discovery.refreshPinotClustersList())
+	defer manager.updateKnownPinotsCache(nil)
+	firstPool := manager.workerPools[server.URL]
+
+	reloader, err := NewConfigReloader(path, conf, manager)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ConfigLastReloadSuccessful))
+	firstHash := testutil.ToFloat64(ConfigHash)
+	assert.False(t, reloader.fileChanged())
+
+	// An invalid config is rejected and the current one is kept
+	writeConfig(t, path, "mode: trololo\n")
+	assert.True(t, reloader.fileChanged())
+	assert.NotNil(t, reloader.Reload())
+	assert.Equal(t, 0.0, testutil.ToFloat64(ConfigLastReloadSuccessful))
+	assert.Equal(t, firstHash, testutil.ToFloat64(ConfigHash))
+	assert.Equal(t, conf, reloader.Current())
+	// and not retried until the file changes again
+	assert.False(t, reloader.fileChanged())
+
+	// So is one that would stop the refresh loop
+	writeConfig(t, path, fmt.Sprintf("mode: direct\npoll_freq_seconds: 0\ncontroller:\n  url: %s\n", server.URL))
+	assert.NotNil(t, reloader.Reload())
+	assert.Equal(t, 0.0, testutil.ToFloat64(ConfigLastReloadSuccessful))
+	assert.Equal(t, conf, reloader.Current())
+
+	// More workers restart the monitoring of the same cluster
+	writeConfig(t, path, fmt.Sprintf("mode: direct\nmax_parallel_collectors: 7\nleader_routing: true\ncontroller:\n  url: %s\n", server.URL))
+	assert.Nil(t, reloader.Reload())
+	assert.Equal(t, 1.0, testutil.ToFloat64(ConfigLastReloadSuccessful))
+	assert.NotEqual(t, firstHash, testutil.ToFloat64(ConfigHash))
+	assert.Equal(t, 7, reloader.Current().MaxParallelCollectors)
+	manager.mutex.Lock()
+	assert.Equal(t, 7, manager.numConnectorWorkers)
+	assert.NotSame(t, firstPool, manager.workerPools[server.URL])
+	assert.True(t, manager.knownPinots[server.URL].LeaderRouting())
+	manager.mutex.Unlock()
+}
+
+func TestConfigReloaderSwitchesDiscovery(t *testing.T) {
+	first := newFakeTablesController("trololo")
+	defer first.Close()
+	second := newFakeTablesController("skata")
+	defer second.Close()
+	path := filepath.Join(t.TempDir(), "pinotexporter.yaml")
+	writeConfig(t, path, fmt.Sprintf("mode: direct\npoll_freq_seconds: 1\ncontroller:\n  url: %s\n", first.URL))
+
+	conf, err := NewConfigFromFile(path)
+	assert.Nil(t, err)
+	discovery, err := NewPinotControllerDiscovery(conf)
+	assert.Nil(t, err)
+	manager, err := NewPinotManager(conf.MaxParallelCollectors, conf.PollFrequencySeconds, discovery)
+	assert.Nil(t, err)
+	reloader, err := NewConfigReloader(path, conf, manager)
+	assert.Nil(t, err)
+	manager.updateKnownPinotsCache(discovery.refreshPinotClustersList())
+	defer manager.updateKnownPinotsCache(nil)
+
+	writeConfig(t, path, fmt.Sprintf("mode: direct\npoll_freq_seconds: 1\ncontroller:\n  url: %s\n", second.URL))
+	assert.Nil(t, reloader.Reload())
+	// The refresh loop is woken up and picks the new discovery
+	assert.Len(t, manager.reconfigured, 1)
+	newDiscovery, _ := manager.currentDiscovery()
+	manager.updateKnownPinotsCache(newDiscovery.refreshPinotClustersList())
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	assert.Contains(t, manager.knownPinots, second.URL)
+	assert.NotContains(t, manager.knownPinots, first.URL)
+}
+
+func TestConfigDiscoveryChanged(t *testing.T) {
+	config := NewConfig(WithPinotCluster(PinotController{URL: "http://localhost:9000"}))
+	other := NewConfig(WithPinotCluster(PinotController{URL: "http://localhost:9000"}), WithMaxParallelCollectors(12))
+	assert.False(t, config.DiscoveryChanged(other))
+	other.PinotController.URLs = []string{"http://localhost:9001"}
+	assert.True(t, config.DiscoveryChanged(other))
+}
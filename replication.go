@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// The state of every replica of every segment of a table: table type -> segment -> instance -> state
+type ExternalView map[string]map[string]map[string]string
+
+// Get the external view of a table, from GET /tables/{tableName}/externalview
+func (c *PinotController) GetExternalView(ctx context.Context, tableName string) (ExternalView, error) {
+	var view ExternalView
+	err := c.getJSON(ctx, c.leaderFor(tableName), fmt.Sprintf("/tables/%s/externalview", url.PathEscape(tableName)), &view)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting external view of table %s from %s: %w", tableName, c, err)
+	}
+	return view, nil
+}
+
+/*
+Compare the configured replication of a table with the replicas serving each segment,
+and export the number of under- and over-replicated segments.
+A replica serves a segment when it is ONLINE, or CONSUMING for realtime tables.
+*/
+func collectReplication(ctx context.Context, controller PinotControllerInterface, table string, configs TableConfigs) error {
+	cluster := controller.String()
+	view, err := controller.GetExternalView(ctx, table)
+	if err != nil {
+		return err
+	}
+	for tableType, config := range configs.ByType() {
+		expected, err := config.Replication()
+		if err != nil {
+			// Already reported along with the config
+			continue
+		}
+		segments := view[tableType]
+		under, over := 0, 0
+		for _, replicas := range segments {
+			serving := 0
+			for _, state := range replicas {
+				if state == "ONLINE" || state == "CONSUMING" {
+					serving++
+				}
+			}
+			if serving < expected {
+				under++
+			} else if serving > expected {
+				over++
+			}
+		}
+		TableSegments.WithLabelValues(cluster, table, tableType).Set(float64(len(segments)))
+		TableSegmentsUnderReplicated.WithLabelValues(cluster, table, tableType).Set(float64(under))
+		TableSegmentsOverReplicated.WithLabelValues(cluster, table, tableType).Set(float64(over))
+	}
+	return nil
+}
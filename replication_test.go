@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectReplication(t *testing.T) {
+	fake := newFakePinot(t, fakePinotFixture)
+	controller := NewPinotController("replication", fake.URL())
+
+	for _, table := range []string{"airlineStats", "githubEvents"} {
+		configs, err := controller.GetTableConfigs(context.Background(), table)
+		assert.Nil(t, err)
+		err = collectReplication(context.Background(), controller, table, configs)
+		assert.Nil(t, err)
+	}
+
+	// One of the replicas of an offline segment is in ERROR
+	assert.Equal(t, 2.0, testutil.ToFloat64(TableSegments.WithLabelValues("replication", "airlineStats", "OFFLINE")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(TableSegmentsUnderReplicated.WithLabelValues("replication", "airlineStats", "OFFLINE")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(TableSegmentsOverReplicated.WithLabelValues("replication", "airlineStats", "OFFLINE")))
+	// Consuming replicas count
+	assert.Equal(t, 0.0, testutil.ToFloat64(TableSegmentsUnderReplicated.WithLabelValues("replication", "airlineStats", "REALTIME")))
+	// A segment of a table with one replica is on two servers
+	assert.Equal(t, 1.0, testutil.ToFloat64(TableSegmentsOverReplicated.WithLabelValues("replication", "githubEvents", "REALTIME")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(TableSegmentsUnderReplicated.WithLabelValues("replication", "githubEvents", "REALTIME")))
+}
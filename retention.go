@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// The metadata of a segment, as reported by the servers holding it
+type SegmentMetadata struct {
+	SegmentName        string `json:"segmentName"`
+	CreationTimeMillis int64  `json:"creationTimeMillis"`
+	// Range of the data in the segment. Not set for segments still consuming, or tables without a time column
+	StartTimeMillis int64 `json:"startTimeMillis"`
+	EndTimeMillis   int64 `json:"endTimeMillis"`
+	TotalDocs       int64 `json:"totalDocs"`
+}
+
+// Get the metadata of the segments of one type of a table, from GET /segments/{tableName}/metadata
+func (c *PinotController) GetSegmentsMetadata(ctx context.Context, tableName string, tableType string) (map[string]SegmentMetadata, error) {
+	var metadata map[string]SegmentMetadata
+	apiPath := fmt.Sprintf("/segments/%s/metadata?type=%s", url.PathEscape(tableName), url.QueryEscape(tableType))
+	err := c.getJSON(ctx, c.leaderFor(tableName), apiPath, &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting metadata of %s segments of table %s from %s: %w", tableType, tableName, c, err)
+	}
+	return metadata, nil
+}
+
+/*
+Export the range of data of a table, how old its newest data is, and the segments
+that are past the configured retention and should have been purged.
+Sizes of the segments come from the size of the table, as collected with it.
+*/
+func collectRetention(ctx context.Context, controller PinotControllerInterface, table string, configs TableConfigs, size TableSize, now time.Time) error {
+	cluster := controller.String()
+	for tableType, config := range configs.ByType() {
+		segments, err := controller.GetSegmentsMetadata(ctx, table, tableType)
+		if err != nil {
+			return err
+		}
+		retention, err := config.Retention()
+		if err != nil {
+			// Already reported along with the config
+			retention = 0
+		}
+		var segmentSizes map[string]SegmentSize
+		if typeSize := size.ByType(tableType); typeSize != nil {
+			segmentSizes = typeSize.Segments
+		}
+
+		var minTime, maxTime int64
+		outOfRetention, outOfRetentionBytes := 0, 0
+		for name, segment := range segments {
+			if segment.EndTimeMillis <= 0 {
+				continue
+			}
+			if minTime == 0 || segment.StartTimeMillis < minTime {
+				minTime = segment.StartTimeMillis
+			}
+			if segment.EndTimeMillis > maxTime {
+				maxTime = segment.EndTimeMillis
+			}
+			if retention > 0 && time.UnixMilli(segment.EndTimeMillis).Add(retention).Before(now) {
+				outOfRetention++
+				outOfRetentionBytes += segmentSizes[name].ReportedSizeInBytes
+			}
+		}
+		if maxTime > 0 {
+			TableDataTimeMinSeconds.WithLabelValues(cluster, table, tableType).Set(float64(minTime) / 1000)
+			TableDataTimeMaxSeconds.WithLabelValues(cluster, table, tableType).Set(float64(maxTime) / 1000)
+			TableNewestSegmentAgeSeconds.WithLabelValues(cluster, table, tableType).Set(now.Sub(time.UnixMilli(maxTime)).Seconds())
+		}
+		TableSegmentsOutOfRetention.WithLabelValues(cluster, table, tableType).Set(float64(outOfRetention))
+		TableSegmentsOutOfRetentionBytes.WithLabelValues(cluster, table, tableType).Set(float64(outOfRetentionBytes))
+	}
+	return nil
+}
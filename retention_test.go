@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectRetention(t *testing.T) {
+	fake := newFakePinot(t, fakePinotFixture)
+	controller := NewPinotController("retention", fake.URL())
+	ctx := context.Background()
+	configs, err := controller.GetTableConfigs(ctx, "airlineStats")
+	assert.Nil(t, err)
+	size, err := controller.GetTableSize(ctx, "airlineStats")
+	assert.Nil(t, err)
+
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	err = collectRetention(ctx, controller, "airlineStats", configs, size, now)
+	assert.Nil(t, err)
+
+	// The older offline segment is past the 365 days of retention
+	assert.Equal(t, 1.0, testutil.ToFloat64(TableSegmentsOutOfRetention.WithLabelValues("retention", "airlineStats", "OFFLINE")))
+	assert.Equal(t, 1200.0, testutil.ToFloat64(TableSegmentsOutOfRetentionBytes.WithLabelValues("retention", "airlineStats", "OFFLINE")))
+	assert.Equal(t, 1653955200.0, testutil.ToFloat64(TableDataTimeMinSeconds.WithLabelValues("retention", "airlineStats", "OFFLINE")))
+	assert.Equal(t, 1703980800.0, testutil.ToFloat64(TableDataTimeMaxSeconds.WithLabelValues("retention", "airlineStats", "OFFLINE")))
+	assert.Equal(t, (2 * 24 * time.Hour).Seconds(), testutil.ToFloat64(TableNewestSegmentAgeSeconds.WithLabelValues("retention", "airlineStats", "OFFLINE")))
+
+	assert.Equal(t, 0.0, testutil.ToFloat64(TableSegmentsOutOfRetention.WithLabelValues("retention", "airlineStats", "REALTIME")))
+	assert.Equal(t, (24 * time.Hour).Seconds(), testutil.ToFloat64(TableNewestSegmentAgeSeconds.WithLabelValues("retention", "airlineStats", "REALTIME")))
+
+	// Ten days later the realtime segment is past its 5 days of retention too
+	err = collectRetention(ctx, controller, "airlineStats", configs, size, now.Add(10*24*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(TableSegmentsOutOfRetention.WithLabelValues("retention", "airlineStats", "REALTIME")))
+	assert.Equal(t, 1000.0, testutil.ToFloat64(TableSegmentsOutOfRetentionBytes.WithLabelValues("retention", "airlineStats", "REALTIME")))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+/*
+Decides when each table of a cluster is due for collection.
+Every table is collected once per interval. New tables get a stable offset within
+the interval, derived from their name, so collections are spread evenly instead of
+all tables being collected at once. A table whose previous collection is still in
+flight is skipped for that round.
+*/
+type TableScheduler struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	tables   map[string]*scheduledTable
+}
+
+type scheduledTable struct {
+	nextDue  time.Time
+	inFlight bool
+}
+
+func NewTableScheduler(interval time.Duration) *TableScheduler {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &TableScheduler{
+		interval: interval,
+		tables:   make(map[string]*scheduledTable),
+	}
+}
+
+// Offset of a table within the interval. Always the same for a given table name.
+func (s *TableScheduler) offset(table string) time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(table))
+	return time.Duration(h.Sum64() % uint64(s.interval))
+}
+
+// Start scheduling new tables and stop scheduling the ones that are gone
+func (s *TableScheduler) UpdateTables(now time.Time, tables []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current := make(map[string]struct{}, len(tables))
+	for _, table := range tables {
+		current[table] = struct{}{}
+		if _, exists := s.tables[table]; !exists {
+			s.tables[table] = &scheduledTable{nextDue: now.Add(s.offset(table))}
+		}
+	}
+	for table := range s.tables {
+		if _, exists := current[table]; !exists {
+			delete(s.tables, table)
+		}
+	}
+}
+
+/*
+Return the tables due for collection at now and mark them as in flight.
+Also returns how many due tables were skipped because their previous collection is still running.
+*/
+func (s *TableScheduler) Due(now time.Time) ([]string, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var due []string
+	skipped := 0
+	for table, scheduled := range s.tables {
+		if now.Before(scheduled.nextDue) {
+			continue
+		}
+		// Keep the table's phase within the interval, even if we fell behind
+		for !now.Before(scheduled.nextDue) {
+			scheduled.nextDue = scheduled.nextDue.Add(s.interval)
+		}
+		if scheduled.inFlight {
+			skipped++
+			continue
+		}
+		scheduled.inFlight = true
+		due = append(due, table)
+	}
+	return due, skipped
+}
+
+// Mark the collection of a table as finished
+func (s *TableScheduler) Done(table string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if scheduled, exists := s.tables[table]; exists {
+		scheduled.inFlight = false
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableSchedulerSpreadsTables(t *testing.T) {
+	interval := time.Minute
+	scheduler := NewTableScheduler(interval)
+	start := time.Now()
+	var tables []string
+	for i := 0; i < 600; i++ {
+		tables = append(tables, fmt.Sprintf("table_%d", i))
+	}
+	scheduler.UpdateTables(start, tables)
+
+	// Each table is due exactly once per interval, and no second has more than a few tables
+	seen := make(map[string]int)
+	for second := 1; second <= 60; second++ {
+		due, skipped := scheduler.Due(start.Add(time.Duration(second) * time.Second))
+		assert.Equal(t, 0, skipped)
+		assert.LessOrEqual(t, len(due), 30, "too many tables due at second %d", second)
+		for _, table := range due {
+			seen[table]++
+			scheduler.Done(table)
+		}
+	}
+	assert.Len(t, seen, 600)
+	for table, count := range seen {
+		assert.Equal(t, 1, count, "table %s collected %d times", table, count)
+	}
+}
+
+func TestTableSchedulerSkipsInFlight(t *testing.T) {
+	scheduler := NewTableScheduler(time.Second)
+	start := time.Now()
+	scheduler.UpdateTables(start, []string{"trololo"})
+
+	due, _ := scheduler.Due(start.Add(time.Second))
+	assert.Equal(t, []string{"trololo"}, due)
+
+	// Still running a round later
+	due, skipped := scheduler.Due(start.Add(2 * time.Second))
+	assert.Empty(t, due)
+	assert.Equal(t, 1, skipped)
+
+	scheduler.Done("trololo")
+	due, _ = scheduler.Due(start.Add(3 * time.Second))
+	assert.Equal(t, []string{"trololo"}, due)
+}
+
+func TestTableSchedulerUpdateTables(t *testing.T) {
+	scheduler := NewTableScheduler(time.Second)
+	start := time.Now()
+	scheduler.UpdateTables(start, []string{"trololo", "skata"})
+	scheduler.UpdateTables(start, []string{"skata", "pola"})
+
+	due, _ := scheduler.Due(start.Add(time.Second))
+	slices.Sort(due)
+	assert.Equal(t, []string{"pola", "skata"}, due)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+A source of Pinot controller endpoints.
+PinotManager periodically asks its discovery for the current list of endpoints
+and starts or stops monitoring clusters accordingly.
+*/
+type PinotControllerDiscovery interface {
+	// Prepare the discovery mechanism (create clients, check files exist etc)
+	Connect() error
+	// Return the currently known Pinot clusters
+	refreshPinotClustersList() []*PinotController
+}
+
+// Create the discovery mechanism that matches the configured mode
+func NewPinotControllerDiscovery(conf *Config) (PinotControllerDiscovery, error) {
+	switch conf.Mode {
+	case "direct":
+		return NewStaticPinotControllerCache(NewPinotControllerFromConfig(*conf.PinotController)), nil
+	case "kubernetes":
+		return NewKubePinotControllerCache(conf.ServiceDiscovery), nil
+	case "file":
+		return NewFilePinotControllerCache(conf.FileDiscovery), nil
+	case "dns":
+		return NewDNSPinotControllerCache(conf.DNSDiscovery), nil
+	case "zookeeper":
+		return NewZKPinotControllerCache(conf.ZKDiscovery), nil
+	}
+	return nil, fmt.Errorf("no discovery mechanism for mode %s", conf.Mode)
+}
+
+// A fixed list of Pinot controllers, as given in the config
+type StaticPinotControllerCache struct {
+	knownControllers []*PinotController
+}
+
+func NewStaticPinotControllerCache(controllers ...*PinotController) *StaticPinotControllerCache {
+	return &StaticPinotControllerCache{
+		knownControllers: controllers,
+	}
+}
+
+func (s *StaticPinotControllerCache) Connect() error {
+	return nil
+}
+
+func (s *StaticPinotControllerCache) refreshPinotClustersList() []*PinotController {
+	return s.knownControllers
+}
+
+// Prefix an endpoint with a scheme if it does not already have one
+func endpointWithScheme(endpoint string, scheme string) string {
+	if strings.Contains(endpoint, "://") {
+		return endpoint
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s", scheme, endpoint)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+Discover Pinot controllers through DNS.
+Each name is one Pinot cluster, and the records behind it are the controllers of that cluster.
+With type SRV, each name is resolved to a list of host:port targets.
+With type A, each name is resolved to its addresses and the configured port is used.
+*/
+type ServiceDiscoveryConfigDNS struct {
+	Names []string `json:"names" yaml:"names"`
+	// Record type to query. One of "SRV" or "A"
+	Type string `json:"type" yaml:"type"`
+	// Port to use for A records. SRV records carry their own port
+	Port int `json:"port" yaml:"port"`
+	// Scheme of the discovered endpoints. Defaults to http
+	Scheme string `json:"scheme" yaml:"scheme"`
+}
+
+// The subset of net.Resolver we need, so tests can replace it
+type dnsResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// A Pinot Controller cache from DNS discovery
+type DNSPinotControllerCache struct {
+	knownControllers []*PinotController
+	resolver         dnsResolver
+	discoveryConfig  ServiceDiscoveryConfigDNS
+}
+
+func NewDNSPinotControllerCache(discoveryConfig ServiceDiscoveryConfigDNS) *DNSPinotControllerCache {
+	return &DNSPinotControllerCache{
+		resolver:        net.DefaultResolver,
+		discoveryConfig: discoveryConfig,
+	}
+}
+
+// Nothing to connect to for DNS, we use the system resolver
+func (d *DNSPinotControllerCache) Connect() error {
+	return nil
+}
+
+/*
+Return a cluster for each name that resolves to at least one endpoint.
+If a name can't be resolved, its last known endpoints are kept, so a DNS hiccup does
+not make us drop the cluster and its metrics.
+*/
+func (d *DNSPinotControllerCache) refreshPinotClustersList() []*PinotController {
+	var knownControllers []*PinotController
+
+	previous := make(map[string]*PinotController)
+	for _, controller := range d.knownControllers {
+		previous[controller.String()] = controller
+	}
+	for _, name := range d.discoveryConfig.Names {
+		// TODO extract hardcoded timeout to a config
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		endpoints, err := d.lookup(ctx, name)
+		cancel()
+		if err != nil {
+			logger.Errorf("Error resolving %s record %s: %s", d.discoveryConfig.Type, name, err)
+			if controller, ok := previous[name]; ok {
+				knownControllers = append(knownControllers, controller)
+			}
+			continue
+		}
+		if len(endpoints) == 0 {
+			continue
+		}
+		slices.Sort(endpoints)
+		logger.Debugf("Resolved %s to endpoints: %+v\n", name, endpoints)
+		knownControllers = append(knownControllers, NewPinotController(name, slices.Compact(endpoints)...))
+	}
+	d.knownControllers = knownControllers
+	return knownControllers
+}
+
+// Resolve a single name to the endpoints behind it
+func (d *DNSPinotControllerCache) lookup(ctx context.Context, name string) ([]string, error) {
+	var endpoints []string
+	switch strings.ToUpper(d.discoveryConfig.Type) {
+	case "SRV":
+		_, records, err := d.resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			endpoints = append(endpoints, endpointWithScheme(fmt.Sprintf("%s:%d", host, record.Port), d.discoveryConfig.Scheme))
+		}
+	case "A":
+		addresses, err := d.resolver.LookupHost(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range addresses {
+			hostPort := net.JoinHostPort(address, fmt.Sprint(d.discoveryConfig.Port))
+			endpoints = append(endpoints, endpointWithScheme(hostPort, d.discoveryConfig.Scheme))
+		}
+	default:
+		return nil, fmt.Errorf("unknown DNS record type %s", d.discoveryConfig.Type)
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeResolver struct {
+	srv   map[string][]*net.SRV
+	hosts map[string][]string
+}
+
+func (f *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	records, ok := f.srv[name]
+	if !ok {
+		return "", nil, fmt.Errorf("no such host %s", name)
+	}
+	return name, records, nil
+}
+
+func (f *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addresses, ok := f.hosts[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	return addresses, nil
+}
+
+func TestDNSRefreshPinotClustersListSRV(t *testing.T) {
+	cache := NewDNSPinotControllerCache(ServiceDiscoveryConfigDNS{
+		Names: []string{"_pinot._tcp.example.com", "_missing._tcp.example.com"},
+		Type:  "SRV",
+	})
+	cache.resolver = &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_pinot._tcp.example.com": {
+				{Target: "controller-b.example.com.", Port: 9000},
+				{Target: "controller-a.example.com.", Port: 9000},
+			},
+		},
+	}
+	assert.Equal(t, map[string][]string{
+		"_pinot._tcp.example.com": {"http://controller-a.example.com:9000", "http://controller-b.example.com:9000"},
+	}, clusterURLs(cache.refreshPinotClustersList()))
+}
+
+func TestDNSRefreshPinotClustersListA(t *testing.T) {
+	cache := NewDNSPinotControllerCache(ServiceDiscoveryConfigDNS{
+		Names:  []string{"pinot.example.com"},
+		Type:   "a",
+		Port:   9443,
+		Scheme: "https",
+	})
+	cache.resolver = &fakeResolver{
+		hosts: map[string][]string{
+			"pinot.example.com": {"10.0.0.2", "10.0.0.1"},
+		},
+	}
+	assert.Equal(t, map[string][]string{
+		"pinot.example.com": {"https://10.0.0.1:9443", "https://10.0.0.2:9443"},
+	}, clusterURLs(cache.refreshPinotClustersList()))
+}
+
+func TestDNSRefreshPinotClustersListKeepsClustersOnLookupError(t *testing.T) {
+	cache := NewDNSPinotControllerCache(ServiceDiscoveryConfigDNS{
+		Names: []string{"_pinot._tcp.example.com"},
+		Type:  "SRV",
+	})
+	resolver := &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_pinot._tcp.example.com": {{Target: "controller-a.example.com.", Port: 9000}},
+		},
+	}
+	cache.resolver = resolver
+	cache.refreshPinotClustersList()
+
+	delete(resolver.srv, "_pinot._tcp.example.com")
+	assert.Equal(t, map[string][]string{
+		"_pinot._tcp.example.com": {"http://controller-a.example.com:9000"},
+	}, clusterURLs(cache.refreshPinotClustersList()))
+}
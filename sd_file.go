@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+Discover Pinot controllers from a YAML or JSON file, in the spirit of Prometheus' file_sd.
+The file contains a list of target groups, for example:
+
+  - targets: ["http://pinot-controller-a:9000", "pinot-controller-b:9000"]
+    labels:
+    cluster: pinot-a
+
+Each target group is one Pinot cluster and its targets are the controllers of that
+cluster, tried in order. The `cluster` label names the cluster, other labels are added
+to all metrics of the cluster.
+*/
+type ServiceDiscoveryConfigFile struct {
+	Path string `json:"path" yaml:"path"`
+	// Scheme to use for targets that do not specify one. Defaults to http
+	Scheme string `json:"scheme" yaml:"scheme"`
+}
+
+type fileTargetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// A Pinot Controller cache, backed by a file that is re-read when it changes
+type FilePinotControllerCache struct {
+	knownControllers []*PinotController
+	lastModTime      time.Time
+	discoveryConfig  ServiceDiscoveryConfigFile
+}
+
+func NewFilePinotControllerCache(discoveryConfig ServiceDiscoveryConfigFile) *FilePinotControllerCache {
+	return &FilePinotControllerCache{
+		discoveryConfig: discoveryConfig,
+	}
+}
+
+// Make sure the file is there. It is (re)read on every refresh.
+func (f *FilePinotControllerCache) Connect() error {
+	_, err := os.Stat(f.discoveryConfig.Path)
+	return err
+}
+
+/*
+Return the clusters listed in the file.
+The file is only parsed again if its modification time changed. If it can't be read
+or parsed, the last known clusters are kept, so a half-written file does not
+make us drop all clusters.
+*/
+func (f *FilePinotControllerCache) refreshPinotClustersList() []*PinotController {
+	info, err := os.Stat(f.discoveryConfig.Path)
+	if err != nil {
+		logger.Errorf("Failed to stat discovery file %s: %s", f.discoveryConfig.Path, err)
+		return f.knownControllers
+	}
+	if info.ModTime().Equal(f.lastModTime) {
+		return f.knownControllers
+	}
+	groups, err := readTargetGroupsFile(f.discoveryConfig.Path, f.discoveryConfig.Scheme)
+	if err != nil {
+		logger.Errorf("Failed to read discovery file %s: %s", f.discoveryConfig.Path, err)
+		return f.knownControllers
+	}
+	logger.Infof("Discovery file %s changed, found target groups %+v", f.discoveryConfig.Path, groups)
+
+	var knownControllers []*PinotController
+	for _, group := range groups {
+		controller := NewPinotController(group.Labels["cluster"], group.Targets...)
+		for name, value := range group.Labels {
+			if name != "cluster" {
+				if controller.Labels == nil {
+					controller.Labels = make(map[string]string)
+				}
+				controller.Labels[sanitizeLabelName(name)] = value
+			}
+		}
+		knownControllers = append(knownControllers, controller)
+	}
+	f.lastModTime = info.ModTime()
+	f.knownControllers = knownControllers
+	return knownControllers
+}
+
+// Parse a target groups file. Targets are prefixed with the scheme if they don't have one.
+func readTargetGroupsFile(path string, scheme string) ([]fileTargetGroup, error) {
+	var groups []fileTargetGroup
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is valid YAML, so this handles both formats
+	err = yaml.Unmarshal(data, &groups)
+	if err != nil {
+		return nil, err
+	}
+	var targetGroups []fileTargetGroup
+	for _, group := range groups {
+		var targets []string
+		for _, target := range group.Targets {
+			targets = append(targets, endpointWithScheme(target, scheme))
+		}
+		if len(targets) == 0 {
+			continue
+		}
+		group.Targets = targets
+		targetGroups = append(targetGroups, group)
+	}
+	return targetGroups, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadTargetGroupsFile(t *testing.T) {
+	groups, err := readTargetGroupsFile("testdata/files/targets.sample.yaml", "")
+	assert.Nil(t, err)
+	assert.Len(t, groups, 2)
+	assert.Equal(t, []string{"http://pinot-controller-a:9000", "http://pinot-controller-b:9000"}, groups[0].Targets)
+	assert.Equal(t, "pinot-ab", groups[0].Labels["cluster"])
+	assert.Equal(t, []string{"http://pinot-controller-c:9000"}, groups[1].Targets)
+
+	groups, err = readTargetGroupsFile("testdata/files/targets.sample.json", "https")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"https://pinot-controller-c:9000"}, groups[0].Targets)
+}
+
+// Return the names and controller URLs of clusters, for easy comparison
+func clusterURLs(clusters []*PinotController) map[string][]string {
+	urls := make(map[string][]string)
+	for _, cluster := range clusters {
+		urls[cluster.String()] = cluster.AllURLs()
+	}
+	return urls
+}
+
+func TestFileRefreshPinotClustersList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.yaml")
+	err := os.WriteFile(path, []byte("- targets: [\"pinot-a:9000\"]\n  labels:\n    team: ingestion\n"), 0644)
+	assert.Nil(t, err)
+
+	cache := NewFilePinotControllerCache(ServiceDiscoveryConfigFile{Path: path})
+	assert.Nil(t, cache.Connect())
+	clusters := cache.refreshPinotClustersList()
+	assert.Equal(t, map[string][]string{"http://pinot-a:9000": {"http://pinot-a:9000"}}, clusterURLs(clusters))
+	// Labels other than cluster are added to the metrics of the cluster
+	assert.Equal(t, map[string]string{"team": "ingestion"}, clusters[0].Labels)
+
+	// A broken file keeps the last known endpoints
+	err = os.WriteFile(path, []byte("- targets: [\"pinot-a:9000\""), 0644)
+	assert.Nil(t, err)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	assert.Equal(t, map[string][]string{"http://pinot-a:9000": {"http://pinot-a:9000"}}, clusterURLs(cache.refreshPinotClustersList()))
+
+	// and a fixed file is picked up
+	err = os.WriteFile(path, []byte("- targets: [\"pinot-b:9000\"]\n"), 0644)
+	assert.Nil(t, err)
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	assert.Equal(t, map[string][]string{"http://pinot-b:9000": {"http://pinot-b:9000"}}, clusterURLs(cache.refreshPinotClustersList()))
+}
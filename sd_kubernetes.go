@@ -17,7 +17,7 @@ import (
 
 // A Pinot Controller cache from Kubernetes discovery mechanism
 type KubePinotControllerCache struct {
-	knownControllers   []PinotController
+	knownControllers   []*PinotController
 	kubernetesClient   *kubernetes.Clientset
 	KubeApiEndpoint    string `json:"kube_api_url" yaml:"kube_api_url"`
 	ServiceAccountName string `json:"serviceaccount" yaml:"serviceaccount"`
@@ -61,8 +61,6 @@ func getKubernetesConfig() (*rest.Config, error) {
 		}
 		return config, nil
 	}
-	return nil, nil
-
 }
 
 func createKubernetesClient(config *rest.Config) (*kubernetes.Clientset, error) {
@@ -113,9 +111,9 @@ func GetLabelSelectorString(labels map[string]string) string {
 	return selector
 
 }
-func (k *KubePinotControllerCache) refreshPinotClustersList() []string {
+func (k *KubePinotControllerCache) refreshPinotClustersList() []*PinotController {
 	var endpoints []string
-	var knownControllers []PinotController
+	var knownControllers []*PinotController
 	// List PinotCluster resources
 	//labelSelector := "app=pinot,nodeType=controller"
 	labelSelector := GetLabelSelectorString(k.discoveryConfig.Labels)
@@ -128,8 +126,9 @@ func (k *KubePinotControllerCache) refreshPinotClustersList() []string {
 	})
 
 	if err != nil {
+		// Keep the last known clusters, so an API server hiccup does not drop all clusters and their metrics
 		logger.Errorf("Error fetching Pinot services: %v\n", err)
-		return endpoints
+		return k.knownControllers
 	}
 
 	//logger.Infof("Fetched Pinot services: %v\n", services)
@@ -137,19 +136,36 @@ func (k *KubePinotControllerCache) refreshPinotClustersList() []string {
 		//logger.Debugf("Discovered service %+v\n", service)
 		// TODO http or https?
 		// TODO (2) first port is used. How to check which port if a service has multiple ports?
-		endpoints = append(endpoints, fmt.Sprintf("http://%s.%s.svc:%d", service.ObjectMeta.Name, service.ObjectMeta.Namespace, service.Spec.Ports[0].Port))
-	}
-
-	// update cache
-	// Build and update the known controllers
-	for _, endpoint := range endpoints {
-		knownControllers = append(knownControllers, PinotController{
-			URL: endpoint,
-		})
+		endpoint := fmt.Sprintf("http://%s.%s.svc:%d", service.ObjectMeta.Name, service.ObjectMeta.Namespace, service.Spec.Ports[0].Port)
+		endpoints = append(endpoints, endpoint)
+		// update cache
+		// Build and update the known controllers
+		controller := NewPinotController("", endpoint)
+		controller.Labels = serviceClusterLabels(service.ObjectMeta, k.discoveryConfig)
+		knownControllers = append(knownControllers, controller)
 	}
 	logger.Debugf("We have our endpoints: %+v\n", endpoints)
 	k.knownControllers = knownControllers
-	return endpoints
+	return knownControllers
+}
+
+// The labels and annotations of a Service to add to the metrics of its cluster, as configured
+func serviceClusterLabels(service metav1.ObjectMeta, discoveryConfig ServiceDiscoveryConfigK8S) map[string]string {
+	labels := make(map[string]string)
+	for _, name := range discoveryConfig.CopyLabels {
+		if value, ok := service.Labels[name]; ok {
+			labels[sanitizeLabelName(name)] = value
+		}
+	}
+	for _, name := range discoveryConfig.CopyAnnotations {
+		if value, ok := service.Annotations[name]; ok {
+			labels[sanitizeLabelName(name)] = value
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
 }
 
 func homeDir() string {
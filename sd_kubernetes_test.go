@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestGetLabelSelectorString(t *testing.T) {
@@ -15,3 +16,17 @@ func TestGetLabelSelectorString(t *testing.T) {
 	assert.Equal(t, "skata=pola,trolling=maximum", labelString)
 
 }
+
+func TestServiceClusterLabels(t *testing.T) {
+	service := metav1.ObjectMeta{
+		Name:        "pinot-controller",
+		Labels:      map[string]string{"app": "pinot", "team": "ingestion", "app.kubernetes.io/part-of": "analytics"},
+		Annotations: map[string]string{"example.com/env": "prod"},
+	}
+	labels := serviceClusterLabels(service, ServiceDiscoveryConfigK8S{
+		CopyLabels:      []string{"team", "app.kubernetes.io/part-of", "missing"},
+		CopyAnnotations: []string{"example.com/env"},
+	})
+	assert.Equal(t, map[string]string{"team": "ingestion", "app_kubernetes_io_part_of": "analytics", "example_com_env": "prod"}, labels)
+	assert.Nil(t, serviceClusterLabels(service, ServiceDiscoveryConfigK8S{}))
+}
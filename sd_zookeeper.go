@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+/*
+Discover Pinot controllers from the ZooKeeper ensemble that backs the Helix clusters.
+Every Helix cluster under the (optional) chroot is a Pinot cluster, and its live
+instances named Controller_<host>_<port> are its controllers.
+*/
+type ServiceDiscoveryConfigZK struct {
+	// ZooKeeper connect string, with an optional chroot. e.g. zk1:2181,zk2:2181/pinot
+	ConnectString string `json:"connectString" yaml:"connectString"`
+	// Only monitor these Helix clusters. Empty means all clusters found.
+	Clusters []string `json:"clusters" yaml:"clusters"`
+	// Scheme of the discovered endpoints. Defaults to http
+	Scheme                string `json:"scheme" yaml:"scheme"`
+	SessionTimeoutSeconds int    `json:"sessionTimeoutSeconds" yaml:"sessionTimeoutSeconds"`
+}
+
+// The subset of zk.Conn we need, so tests can replace it with an in-memory tree
+type zkConn interface {
+	Children(path string) ([]string, *zk.Stat, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+	Close()
+}
+
+// A Pinot Controller cache from ZooKeeper/Helix discovery
+type ZKPinotControllerCache struct {
+	knownControllers []*PinotController
+	conn             zkConn
+	servers          []string
+	chroot           string
+	discoveryConfig  ServiceDiscoveryConfigZK
+	// signalled when the live instances of a watched cluster change
+	changes chan struct{}
+	// protects watched, which is updated from the watch goroutines
+	watchMutex sync.Mutex
+	// LIVEINSTANCES nodes with a registered watch
+	watched map[string]bool
+}
+
+func NewZKPinotControllerCache(discoveryConfig ServiceDiscoveryConfigZK) *ZKPinotControllerCache {
+	servers, chroot := parseZKConnectString(discoveryConfig.ConnectString)
+	return &ZKPinotControllerCache{
+		servers:         servers,
+		chroot:          chroot,
+		discoveryConfig: discoveryConfig,
+		changes:         make(chan struct{}, 1),
+		watched:         make(map[string]bool),
+	}
+}
+
+// Split a ZooKeeper connect string in a list of servers and a chroot path
+func parseZKConnectString(connectString string) ([]string, string) {
+	chroot := "/"
+	hosts := connectString
+	if idx := strings.Index(connectString, "/"); idx >= 0 {
+		hosts = connectString[:idx]
+		chroot = path.Clean(connectString[idx:])
+	}
+	var servers []string
+	for _, server := range strings.Split(hosts, ",") {
+		server = strings.TrimSpace(server)
+		if server != "" {
+			servers = append(servers, server)
+		}
+	}
+	return servers, chroot
+}
+
+// zk logs through a Printf style interface
+type zkLogger struct{}
+
+func (zkLogger) Printf(format string, args ...interface{}) {
+	logger.Debugf(format, args...)
+}
+
+// Connect to the ZooKeeper ensemble. The session is kept open and re-established by the zk client.
+func (z *ZKPinotControllerCache) Connect() error {
+	sessionTimeout := time.Duration(z.discoveryConfig.SessionTimeoutSeconds) * time.Second
+	if sessionTimeout == 0 {
+		sessionTimeout = 10 * time.Second
+	}
+	conn, _, err := zk.Connect(z.servers, sessionTimeout, zk.WithLogger(zkLogger{}))
+	if err != nil {
+		logger.Errorf("Failed to connect to ZooKeeper %s: %s", z.discoveryConfig.ConnectString, err)
+		return err
+	}
+	z.conn = conn
+	return nil
+}
+
+// Close the ZooKeeper session, e.g. when the discovery is replaced after a config reload
+func (z *ZKPinotControllerCache) Close() {
+	if z.conn != nil {
+		z.conn.Close()
+	}
+}
+
+// Signalled when the live controllers of a cluster may have changed, so they are refreshed before the next poll
+func (z *ZKPinotControllerCache) Changes() <-chan struct{} {
+	return z.changes
+}
+
+/*
+Return the Helix clusters with their live controllers.
+If ZooKeeper can't be read, the last known clusters are kept. A cluster that has no
+live controllers for a while, e.g. while its only controller restarts, keeps its last
+known controllers, so we don't drop it and its metrics.
+*/
+func (z *ZKPinotControllerCache) refreshPinotClustersList() []*PinotController {
+	var knownControllers []*PinotController
+
+	clusters, err := z.helixClusters()
+	if err != nil {
+		logger.Errorf("Error listing Helix clusters in ZooKeeper: %s", err)
+		return z.knownControllers
+	}
+	previous := make(map[string]*PinotController)
+	for _, controller := range z.knownControllers {
+		previous[controller.String()] = controller
+	}
+	for _, cluster := range clusters {
+		endpoints, err := z.controllersForCluster(cluster)
+		if err != nil {
+			logger.Errorf("Error finding live controllers for Helix cluster %s: %s", cluster, err)
+			if controller, ok := previous[cluster]; ok {
+				knownControllers = append(knownControllers, controller)
+			}
+			continue
+		}
+		logger.Debugf("Helix cluster %s has controllers: %+v\n", cluster, endpoints)
+		knownControllers = append(knownControllers, NewPinotController(cluster, endpoints...))
+	}
+	z.knownControllers = knownControllers
+	return knownControllers
+}
+
+// List the Helix clusters under the chroot, filtered by the configured cluster names
+func (z *ZKPinotControllerCache) helixClusters() ([]string, error) {
+	children, _, err := z.conn.Children(z.chroot)
+	if err != nil {
+		return nil, err
+	}
+	var clusters []string
+	for _, child := range children {
+		if len(z.discoveryConfig.Clusters) > 0 && !slices.Contains(z.discoveryConfig.Clusters, child) {
+			continue
+		}
+		// A Helix cluster always has a LIVEINSTANCES node. Skip anything else (e.g. the zookeeper node)
+		_, _, err := z.conn.Children(path.Join(z.chroot, child, "LIVEINSTANCES"))
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, child)
+	}
+	slices.Sort(clusters)
+	return clusters, nil
+}
+
+/*
+Return the endpoints of the live controllers of the given cluster.
+The Helix leader goes first, followed by the rest in name order.
+*/
+func (z *ZKPinotControllerCache) controllersForCluster(cluster string) ([]string, error) {
+	liveInstances, err := z.liveInstances(cluster)
+	if err != nil {
+		return nil, err
+	}
+	var controllers []string
+	for _, instance := range liveInstances {
+		if strings.HasPrefix(instance, "Controller_") {
+			controllers = append(controllers, instance)
+		}
+	}
+	if len(controllers) == 0 {
+		return nil, fmt.Errorf("no live controllers")
+	}
+	slices.Sort(controllers)
+
+	leader, err := z.helixLeader(cluster)
+	if idx := slices.Index(controllers, leader); err == nil && idx > 0 {
+		controllers = append([]string{leader}, slices.Delete(controllers, idx, idx+1)...)
+	}
+	var endpoints []string
+	for _, instance := range controllers {
+		hostPort, err := controllerInstanceHostPort(instance)
+		if err != nil {
+			logger.Warnf("Skipping controller of Helix cluster %s: %s", cluster, err)
+			continue
+		}
+		endpoints = append(endpoints, endpointWithScheme(hostPort, z.discoveryConfig.Scheme))
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no usable live controllers")
+	}
+	return endpoints, nil
+}
+
+/*
+List the live instances of a cluster and watch them for changes, unless they are watched already.
+A watch fires only once, and all watches are lost when the session expires. Either way the
+change is signalled and the watch is registered again by the next refresh.
+*/
+func (z *ZKPinotControllerCache) liveInstances(cluster string) ([]string, error) {
+	nodePath := path.Join(z.chroot, cluster, "LIVEINSTANCES")
+	z.watchMutex.Lock()
+	watched := z.watched[nodePath]
+	z.watchMutex.Unlock()
+	if watched {
+		children, _, err := z.conn.Children(nodePath)
+		return children, err
+	}
+	children, _, events, err := z.conn.ChildrenW(nodePath)
+	if err != nil {
+		return nil, err
+	}
+	z.watchMutex.Lock()
+	z.watched[nodePath] = true
+	z.watchMutex.Unlock()
+	go func() {
+		event := <-events
+		logger.Debugf("ZooKeeper watch on %s fired with %s", nodePath, event.Type)
+		z.watchMutex.Lock()
+		delete(z.watched, nodePath)
+		z.watchMutex.Unlock()
+		select {
+		case z.changes <- struct{}{}:
+		default:
+		}
+	}()
+	return children, nil
+}
+
+// Read the instance name of the Helix controller leader of a cluster
+func (z *ZKPinotControllerCache) helixLeader(cluster string) (string, error) {
+	type ZNRecord struct {
+		Id string `json:"id"`
+	}
+	var record ZNRecord
+	data, _, err := z.conn.Get(path.Join(z.chroot, cluster, "CONTROLLER", "LEADER"))
+	if err != nil {
+		return "", err
+	}
+	err = json.Unmarshal(data, &record)
+	return record.Id, err
+}
+
+// Turn a Helix instance name like Controller_pinot-controller-0.pinot_9000 into host:port
+func controllerInstanceHostPort(instance string) (string, error) {
+	name := strings.TrimPrefix(instance, "Controller_")
+	idx := strings.LastIndex(name, "_")
+	if idx <= 0 || idx == len(name)-1 {
+		return "", fmt.Errorf("can't parse host and port from instance name %s", instance)
+	}
+	return fmt.Sprintf("%s:%s", name[:idx], name[idx+1:]), nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+)
+
+// An in-memory ZooKeeper tree. Keys are full paths, values are the node data.
+type fakeZKConn struct {
+	nodes map[string][]byte
+}
+
+func newFakeZKConn(paths map[string]string) *fakeZKConn {
+	conn := &fakeZKConn{nodes: map[string][]byte{"/": nil}}
+	for nodePath, data := range paths {
+		// create parents as well
+		for p := nodePath; p != "/"; p = path.Dir(p) {
+			if _, exists := conn.nodes[p]; !exists {
+				conn.nodes[p] = nil
+			}
+		}
+		conn.nodes[nodePath] = []byte(data)
+	}
+	return conn
+}
+
+func (f *fakeZKConn) Children(nodePath string) ([]string, *zk.Stat, error) {
+	if _, exists := f.nodes[nodePath]; !exists {
+		return nil, nil, zk.ErrNoNode
+	}
+	var children []string
+	for p := range f.nodes {
+		if p != "/" && path.Dir(p) == nodePath {
+			children = append(children, path.Base(p))
+		}
+	}
+	slices.Sort(children)
+	return children, &zk.Stat{}, nil
+}
+
+func (f *fakeZKConn) Get(nodePath string) ([]byte, *zk.Stat, error) {
+	data, exists := f.nodes[nodePath]
+	if !exists {
+		return nil, nil, zk.ErrNoNode
+	}
+	return data, &zk.Stat{}, nil
+}
+
+// Watches never fire, as the tree only changes between refreshes
+func (f *fakeZKConn) ChildrenW(nodePath string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	children, stat, err := f.Children(nodePath)
+	return children, stat, make(chan zk.Event), err
+}
+
+func (f *fakeZKConn) Close() {}
+
+func TestParseZKConnectString(t *testing.T) {
+	servers, chroot := parseZKConnectString("zk1:2181, zk2:2181/pinot/")
+	assert.Equal(t, []string{"zk1:2181", "zk2:2181"}, servers)
+	assert.Equal(t, "/pinot", chroot)
+
+	servers, chroot = parseZKConnectString("zk1:2181")
+	assert.Equal(t, []string{"zk1:2181"}, servers)
+	assert.Equal(t, "/", chroot)
+}
+
+func TestControllerInstanceHostPort(t *testing.T) {
+	hostPort, err := controllerInstanceHostPort("Controller_pinot_controller-0.pinot.svc_9000")
+	assert.Nil(t, err)
+	assert.Equal(t, "pinot_controller-0.pinot.svc:9000", hostPort)
+
+	_, err = controllerInstanceHostPort("Controller_nohostport")
+	assert.NotNil(t, err)
+}
+
+func TestZKRefreshPinotClustersList(t *testing.T) {
+	cache := NewZKPinotControllerCache(ServiceDiscoveryConfigZK{ConnectString: "zk:2181/pinot"})
+	cache.conn = newFakeZKConn(map[string]string{
+		"/pinot/ClusterA/LIVEINSTANCES/Controller_ctrl-a0_9000": "",
+		"/pinot/ClusterA/LIVEINSTANCES/Controller_ctrl-a1_9000": "",
+		"/pinot/ClusterA/LIVEINSTANCES/Server_server-a0_8098":   "",
+		"/pinot/ClusterA/CONTROLLER/LEADER":                     `{"id":"Controller_ctrl-a1_9000"}`,
+		// Leader is gone, so the live controllers are in name order
+		"/pinot/ClusterB/LIVEINSTANCES/Controller_ctrl-b0_9000": "",
+		"/pinot/ClusterB/CONTROLLER/LEADER":                     `{"id":"Controller_ctrl-b9_9000"}`,
+		// No live controllers
+		"/pinot/ClusterC/LIVEINSTANCES/Server_server-c0_8098": "",
+		// Not a Helix cluster
+		"/pinot/zookeeper/quota": "",
+	})
+	assert.Equal(t, map[string][]string{
+		// the leader goes first
+		"ClusterA": {"http://ctrl-a1:9000", "http://ctrl-a0:9000"},
+		"ClusterB": {"http://ctrl-b0:9000"},
+	}, clusterURLs(cache.refreshPinotClustersList()))
+
+	// Restrict to some clusters
+	cache.discoveryConfig.Clusters = []string{"ClusterB"}
+	assert.Equal(t, map[string][]string{"ClusterB": {"http://ctrl-b0:9000"}}, clusterURLs(cache.refreshPinotClustersList()))
+}
+
+func TestZKRefreshPinotClustersListKeepsClusters(t *testing.T) {
+	cache := NewZKPinotControllerCache(ServiceDiscoveryConfigZK{ConnectString: "zk:2181/pinot"})
+	conn := newFakeZKConn(map[string]string{
+		"/pinot/ClusterA/LIVEINSTANCES/Controller_ctrl-a0_9000": "",
+	})
+	cache.conn = conn
+	expected := map[string][]string{"ClusterA": {"http://ctrl-a0:9000"}}
+	assert.Equal(t, expected, clusterURLs(cache.refreshPinotClustersList()))
+
+	// The only controller restarts
+	delete(conn.nodes, "/pinot/ClusterA/LIVEINSTANCES/Controller_ctrl-a0_9000")
+	assert.Equal(t, expected, clusterURLs(cache.refreshPinotClustersList()))
+
+	// ZooKeeper can't be read
+	delete(conn.nodes, "/pinot")
+	assert.Equal(t, expected, clusterURLs(cache.refreshPinotClustersList()))
+}
+
+func TestZKWatchRegisteredAgainAfterSessionExpiry(t *testing.T) {
+	server := newFakeZKServer(t, map[string]string{
+		"/pinot/ClusterA/LIVEINSTANCES/Controller_ctrl-a0_9000": "",
+	})
+	cache := NewZKPinotControllerCache(ServiceDiscoveryConfigZK{ConnectString: server.Addr() + "/pinot"})
+	assert.Nil(t, cache.Connect())
+	defer cache.Close()
+	liveInstances := "/pinot/ClusterA/LIVEINSTANCES"
+
+	assert.Equal(t, map[string][]string{"ClusterA": {"http://ctrl-a0:9000"}}, clusterURLs(cache.refreshPinotClustersList()))
+	assert.Equal(t, []int64{1}, server.ChildWatches(liveInstances))
+
+	// The session expires, which drops the watch and is signalled as a change
+	server.ExpireSessions()
+	select {
+	case <-cache.Changes():
+	case <-time.After(10 * time.Second):
+		t.Fatal("session expiry was not signalled")
+	}
+	// The next refresh watches again, with the new session
+	assert.Eventually(t, func() bool {
+		cache.refreshPinotClustersList()
+		return slices.Equal([]int64{2}, server.ChildWatches(liveInstances))
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// and the new watch fires when a controller joins
+	server.Create(liveInstances+"/Controller_ctrl-a1_9000", "")
+	select {
+	case <-cache.Changes():
+	case <-time.After(10 * time.Second):
+		t.Fatal("new controller was not signalled")
+	}
+	assert.Equal(t, map[string][]string{"ClusterA": {"http://ctrl-a0:9000", "http://ctrl-a1:9000"}}, clusterURLs(cache.refreshPinotClustersList()))
+	assert.Equal(t, []int64{2}, server.ChildWatches(liveInstances))
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Labels summed away first when a limit is exceeded, unless aggregate_labels is set
+var defaultAggregateLabels = []string{"column", "server", "broker"}
+
+var fqNameRegexp = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+/*
+Limits on the number of exported series of each cluster, under series_limits: in the config file.
+Series are counted before relabeling, for each collector of a cluster and for the whole cluster.
+The exporter's own series, like pinotexporter_controller_up, belong to no collector and are never limited.
+Over a limit, the aggregate labels are summed away, the one with the most values first, and if
+that is not enough the series over the limit are dropped.
+*/
+type SeriesLimitsConfig struct {
+	// 0, the default, means no limit
+	MaxSeriesPerCluster   int `json:"max_series_per_cluster" yaml:"max_series_per_cluster"`
+	MaxSeriesPerCollector int `json:"max_series_per_collector" yaml:"max_series_per_collector"`
+	// Limits of some clusters and collectors, by name, instead of the ones above
+	Clusters   map[string]int `json:"clusters" yaml:"clusters"`
+	Collectors map[string]int `json:"collectors" yaml:"collectors"`
+	// Defaults to column, server and broker
+	AggregateLabels []string `json:"aggregate_labels" yaml:"aggregate_labels"`
+}
+
+func (c SeriesLimitsConfig) IsValid() error {
+	if c.MaxSeriesPerCluster < 0 || c.MaxSeriesPerCollector < 0 {
+		return fmt.Errorf("series_limits can't be negative")
+	}
+	for name, limit := range c.Clusters {
+		if limit < 0 {
+			return fmt.Errorf("series_limits.clusters.%s can't be negative", name)
+		}
+	}
+	names := collectorNames()
+	for name, limit := range c.Collectors {
+		if !slices.Contains(names, name) {
+			return fmt.Errorf("unknown collector %s in series_limits - should be one of %v", name, names)
+		}
+		if limit < 0 {
+			return fmt.Errorf("series_limits.collectors.%s can't be negative", name)
+		}
+	}
+	return nil
+}
+
+func (c SeriesLimitsConfig) enabled() bool {
+	return c.MaxSeriesPerCluster > 0 || c.MaxSeriesPerCollector > 0 || len(c.Clusters) > 0 || len(c.Collectors) > 0
+}
+
+func (c SeriesLimitsConfig) clusterLimit(cluster string) int {
+	if limit, ok := c.Clusters[cluster]; ok {
+		return limit
+	}
+	return c.MaxSeriesPerCluster
+}
+
+func (c SeriesLimitsConfig) collectorLimit(collector string) int {
+	if limit, ok := c.Collectors[collector]; ok {
+		return limit
+	}
+	return c.MaxSeriesPerCollector
+}
+
+func (c SeriesLimitsConfig) aggregateLabels() []string {
+	if len(c.AggregateLabels) == 0 {
+		return defaultAggregateLabels
+	}
+	return c.AggregateLabels
+}
+
+// The collector of each metric name. Desc has no accessor for the name, so it is read from its description
+func collectorMetricNames() map[string]string {
+	names := make(map[string]string)
+	add := func(collector string, metrics []*prometheus.GaugeVec) {
+		for _, metric := range metrics {
+			descs := make(chan *prometheus.Desc, 1)
+			metric.Describe(descs)
+			if match := fqNameRegexp.FindStringSubmatch((<-descs).String()); match != nil {
+				names[match[1]] = collector
+			}
+		}
+	}
+	for _, collector := range tableCollectors {
+		add(collector.Name, collector.Metrics)
+	}
+	for _, collector := range clusterCollectors {
+		add(collector.Name, collector.Metrics)
+	}
+	return names
+}
+
+// A series of a cluster, along with its family
+type clusterSeries struct {
+	family *dto.MetricFamily
+	metric *dto.Metric
+}
+
+/*
+Applies the series limits when the metrics are gathered, counting the series it drops in
+pinotexporter_series_dropped_total. Updated in place when the config is reloaded.
+*/
+type SeriesLimiter struct {
+	mutex  sync.Mutex
+	config SeriesLimitsConfig
+	// collector of each metric name
+	collectors map[string]string
+	// gathers pinotexporter_series_dropped_total again once the series are limited
+	dropped prometheus.Gatherer
+}
+
+// Create a limiter from a valid config
+func NewSeriesLimiter(config SeriesLimitsConfig) *SeriesLimiter {
+	dropped := prometheus.NewRegistry()
+	dropped.MustRegister(SeriesDropped)
+	return &SeriesLimiter{config: config, collectors: collectorMetricNames(), dropped: dropped}
+}
+
+// Apply a new valid config
+func (l *SeriesLimiter) Update(config SeriesLimitsConfig) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.config = config
+}
+
+// Limit the series that gatherer returns
+func (l *SeriesLimiter) Gatherer(gatherer prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := gatherer.Gather()
+		return l.limit(families), err
+	})
+}
+
+func (l *SeriesLimiter) collectorOf(name string) string {
+	return l.collectors[name]
+}
+
+func (l *SeriesLimiter) limit(families []*dto.MetricFamily) []*dto.MetricFamily {
+	l.mutex.Lock()
+	config := l.config
+	l.mutex.Unlock()
+	if !config.enabled() {
+		return families
+	}
+
+	// Take the series of clusters out of their families, by cluster and collector
+	byCluster := make(map[string]map[string][]clusterSeries)
+	for _, family := range families {
+		collector, ok := l.collectors[family.GetName()]
+		if !ok {
+			continue
+		}
+		var others []*dto.Metric
+		for _, metric := range family.Metric {
+			cluster, ok := labelValue(metric, "cluster")
+			if !ok {
+				others = append(others, metric)
+				continue
+			}
+			if byCluster[cluster] == nil {
+				byCluster[cluster] = make(map[string][]clusterSeries)
+			}
+			byCluster[cluster][collector] = append(byCluster[cluster][collector], clusterSeries{family: family, metric: metric})
+		}
+		family.Metric = others
+	}
+
+	// and put back what fits in the limits
+	for _, cluster := range sortedKeys(byCluster) {
+		byCollector := byCluster[cluster]
+		var all []clusterSeries
+		for _, collector := range sortedKeys(byCollector) {
+			series := byCollector[collector]
+			if limit := config.collectorLimit(collector); limit > 0 && len(series) > limit {
+				series = l.reduce(cluster, series, limit, config.aggregateLabels())
+			}
+			all = append(all, series...)
+		}
+		if limit := config.clusterLimit(cluster); limit > 0 && len(all) > limit {
+			all = l.reduce(cluster, all, limit, config.aggregateLabels())
+		}
+		kept := l.countByCollector(all)
+		for collector, series := range byCollector {
+			SeriesDropped.WithLabelValues(cluster, collector).Add(float64(len(series) - kept[collector]))
+		}
+		for _, series := range all {
+			series.family.Metric = append(series.family.Metric, series.metric)
+		}
+	}
+
+	var limited []*dto.MetricFamily
+	for _, family := range families {
+		if len(family.Metric) > 0 {
+			sortMetrics(family.Metric)
+			limited = append(limited, family)
+		}
+	}
+	return l.withDropped(limited)
+}
+
+// The families with pinotexporter_series_dropped_total as of now, as it was gathered before this scrape's drops were counted
+func (l *SeriesLimiter) withDropped(families []*dto.MetricFamily) []*dto.MetricFamily {
+	dropped, err := l.dropped.Gather()
+	if err != nil || len(dropped) == 0 {
+		return families
+	}
+	families = slices.DeleteFunc(families, func(family *dto.MetricFamily) bool {
+		return family.GetName() == dropped[0].GetName()
+	})
+	families = append(families, dropped[0])
+	slices.SortFunc(families, func(a, b *dto.MetricFamily) int {
+		return strings.Compare(a.GetName(), b.GetName())
+	})
+	return families
+}
+
+/*
+Bring series down to limit, summing away the aggregate label with the most values until they fit
+and dropping the series over the limit if there are no more labels to aggregate, those of the
+collectors with the most series first.
+*/
+func (l *SeriesLimiter) reduce(cluster string, series []clusterSeries, limit int, aggregateLabels []string) []clusterSeries {
+	for len(series) > limit {
+		label := highestCardinalityLabel(series, aggregateLabels)
+		if label == "" {
+			break
+		}
+		logger.Debugf("Aggregating away label %s of %d series of %s, over the limit of %d", label, len(series), cluster, limit)
+		series = aggregateSeries(series, label)
+	}
+	if len(series) > limit {
+		logger.Debugf("Dropping %d series of %s over the limit of %d", len(series)-limit, cluster, limit)
+		// From the collectors with the most series
+		counts := l.countByCollector(series)
+		slices.SortStableFunc(series, func(a, b clusterSeries) int {
+			return counts[l.collectorOf(a.family.GetName())] - counts[l.collectorOf(b.family.GetName())]
+		})
+		series = series[:limit]
+	}
+	return series
+}
+
+func (l *SeriesLimiter) countByCollector(series []clusterSeries) map[string]int {
+	counts := make(map[string]int)
+	for _, s := range series {
+		counts[l.collectorOf(s.family.GetName())]++
+	}
+	return counts
+}
+
+// The label with more than one value and the most values among labels, or "" if there is none
+func highestCardinalityLabel(series []clusterSeries, labels []string) string {
+	highest, highestValues := "", 1
+	for _, label := range labels {
+		values := make(map[string]struct{})
+		for _, s := range series {
+			if value, ok := labelValue(s.metric, label); ok {
+				values[value] = struct{}{}
+			}
+		}
+		if len(values) > highestValues {
+			highest, highestValues = label, len(values)
+		}
+	}
+	return highest
+}
+
+/*
+Merge the series that only differ by label into one without it.
+Gauges and counters are summed. Of other series, like histograms, the first one is kept.
+*/
+func aggregateSeries(series []clusterSeries, label string) []clusterSeries {
+	var aggregated []clusterSeries
+	// index in aggregated of the series each key was merged into
+	merged := make(map[string]int)
+	for _, s := range series {
+		if _, ok := labelValue(s.metric, label); !ok {
+			aggregated = append(aggregated, s)
+			continue
+		}
+		pairs := slices.DeleteFunc(slices.Clone(s.metric.Label), func(pair *dto.LabelPair) bool { return pair.GetName() == label })
+		key := seriesKey(s.family.GetName(), pairs)
+		if i, ok := merged[key]; ok {
+			into := aggregated[i].metric
+			switch {
+			case into.Gauge != nil:
+				*into.Gauge.Value += s.metric.GetGauge().GetValue()
+			case into.Counter != nil:
+				*into.Counter.Value += s.metric.GetCounter().GetValue()
+			case into.Untyped != nil:
+				*into.Untyped.Value += s.metric.GetUntyped().GetValue()
+			}
+			continue
+		}
+		metric := &dto.Metric{Label: pairs}
+		switch {
+		case s.metric.Gauge != nil:
+			value := s.metric.GetGauge().GetValue()
+			metric.Gauge = &dto.Gauge{Value: &value}
+		case s.metric.Counter != nil:
+			value := s.metric.GetCounter().GetValue()
+			metric.Counter = &dto.Counter{Value: &value}
+		case s.metric.Untyped != nil:
+			value := s.metric.GetUntyped().GetValue()
+			metric.Untyped = &dto.Untyped{Value: &value}
+		default:
+			metric.Histogram = s.metric.Histogram
+			metric.Summary = s.metric.Summary
+		}
+		merged[key] = len(aggregated)
+		aggregated = append(aggregated, clusterSeries{family: s.family, metric: metric})
+	}
+	return aggregated
+}
+
+// The value of a label of a series, and whether it has it
+func labelValue(metric *dto.Metric, name string) (string, bool) {
+	for _, pair := range metric.Label {
+		if pair.GetName() == name {
+			return pair.GetValue(), true
+		}
+	}
+	return "", false
+}
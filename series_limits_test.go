@@ -0,0 +1,126 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeriesLimitsConfig(t *testing.T) {
+	config, err := NewConfigFromBytes([]byte(`
+series_limits:
+  max_series_per_cluster: 1000
+  collectors:
+    server_admin: 100
+`))
+	assert.Nil(t, err)
+	assert.Nil(t, config.SeriesLimits.IsValid())
+	assert.Equal(t, 1000, config.SeriesLimits.clusterLimit("any"))
+	assert.Equal(t, 100, config.SeriesLimits.collectorLimit("server_admin"))
+	assert.Equal(t, 0, config.SeriesLimits.collectorLimit("size"))
+	assert.Equal(t, defaultAggregateLabels, config.SeriesLimits.aggregateLabels())
+
+	assert.NotNil(t, SeriesLimitsConfig{MaxSeriesPerCluster: -1}.IsValid())
+	assert.NotNil(t, SeriesLimitsConfig{Clusters: map[string]int{"big": -1}}.IsValid())
+	assert.NotNil(t, SeriesLimitsConfig{Collectors: map[string]int{"segments": 10}}.IsValid())
+}
+
+func TestDefaultAggregateLabelsAreExported(t *testing.T) {
+	var descs []string
+	for _, collector := range append(slices.Clone(tableCollectors), TableCollector{Metrics: serverAdminMetrics()}) {
+		for _, metric := range collector.Metrics {
+			described := make(chan *prometheus.Desc, 1)
+			metric.Describe(described)
+			descs = append(descs, (<-described).String())
+		}
+	}
+	for _, label := range defaultAggregateLabels {
+		assert.True(t, slices.ContainsFunc(descs, func(desc string) bool {
+			return strings.Contains(desc, ","+label+",") || strings.Contains(desc, ","+label+"}")
+		}), "no collector exports a %s label", label)
+	}
+}
+
+func TestCollectorMetricNames(t *testing.T) {
+	names := collectorMetricNames()
+	assert.Equal(t, "brokers", names["pinotexporter_table_routed_segments"])
+	assert.Equal(t, "server_admin", names["pinotexporter_table_column_bytes"])
+	assert.Equal(t, "instances", names["pinotexporter_instances"])
+}
+
+func TestSeriesLimiter(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	docs := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_segment_docs", Help: "Documents of a segment"}, []string{"cluster", "table", "segment"})
+	up := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_up", Help: "Whether the controller is up"}, []string{"cluster"})
+	version := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_version", Help: "Version of the exporter"})
+	registry.MustRegister(docs, up, version, SeriesDropped)
+	for _, segment := range []string{"s0", "s1", "s2"} {
+		docs.WithLabelValues("limited", "airlineStats", segment).Set(10)
+		docs.WithLabelValues("limited", "githubEvents", segment).Set(1)
+	}
+	docs.WithLabelValues("unlimited", "airlineStats", "s0").Set(5)
+	up.WithLabelValues("limited").Set(1)
+	version.Set(1)
+
+	limiter := NewSeriesLimiter(SeriesLimitsConfig{})
+	limiter.collectors = map[string]string{"test_segment_docs": "replication"}
+	gatherer := limiter.Gatherer(registry)
+	count, err := testutil.GatherAndCount(gatherer)
+	assert.Nil(t, err)
+	assert.Equal(t, 9, count)
+
+	// The segments of each table are summed to fit
+	limiter.Update(SeriesLimitsConfig{Collectors: map[string]int{"replication": 2}, AggregateLabels: []string{"segment"}})
+	// and the series dropped are counted in the same scrape
+	expected := `
+# HELP pinotexporter_series_dropped_total Series of a collector dropped or aggregated away to keep a cluster within its series limits, counted at every scrape
+# TYPE pinotexporter_series_dropped_total counter
+pinotexporter_series_dropped_total{cluster="limited",collector="replication"} 4
+pinotexporter_series_dropped_total{cluster="unlimited",collector="replication"} 0
+# HELP test_segment_docs Documents of a segment
+# TYPE test_segment_docs gauge
+test_segment_docs{cluster="limited",table="airlineStats"} 30
+test_segment_docs{cluster="limited",table="githubEvents"} 3
+test_segment_docs{cluster="unlimited",segment="s0",table="airlineStats"} 5
+# HELP test_up Whether the controller is up
+# TYPE test_up gauge
+test_up{cluster="limited"} 1
+# HELP test_version Version of the exporter
+# TYPE test_version gauge
+test_version 1
+`
+	assert.Nil(t, testutil.GatherAndCompare(gatherer, strings.NewReader(expected)))
+
+	// Every scrape adds what it dropped
+	assert.Nil(t, testutil.GatherAndCompare(gatherer, strings.NewReader(strings.Replace(expected, `collector="replication"} 4`, `collector="replication"} 8`, 1))))
+
+	// With nothing left to aggregate, the series over the limit of the cluster are dropped,
+	// from the collector with the most series. Series of no collector are not limited
+	limiter.Update(SeriesLimitsConfig{MaxSeriesPerCluster: 1, Collectors: map[string]int{"replication": 2}, AggregateLabels: []string{"segment"}})
+	expected = `
+# HELP pinotexporter_series_dropped_total Series of a collector dropped or aggregated away to keep a cluster within its series limits, counted at every scrape
+# TYPE pinotexporter_series_dropped_total counter
+pinotexporter_series_dropped_total{cluster="limited",collector="replication"} 13
+pinotexporter_series_dropped_total{cluster="unlimited",collector="replication"} 0
+# HELP test_segment_docs Documents of a segment
+# TYPE test_segment_docs gauge
+test_segment_docs{cluster="limited",table="airlineStats"} 30
+test_segment_docs{cluster="unlimited",segment="s0",table="airlineStats"} 5
+# HELP test_up Whether the controller is up
+# TYPE test_up gauge
+test_up{cluster="limited"} 1
+# HELP test_version Version of the exporter
+# TYPE test_version gauge
+test_version 1
+`
+	assert.Nil(t, testutil.GatherAndCompare(gatherer, strings.NewReader(expected)))
+	assert.False(t, SeriesDropped.DeleteLabelValues("limited", ""))
+
+	deleteClusterMetrics("limited")
+	deleteClusterMetrics("unlimited")
+	assert.False(t, SeriesDropped.DeleteLabelValues("limited", "replication"))
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A server, reached on its admin port
+type ServerInfo struct {
+	InstanceName string
+	Host         string
+	AdminPort    int
+}
+
+/*
+What a server holds of a table, from GET /tables/{tableNameWithType}/metadata on its admin port.
+The server sums the metadata of its segments of the table, so there is one request per table
+rather than per segment, and no per segment series.
+*/
+type ServerTableMetadata struct {
+	TableName       string `json:"tableName"`
+	DiskSizeInBytes int64  `json:"diskSizeInBytes"`
+	NumSegments     int    `json:"numSegments"`
+	NumRows         int64  `json:"numRows"`
+	// Bytes of each index of each column: column -> index (e.g. forward_index, inverted_index) -> bytes
+	ColumnIndexSizeMap map[string]map[string]float64 `json:"columnIndexSizeMap"`
+}
+
+// A consuming segment of a realtime table on a server
+type ServerConsumerInfo struct {
+	SegmentName           string `json:"segmentName"`
+	ConsumerState         string `json:"consumerState"`
+	LastConsumedTimestamp int64  `json:"lastConsumedTimestamp"`
+	PartitionOffsetInfo   *struct {
+		RecordsLagMap map[string]string `json:"recordsLagMap"`
+	} `json:"partitionOffsetInfo"`
+}
+
+/*
+List the enabled servers of the cluster that have an admin port, from the instances on the controller.
+*/
+func (c *PinotController) ListServers(ctx context.Context) ([]ServerInfo, error) {
+	instances, err := c.ListInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var servers []ServerInfo
+	for _, name := range instances {
+		if !strings.HasPrefix(name, "Server_") {
+			continue
+		}
+		instance, err := c.GetInstance(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if !instance.Enabled || instance.AdminPort <= 0 {
+			logger.Debugf("Skipping server %s of %s, which is disabled or has no admin port", name, c)
+			continue
+		}
+		servers = append(servers, ServerInfo{InstanceName: name, Host: instance.HostName, AdminPort: instance.AdminPort})
+	}
+	return servers, nil
+}
+
+func (c *PinotController) serverURL(server ServerInfo) string {
+	return c.instanceURL(server.Host, server.AdminPort)
+}
+
+// List the tables with a type suffix (e.g. airlineStats_OFFLINE) a server holds segments of
+func (c *PinotController) ListServerTables(ctx context.Context, server ServerInfo) ([]string, error) {
+	var response struct {
+		Tables []string `json:"tables"`
+	}
+	err := c.getInstanceJSON(ctx, c.serverURL(server), "/tables", &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing tables of server %s: %w", server.InstanceName, err)
+	}
+	return response.Tables, nil
+}
+
+func (c *PinotController) GetServerTableMetadata(ctx context.Context, server ServerInfo, tableNameWithType string) (ServerTableMetadata, error) {
+	var metadata ServerTableMetadata
+	apiPath := fmt.Sprintf("/tables/%s/metadata?columns=*", url.PathEscape(tableNameWithType))
+	err := c.getInstanceJSON(ctx, c.serverURL(server), apiPath, &metadata)
+	if err != nil {
+		return metadata, fmt.Errorf("failed getting metadata of table %s from server %s: %w", tableNameWithType, server.InstanceName, err)
+	}
+	return metadata, nil
+}
+
+func (c *PinotController) GetServerConsumingSegments(ctx context.Context, server ServerInfo, tableNameWithType string) ([]ServerConsumerInfo, error) {
+	var consumers []ServerConsumerInfo
+	apiPath := fmt.Sprintf("/tables/%s/consumingSegmentsInfo", url.PathEscape(tableNameWithType))
+	err := c.getInstanceJSON(ctx, c.serverURL(server), apiPath, &consumers)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting consuming segments of table %s from server %s: %w", tableNameWithType, server.InstanceName, err)
+	}
+	return consumers, nil
+}
+
+// Split a table name with type, e.g. airlineStats_OFFLINE, into the table and its type
+func splitTableType(tableNameWithType string) (string, string) {
+	for _, tableType := range []string{"OFFLINE", "REALTIME"} {
+		if table, ok := strings.CutSuffix(tableNameWithType, "_"+tableType); ok {
+			return table, tableType
+		}
+	}
+	return tableNameWithType, ""
+}
+
+// Keys of the series the server admin API feeds
+type tableIndex struct{ table, tableType, index string }
+type tableColumn struct{ table, tableType, column string }
+type tableOfType struct{ table, tableType string }
+type serverTable struct{ server, table string }
+
+// What one server adds to the series of its cluster
+type serverAdminContribution struct {
+	indexBytes  map[tableIndex]float64
+	columnBytes map[tableColumn]float64
+	rows        map[tableOfType]int64
+	consuming   map[serverTable]int
+	lag         map[serverTable]int64
+}
+
+func newServerAdminContribution() *serverAdminContribution {
+	return &serverAdminContribution{
+		indexBytes:  make(map[tableIndex]float64),
+		columnBytes: make(map[tableColumn]float64),
+		rows:        make(map[tableOfType]int64),
+		consuming:   make(map[serverTable]int),
+		lag:         make(map[serverTable]int64),
+	}
+}
+
+// Add the contribution of another server
+func (c *serverAdminContribution) add(other *serverAdminContribution) {
+	for key, bytes := range other.indexBytes {
+		c.indexBytes[key] += bytes
+	}
+	for key, bytes := range other.columnBytes {
+		c.columnBytes[key] += bytes
+	}
+	for key, count := range other.rows {
+		c.rows[key] += count
+	}
+	for key, count := range other.consuming {
+		c.consuming[key] += count
+	}
+	for key, records := range other.lag {
+		c.lag[key] += records
+	}
+}
+
+/*
+The last complete contribution of each server, by cluster and server name, kept for when
+a server fails to respond, so the table totals don't dip whenever one server is slow.
+*/
+var serverAdminLastGood = struct {
+	sync.Mutex
+	clusters map[string]map[string]*serverAdminContribution
+}{clusters: make(map[string]map[string]*serverAdminContribution)}
+
+/*
+Read what a server holds of each of its tables that are collected, i.e. pass the table filter.
+Nothing is returned unless all of them could be read.
+*/
+func collectServerContribution(ctx context.Context, controller PinotControllerInterface, server ServerInfo, collected map[string]struct{}) (*serverAdminContribution, error) {
+	contribution := newServerAdminContribution()
+	tables, err := controller.ListServerTables(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	for _, tableNameWithType := range tables {
+		table, tableType := splitTableType(tableNameWithType)
+		if _, ok := collected[table]; !ok {
+			continue
+		}
+		metadata, err := controller.GetServerTableMetadata(ctx, server, tableNameWithType)
+		if err != nil {
+			return nil, err
+		}
+		contribution.rows[tableOfType{table, tableType}] += metadata.NumRows
+		for column, indexes := range metadata.ColumnIndexSizeMap {
+			for index, bytes := range indexes {
+				contribution.indexBytes[tableIndex{table, tableType, index}] += bytes
+				contribution.columnBytes[tableColumn{table, tableType, column}] += bytes
+			}
+		}
+		if tableType != "REALTIME" {
+			continue
+		}
+		consumers, err := controller.GetServerConsumingSegments(ctx, server, tableNameWithType)
+		if err != nil {
+			return nil, err
+		}
+		key := serverTable{server.InstanceName, table}
+		for _, consumer := range consumers {
+			if consumer.ConsumerState == "CONSUMING" {
+				contribution.consuming[key]++
+			}
+			if consumer.PartitionOffsetInfo == nil {
+				continue
+			}
+			for _, records := range consumer.PartitionOffsetInfo.RecordsLagMap {
+				if value, err := strconv.ParseInt(records, 10, 64); err == nil {
+					contribution.lag[key] += value
+				}
+			}
+		}
+	}
+	return contribution, nil
+}
+
+/*
+Collect what the servers of a cluster report on their admin port about the tables that pass
+the table filter: the bytes of every index of every column of each table, which the controller only reports as a total,
+and the state of their consumers. Servers that don't respond are reported as down,
+and count with what they reported the last time they did.
+*/
+func collectServerAdmin(ctx context.Context, target *ClusterTarget) error {
+	controller := target.Controller
+	cluster := controller.String()
+	servers, err := controller.ListServers(ctx)
+	if err != nil {
+		return err
+	}
+	collected := make(map[string]struct{})
+	for _, table := range target.TableCache.GetTables() {
+		collected[table] = struct{}{}
+	}
+	serverAdminLastGood.Lock()
+	lastGood := serverAdminLastGood.clusters[cluster]
+	serverAdminLastGood.Unlock()
+
+	contributions := make(map[string]*serverAdminContribution)
+	total := newServerAdminContribution()
+	up := make(map[string]bool)
+	for _, server := range servers {
+		contribution, err := collectServerContribution(ctx, controller, server, collected)
+		if err != nil {
+			logger.Warnf("Failed to collect server %s of %s: %s", server.InstanceName, cluster, err)
+			contribution = lastGood[server.InstanceName]
+		}
+		up[server.InstanceName] = err == nil
+		if contribution != nil {
+			// Servers that are no longer listed are forgotten
+			contributions[server.InstanceName] = contribution
+			total.add(contribution)
+		}
+	}
+	serverAdminLastGood.Lock()
+	serverAdminLastGood.clusters[cluster] = contributions
+	serverAdminLastGood.Unlock()
+
+	// Tables, columns and servers come and go
+	var upSeries, indexSeries, columnSeries, rowSeries, consumingSeries, lagSeries []gaugeSeries
+	for server, ok := range up {
+		value := 0.0
+		if ok {
+			value = 1
+		}
+		upSeries = append(upSeries, gaugeSeries{prometheus.Labels{"cluster": cluster, "server": server}, value})
+	}
+	for key, bytes := range total.indexBytes {
+		labels := prometheus.Labels{"cluster": cluster, "table": key.table, "table_type": key.tableType, "index": key.index}
+		indexSeries = append(indexSeries, gaugeSeries{labels, bytes})
+	}
+	for key, bytes := range total.columnBytes {
+		labels := prometheus.Labels{"cluster": cluster, "table": key.table, "table_type": key.tableType, "column": key.column}
+		columnSeries = append(columnSeries, gaugeSeries{labels, bytes})
+	}
+	for key, count := range total.rows {
+		labels := prometheus.Labels{"cluster": cluster, "table": key.table, "table_type": key.tableType}
+		rowSeries = append(rowSeries, gaugeSeries{labels, float64(count)})
+	}
+	for key, count := range total.consuming {
+		labels := prometheus.Labels{"cluster": cluster, "server": key.server, "table": key.table}
+		consumingSeries = append(consumingSeries, gaugeSeries{labels, float64(count)})
+	}
+	for key, records := range total.lag {
+		labels := prometheus.Labels{"cluster": cluster, "server": key.server, "table": key.table}
+		lagSeries = append(lagSeries, gaugeSeries{labels, float64(records)})
+	}
+	clusterLabels := prometheus.Labels{"cluster": cluster}
+	replaceSeries(ServerAdminUp, clusterLabels, upSeries)
+	replaceSeries(TableIndexBytes, clusterLabels, indexSeries)
+	replaceSeries(TableColumnBytes, clusterLabels, columnSeries)
+	replaceSeries(TableRows, clusterLabels, rowSeries)
+	replaceSeries(ServerConsumingSegments, clusterLabels, consumingSeries)
+	replaceSeries(ServerConsumerLagRecords, clusterLabels, lagSeries)
+	return nil
+}
+
+func serverAdminMetrics() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{
+		ServerAdminUp, TableIndexBytes, TableColumnBytes, TableRows, ServerConsumingSegments, ServerConsumerLagRecords,
+	}
+}
+
+// Remove the series of a cluster and forget what its servers reported
+func deleteServerAdminMetrics(cluster string) {
+	serverAdminLastGood.Lock()
+	delete(serverAdminLastGood.clusters, cluster)
+	serverAdminLastGood.Unlock()
+	for _, metric := range serverAdminMetrics() {
+		metric.DeletePartialMatch(prometheus.Labels{"cluster": cluster})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// Point an instance of the fake controller at the given server
+func setInstanceAddress(t *testing.T, fake *fakePinot, instanceName string, server *httptest.Server) {
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	assert.Nil(t, err)
+	adminPort, _ := strconv.Atoi(port)
+	fake.update(func(cluster *fakePinotCluster) {
+		var instance InstanceInfo
+		json.Unmarshal(cluster.Instances[instanceName], &instance)
+		instance.HostName = host
+		instance.AdminPort = adminPort
+		cluster.Instances[instanceName], _ = json.Marshal(instance)
+	})
+}
+
+// A cluster target whose only collected table is airlineStats
+func newServerAdminTarget(controller *PinotController) *ClusterTarget {
+	return &ClusterTarget{Controller: controller, TableCache: &TableCache{cluster: controller.String(), Tables: []string{"airlineStats"}}}
+}
+
+func TestCollectServerAdmin(t *testing.T) {
+	fake := newFakePinot(t, fakePinotFixture)
+	controller := NewPinotController("serveradmin", fake.URL())
+	target := newServerAdminTarget(controller)
+	server := newRecordedServer(t, filepath.Join("testdata", "pinotserver"))
+	setInstanceAddress(t, fake, "Server_pinot-server-0_8098", server)
+	// The other server is down
+	down := httptest.NewServer(nil)
+	down.Close()
+	setInstanceAddress(t, fake, "Server_pinot-server-1_8098", down)
+
+	servers, err := controller.ListServers(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, servers, 2)
+
+	err = collectServerAdmin(context.Background(), target)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ServerAdminUp.WithLabelValues("serveradmin", "Server_pinot-server-0_8098")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(ServerAdminUp.WithLabelValues("serveradmin", "Server_pinot-server-1_8098")))
+	assert.Equal(t, 250.0, testutil.ToFloat64(TableIndexBytes.WithLabelValues("serveradmin", "airlineStats", "OFFLINE", "inverted_index")))
+	assert.Equal(t, 500.0, testutil.ToFloat64(TableIndexBytes.WithLabelValues("serveradmin", "airlineStats", "OFFLINE", "forward_index")))
+	assert.Equal(t, 80.0, testutil.ToFloat64(TableIndexBytes.WithLabelValues("serveradmin", "airlineStats", "REALTIME", "forward_index")))
+	assert.Equal(t, 560.0, testutil.ToFloat64(TableColumnBytes.WithLabelValues("serveradmin", "airlineStats", "OFFLINE", "Origin")))
+	assert.Equal(t, 1800.0, testutil.ToFloat64(TableRows.WithLabelValues("serveradmin", "airlineStats", "OFFLINE")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ServerConsumingSegments.WithLabelValues("serveradmin", "Server_pinot-server-0_8098", "airlineStats")))
+	assert.Equal(t, 8.0, testutil.ToFloat64(ServerConsumerLagRecords.WithLabelValues("serveradmin", "Server_pinot-server-0_8098", "airlineStats")))
+
+	// Servers that are gone take their series with them
+	fake.update(func(cluster *fakePinotCluster) {
+		delete(cluster.Instances, "Server_pinot-server-1_8098")
+	})
+	err = collectServerAdmin(context.Background(), target)
+	assert.Nil(t, err)
+	assert.False(t, ServerAdminUp.DeleteLabelValues("serveradmin", "Server_pinot-server-1_8098"))
+}
+
+func TestCollectServerAdminKeepsLastGoodContribution(t *testing.T) {
+	fake := newFakePinot(t, fakePinotFixture)
+	controller := NewPinotController("serveradminlastgood", fake.URL())
+	target := newServerAdminTarget(controller)
+	server := newRecordedServer(t, filepath.Join("testdata", "pinotserver"))
+	setInstanceAddress(t, fake, "Server_pinot-server-0_8098", server)
+	other := newRecordedServer(t, filepath.Join("testdata", "pinotserver"))
+	setInstanceAddress(t, fake, "Server_pinot-server-1_8098", other)
+
+	err := collectServerAdmin(context.Background(), target)
+	assert.Nil(t, err)
+	assert.Equal(t, 3600.0, testutil.ToFloat64(TableRows.WithLabelValues("serveradminlastgood", "airlineStats", "OFFLINE")))
+
+	// A server that fails still counts with what it reported last
+	other.Close()
+	err = collectServerAdmin(context.Background(), target)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, testutil.ToFloat64(ServerAdminUp.WithLabelValues("serveradminlastgood", "Server_pinot-server-1_8098")))
+	assert.Equal(t, 3600.0, testutil.ToFloat64(TableRows.WithLabelValues("serveradminlastgood", "airlineStats", "OFFLINE")))
+
+	// Until it is gone from the cluster
+	fake.update(func(cluster *fakePinotCluster) {
+		delete(cluster.Instances, "Server_pinot-server-1_8098")
+	})
+	err = collectServerAdmin(context.Background(), target)
+	assert.Nil(t, err)
+	assert.Equal(t, 1800.0, testutil.ToFloat64(TableRows.WithLabelValues("serveradminlastgood", "airlineStats", "OFFLINE")))
+	deleteServerAdminMetrics("serveradminlastgood")
+}
+
+func TestCollectServerAdminSkipsExcludedTables(t *testing.T) {
+	fake := newFakePinot(t, fakePinotFixture)
+	controller := NewPinotController("serveradminexcluded", fake.URL())
+	server := newRecordedServer(t, filepath.Join("testdata", "pinotserver"))
+	setInstanceAddress(t, fake, "Server_pinot-server-0_8098", server)
+	setInstanceAddress(t, fake, "Server_pinot-server-1_8098", server)
+
+	// airlineStats does not pass the table filter
+	target := &ClusterTarget{Controller: controller, TableCache: &TableCache{cluster: "serveradminexcluded", Tables: []string{"trololo"}}}
+	err := collectServerAdmin(context.Background(), target)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ServerAdminUp.WithLabelValues("serveradminexcluded", "Server_pinot-server-0_8098")))
+	assert.False(t, TableRows.DeleteLabelValues("serveradminexcluded", "airlineStats", "OFFLINE"))
+	assert.False(t, TableIndexBytes.DeleteLabelValues("serveradminexcluded", "airlineStats", "OFFLINE", "forward_index"))
+	assert.False(t, ServerConsumingSegments.DeleteLabelValues("serveradminexcluded", "Server_pinot-server-0_8098", "airlineStats"))
+	deleteServerAdminMetrics("serveradminexcluded")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// What a server holds: bytes on disk and number of segments
+type ServerUsage struct {
+	Bytes    int `json:"bytes"`
+	Segments int `json:"segments"`
+}
+
+// Bytes and segments of the table on each server holding it, from the per-segment sizes
+func (s TableSize) ServerUsage() map[string]ServerUsage {
+	usage := make(map[string]ServerUsage)
+	for _, typeSize := range []*TableTypeSize{s.OfflineSegments, s.RealtimeSegments} {
+		if typeSize == nil {
+			continue
+		}
+		for _, segment := range typeSize.Segments {
+			for server, info := range segment.ServerInfo {
+				serverUsage := usage[server]
+				serverUsage.Segments++
+				// Pinot reports -1 when the server did not respond
+				if info.DiskSizeInBytes > 0 {
+					serverUsage.Bytes += info.DiskSizeInBytes
+				}
+				usage[server] = serverUsage
+			}
+		}
+	}
+	return usage
+}
+
+/*
+Export how much of a table each server holds, and the totals of each server
+over all tables of the cluster collected so far.
+*/
+func collectServerUsage(cluster string, tableCache *TableCache, table string, size TableSize) {
+	usage := size.ServerUsage()
+	before, after := tableCache.RecordServerUsage(table, usage)
+	// Segments may have moved off some servers
+	TableServerBytes.DeletePartialMatch(prometheus.Labels{"cluster": cluster, "table": table})
+	TableServerSegments.DeletePartialMatch(prometheus.Labels{"cluster": cluster, "table": table})
+	for server, serverUsage := range usage {
+		TableServerBytes.WithLabelValues(cluster, table, server).Set(float64(serverUsage.Bytes))
+		TableServerSegments.WithLabelValues(cluster, table, server).Set(float64(serverUsage.Segments))
+	}
+	exportServerTotals(cluster, before, after)
+}
+
+// Export the totals of the servers of a cluster, removing the servers that hold nothing anymore
+func exportServerTotals(cluster string, before map[string]ServerUsage, after map[string]ServerUsage) {
+	for server := range before {
+		if _, ok := after[server]; !ok {
+			ServerBytes.DeleteLabelValues(cluster, server)
+			ServerSegments.DeleteLabelValues(cluster, server)
+		}
+	}
+	for server, usage := range after {
+		ServerBytes.WithLabelValues(cluster, server).Set(float64(usage.Bytes))
+		ServerSegments.WithLabelValues(cluster, server).Set(float64(usage.Segments))
+	}
+}
+
+// Sum the usage of each server over the given tables
+func sumServerUsage(tables map[string]TableInfo) map[string]ServerUsage {
+	totals := make(map[string]ServerUsage)
+	for _, info := range tables {
+		for server, usage := range info.Servers {
+			total := totals[server]
+			total.Bytes += usage.Bytes
+			total.Segments += usage.Segments
+			totals[server] = total
+		}
+	}
+	return totals
+}
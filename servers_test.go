@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectServerUsage(t *testing.T) {
+	fake := newFakePinot(t, fakePinotFixture)
+	controller := NewPinotController("servers", fake.URL())
+	size, err := controller.GetTableSize(context.Background(), "airlineStats")
+	assert.Nil(t, err)
+
+	usage := size.ServerUsage()
+	assert.Equal(t, ServerUsage{Bytes: 1500, Segments: 3}, usage["Server_pinot-server-0_8098"])
+	assert.Equal(t, ServerUsage{Bytes: 1500, Segments: 3}, usage["Server_pinot-server-1_8098"])
+
+	tables := make(chan []string)
+	tableCache := &TableCache{cluster: "servers"}
+	go tableCache.TableRefreshChanListener(tables)
+	tables <- []string{"airlineStats", "other"}
+
+	collectServerUsage("servers", tableCache, "airlineStats", size)
+	otherSize := TableSize{OfflineSegments: &TableTypeSize{Segments: map[string]SegmentSize{
+		"other_0": {ServerInfo: map[string]struct {
+			DiskSizeInBytes int `json:"diskSizeInBytes"`
+		}{"Server_pinot-server-2_8098": {DiskSizeInBytes: 100}}},
+	}}}
+	collectServerUsage("servers", tableCache, "other", otherSize)
+	assert.Equal(t, 1500.0, testutil.ToFloat64(TableServerBytes.WithLabelValues("servers", "airlineStats", "Server_pinot-server-0_8098")))
+	assert.Equal(t, 3.0, testutil.ToFloat64(TableServerSegments.WithLabelValues("servers", "airlineStats", "Server_pinot-server-0_8098")))
+	assert.Equal(t, 1500.0, testutil.ToFloat64(ServerBytes.WithLabelValues("servers", "Server_pinot-server-1_8098")))
+	assert.Equal(t, 100.0, testutil.ToFloat64(ServerBytes.WithLabelValues("servers", "Server_pinot-server-2_8098")))
+
+	// The other table moves to the first server
+	otherSize.OfflineSegments.Segments["other_0"] = SegmentSize{ServerInfo: map[string]struct {
+		DiskSizeInBytes int `json:"diskSizeInBytes"`
+	}{"Server_pinot-server-0_8098": {DiskSizeInBytes: 100}}}
+	collectServerUsage("servers", tableCache, "other", otherSize)
+	assert.Equal(t, 1600.0, testutil.ToFloat64(ServerBytes.WithLabelValues("servers", "Server_pinot-server-0_8098")))
+	assert.Equal(t, 4.0, testutil.ToFloat64(ServerSegments.WithLabelValues("servers", "Server_pinot-server-0_8098")))
+	assert.False(t, TableServerBytes.DeleteLabelValues("servers", "other", "Server_pinot-server-2_8098"))
+	assert.False(t, ServerBytes.DeleteLabelValues("servers", "Server_pinot-server-2_8098"))
+
+	// Dropping the table removes its share of the servers
+	tables <- []string{"airlineStats"}
+	close(tables)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(ServerBytes.WithLabelValues("servers", "Server_pinot-server-0_8098")) == 1500
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, TableServerBytes.DeleteLabelValues("servers", "other", "Server_pinot-server-0_8098"))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+What we know about the monitoring of a single Pinot cluster.
+Updated by the table refresh loop and the collector workers, read by the status page and readiness check.
+*/
+type ClusterStatus struct {
+	mutex                 sync.Mutex
+	lastTableRefresh      time.Time
+	lastTableRefreshError string
+	lastCollection        time.Time
+	lastCollectionError   string
+	// the table the last collection error is about
+	lastCollectionErrorTable string
+	// Pinot version of the controllers, empty until detected. Only reported, nothing depends on it
+	version string
+}
+
+func (s *ClusterStatus) RecordTableRefresh(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil {
+		s.lastTableRefreshError = err.Error()
+		return
+	}
+	s.lastTableRefresh = time.Now()
+	s.lastTableRefreshError = ""
+}
+
+// Record a collection of a table. The last error is cleared once its table is collected successfully
+func (s *ClusterStatus) RecordCollection(table string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil {
+		s.lastCollectionError = fmt.Sprintf("table %s: %s", table, err)
+		s.lastCollectionErrorTable = table
+		return
+	}
+	s.lastCollection = time.Now()
+	if table == s.lastCollectionErrorTable {
+		s.lastCollectionError = ""
+		s.lastCollectionErrorTable = ""
+	}
+}
+
+// Record the detected Pinot version of the cluster, replacing the previous one in the version metric
+func (s *ClusterStatus) RecordVersion(cluster string, version string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if version == s.version {
+		return
+	}
+	if s.version != "" {
+		logger.Infof("Pinot version of %s changed from %s to %s", cluster, s.version, version)
+		PinotVersionInfo.DeleteLabelValues(cluster, s.version)
+	}
+	s.version = version
+	PinotVersionInfo.WithLabelValues(cluster, version).Set(1)
+}
+
+// Whether tables were listed successfully at least once
+func (s *ClusterStatus) TablesListed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.lastTableRefresh.IsZero()
+}
+
+// A point in time view of a monitored cluster, as shown on the status page
+type ClusterStatusReport struct {
+	Name                  string    `json:"name"`
+	Controllers           []string  `json:"controllers"`
+	Version               string    `json:"version,omitempty"`
+	Tables                int       `json:"tables"`
+	LastTableRefresh      time.Time `json:"lastTableRefresh"`
+	LastTableRefreshError string    `json:"lastTableRefreshError,omitempty"`
+	LastCollection        time.Time `json:"lastCollection"`
+	LastCollectionError   string    `json:"lastCollectionError,omitempty"`
+}
+
+// Report the status of every known cluster, sorted by name
+func (m *PinotManager) Status() []ClusterStatusReport {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var reports []ClusterStatusReport
+	for name, controller := range m.knownPinots {
+		report := ClusterStatusReport{
+			Name:        name,
+			Controllers: controller.AllURLs(),
+		}
+		if tableCache, ok := m.tableCaches[name]; ok {
+			report.Tables = len(tableCache.GetTables())
+		}
+		if status, ok := m.statuses[name]; ok {
+			status.mutex.Lock()
+			report.Version = status.version
+			report.LastTableRefresh = status.lastTableRefresh
+			report.LastTableRefreshError = status.lastTableRefreshError
+			report.LastCollection = status.lastCollection
+			report.LastCollectionError = status.lastCollectionError
+			status.mutex.Unlock()
+		}
+		reports = append(reports, report)
+	}
+	slices.SortFunc(reports, func(a, b ClusterStatusReport) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return reports
+}
+
+/*
+Ready once discovery ran and every known cluster had its tables listed.
+Returns the reason when not ready.
+*/
+func (m *PinotManager) Ready() (bool, string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.discovered {
+		return false, "discovery has not run yet"
+	}
+	var pending []string
+	for name := range m.knownPinots {
+		if status, ok := m.statuses[name]; !ok || !status.TablesListed() {
+			pending = append(pending, name)
+		}
+	}
+	if len(pending) > 0 {
+		slices.Sort(pending)
+		return false, fmt.Sprintf("tables not listed yet for %s", strings.Join(pending, ", "))
+	}
+	return true, ""
+}
+
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "OK")
+}
+
+func readyHandler(m *PinotManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ready, reason := m.Ready()
+		if !ready {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	}
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>pinot-exporter status</title></head>
+<body>
+<h1>pinot-exporter</h1>
+<p>Ready: {{ if .Ready }}yes{{ else }}no ({{ .Reason }}){{ end }}</p>
+<table border="1" cellpadding="4">
+<tr><th>Cluster</th><th>Controllers</th><th>Version</th><th>Tables</th><th>Last table refresh</th><th>Last collection</th><th>Last errors</th></tr>
+{{ range .Clusters }}
+<tr>
+<td>{{ .Name }}</td>
+<td>{{ range .Controllers }}{{ . }}<br>{{ end }}</td>
+<td>{{ .Version }}</td>
+<td>{{ .Tables }}</td>
+<td>{{ if not .LastTableRefresh.IsZero }}{{ .LastTableRefresh.Format "2006-01-02 15:04:05" }}{{ else }}never{{ end }}</td>
+<td>{{ if not .LastCollection.IsZero }}{{ .LastCollection.Format "2006-01-02 15:04:05" }}{{ else }}never{{ end }}</td>
+<td>{{ .LastTableRefreshError }}<br>{{ .LastCollectionError }}</td>
+</tr>
+{{ end }}
+</table>
+</body>
+</html>
+`))
+
+// Serve the status of all clusters as HTML, or as JSON with ?format=json or an Accept: application/json header
+func statusHandler(m *PinotManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ready, reason := m.Ready()
+		status := struct {
+			Ready    bool                  `json:"ready"`
+			Reason   string                `json:"reason,omitempty"`
+			Clusters []ClusterStatusReport `json:"clusters"`
+		}{ready, reason, m.Status()}
+
+		if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(status)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := statusTemplate.Execute(w, status)
+		if err != nil {
+			logger.Errorf("Failed rendering status page: %s", err)
+		}
+	}
+}
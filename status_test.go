@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthyHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	healthyHandler(recorder, httptest.NewRequest("GET", "/-/healthy", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestReadyAndStatusHandlers(t *testing.T) {
+	server := newFakeTablesController("trololo", "skata")
+	defer server.Close()
+	controller := NewPinotController("test", server.URL)
+	manager, err := NewPinotManager(2, 1, NewStaticPinotControllerCache(controller))
+	assert.Nil(t, err)
+
+	// Not ready before discovery ran
+	recorder := httptest.NewRecorder()
+	readyHandler(manager)(recorder, httptest.NewRequest("GET", "/-/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+
+	manager.updateKnownPinotsCache([]*PinotController{controller})
+	defer manager.updateKnownPinotsCache(nil)
+	assert.Eventually(t, func() bool {
+		ready, _ := manager.Ready()
+		return ready
+	}, 3*time.Second, 20*time.Millisecond)
+
+	recorder = httptest.NewRecorder()
+	readyHandler(manager)(recorder, httptest.NewRequest("GET", "/-/ready", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// JSON status
+	assert.Eventually(t, func() bool { return manager.Status()[0].Tables == 2 }, 3*time.Second, 20*time.Millisecond)
+	recorder = httptest.NewRecorder()
+	statusHandler(manager)(recorder, httptest.NewRequest("GET", "/status?format=json", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var status struct {
+		Ready    bool                  `json:"ready"`
+		Clusters []ClusterStatusReport `json:"clusters"`
+	}
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+	assert.True(t, status.Ready)
+	assert.Len(t, status.Clusters, 1)
+	assert.Equal(t, "test", status.Clusters[0].Name)
+	assert.Equal(t, []string{server.URL}, status.Clusters[0].Controllers)
+	assert.Equal(t, 2, status.Clusters[0].Tables)
+	assert.False(t, status.Clusters[0].LastTableRefresh.IsZero())
+
+	// HTML status
+	recorder = httptest.NewRecorder()
+	statusHandler(manager)(recorder, httptest.NewRequest("GET", "/status", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "<td>test</td>")
+}
+
+func TestClusterStatusRecordCollection(t *testing.T) {
+	status := &ClusterStatus{}
+	status.RecordCollection("trololo", fmt.Errorf("timeout"))
+	assert.Equal(t, "table trololo: timeout", status.lastCollectionError)
+
+	// Other tables collecting fine don't hide the error
+	status.RecordCollection("skata", nil)
+	assert.Equal(t, "table trololo: timeout", status.lastCollectionError)
+
+	// The table recovering clears it
+	status.RecordCollection("trololo", nil)
+	assert.Equal(t, "", status.lastCollectionError)
+	assert.False(t, status.lastCollection.IsZero())
+}
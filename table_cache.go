@@ -2,39 +2,226 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"maps"
+	"slices"
 	"sync"
 	"time"
 )
 
 type TableCache struct {
 	Tables []string `json:"tables"`
-	mutex  sync.Mutex
+	// Latest collection results per table
+	tableInfo map[string]TableInfo
+	mutex     sync.Mutex
+	// Name of the cluster, to remove the metrics of tables that are gone
+	cluster string
 }
 
-func refreshTableCache(ctx context.Context, controller *PinotController, sleepDuration int, tables chan<- []string) {
-	// we never return.
+// What we last collected for a table
+type TableInfo struct {
+	Name                string    `json:"name"`
+	SizeBytes           int       `json:"sizeBytes"`
+	LastCollection      time.Time `json:"lastCollection"`
+	LastCollectionError string    `json:"lastCollectionError,omitempty"`
+	// Types of the table (OFFLINE, REALTIME), as found in its configs
+	TableTypes []string `json:"tableTypes,omitempty"`
+	// Hashes of the config of each table type and of the schema
+	ConfigHashes map[string]string `json:"configHashes,omitempty"`
+	SchemaHash   string            `json:"schemaHash,omitempty"`
+	// Bytes and segments of the table on each server
+	Servers map[string]ServerUsage `json:"servers,omitempty"`
+	// Ids of the jobs of the table that are known to have finished
+	finishedJobs map[string]bool
+}
+
+/*
+List the tables of the controller every sleepDuration seconds and send the ones that pass
+the filter to the tables channel. A nil filter passes all tables.
+Returns when ctx is cancelled, closing the tables channel so downstream consumers return too.
+*/
+func refreshTableCache(ctx context.Context, controller PinotControllerInterface, status *ClusterStatus, filter *TableFilter, sleepDuration int, tables chan<- []string) {
+	defer close(tables)
 	for {
-		tableList, err := controller.ListTables(ctx)
-		fmt.Printf("Discovered tables: %+v\n", tableList)
+		controller.CheckHealth(ctx)
+		// Detected on every round, to notice upgrades
+		version, err := controller.GetVersion(ctx)
 		if err != nil {
-			panic(err)
+			logger.Warnf("Failed to detect the Pinot version of %s: %s", controller, err)
+		} else {
+			status.RecordVersion(controller.String(), version)
+		}
+		if controller.LeaderRouting() {
+			err := controller.RefreshLeaders(ctx)
+			if err != nil {
+				logger.Warnf("Failed to refresh table leaders of %s: %s", controller, err)
+			}
+		}
+		tableList, err := controller.ListTables(ctx)
+		logger.Debugf("Discovered tables of %s: %+v", controller, tableList)
+		if err == nil && filter != nil {
+			listed := len(tableList)
+			tableList, err = filter.Apply(ctx, controller, tableList)
+			TablesExcluded.WithLabelValues(controller.String()).Set(float64(listed - len(tableList)))
+		}
+		status.RecordTableRefresh(err)
+		// If all controllers failed, try again on the next round
+		if err == nil {
+			select {
+			case tables <- tableList:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-time.After(time.Duration(sleepDuration) * time.Second):
+		case <-ctx.Done():
+			logger.Infof("Stopped refreshing tables of %s", controller)
+			return
 		}
-		tables <- tableList
-		time.Sleep(time.Duration(sleepDuration) * time.Second)
 	}
 }
 
 // Refresh the table cache when we get a new list from the re
 func (t *TableCache) TableRefreshChanListener(tables <-chan []string) {
 	for newTables := range tables {
-		fmt.Printf("TableCache received update: %+v\n", newTables)
+		logger.Debugf("TableCache of %s received update: %+v", t.cluster, newTables)
 		t.mutex.Lock()
 		t.Tables = newTables
+		// Forget tables that are gone, along with what they held on the servers
+		before := sumServerUsage(t.tableInfo)
+		removed := false
+		for table := range t.tableInfo {
+			if !slices.Contains(newTables, table) {
+				delete(t.tableInfo, table)
+				deleteTableMetrics(t.cluster, table)
+				removed = true
+			}
+		}
+		if removed {
+			exportServerTotals(t.cluster, before, sumServerUsage(t.tableInfo))
+		}
 		t.mutex.Unlock()
 	}
 }
 
 func (t *TableCache) GetTables() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	return t.Tables
 }
+
+// Record the result of collecting a table. On error, the last known size is kept.
+func (t *TableCache) RecordCollection(table string, size int, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.tableInfo == nil {
+		t.tableInfo = make(map[string]TableInfo)
+	}
+	info := t.tableInfo[table]
+	info.Name = table
+	if err != nil {
+		info.LastCollectionError = err.Error()
+	} else {
+		info.SizeBytes = size
+		info.LastCollection = time.Now()
+		info.LastCollectionError = ""
+	}
+	t.tableInfo[table] = info
+}
+
+// Record the config and schema hashes of a table, returning what we knew before
+func (t *TableCache) RecordConfig(table string, configHashes map[string]string, schemaHash string) (TableInfo, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.tableInfo == nil {
+		t.tableInfo = make(map[string]TableInfo)
+	}
+	info, existed := t.tableInfo[table]
+	previous := info
+	info.Name = table
+	info.TableTypes = sortedKeys(configHashes)
+	info.ConfigHashes = configHashes
+	info.SchemaHash = schemaHash
+	t.tableInfo[table] = info
+	return previous, existed
+}
+
+// Record what a table holds on each server, returning the totals of the servers before and after
+func (t *TableCache) RecordServerUsage(table string, usage map[string]ServerUsage) (map[string]ServerUsage, map[string]ServerUsage) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.tableInfo == nil {
+		t.tableInfo = make(map[string]TableInfo)
+	}
+	before := sumServerUsage(t.tableInfo)
+	info := t.tableInfo[table]
+	info.Name = table
+	info.Servers = usage
+	t.tableInfo[table] = info
+	return before, sumServerUsage(t.tableInfo)
+}
+
+// The jobs of a table known to have finished, by job id
+func (t *TableCache) FinishedJobs(table string) map[string]bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return maps.Clone(t.tableInfo[table].finishedJobs)
+}
+
+// Record the jobs of a table known to have finished, forgetting any others
+func (t *TableCache) RecordFinishedJobs(table string, finished map[string]bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.tableInfo == nil {
+		t.tableInfo = make(map[string]TableInfo)
+	}
+	info := t.tableInfo[table]
+	info.Name = table
+	info.finishedJobs = make(map[string]bool)
+	for jobId, done := range finished {
+		if done {
+			info.finishedJobs[jobId] = true
+		}
+	}
+	t.tableInfo[table] = info
+}
+
+// Return what we know about a listed table
+func (t *TableCache) GetTableInfo(table string) (TableInfo, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !slices.Contains(t.Tables, table) {
+		return TableInfo{}, false
+	}
+	info, ok := t.tableInfo[table]
+	if !ok {
+		// Listed but not collected yet
+		info.Name = table
+	}
+	return info, true
+}
+
+// Return what we know about all listed tables, in listing order
+func (t *TableCache) GetTablesInfo() []TableInfo {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	infos := make([]TableInfo, 0, len(t.Tables))
+	for _, table := range t.Tables {
+		info, ok := t.tableInfo[table]
+		if !ok {
+			info.Name = table
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// The keys of m, sorted
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
@@ -25,3 +26,36 @@ func TestTableRefreshChanListener(t *testing.T) {
 	time.Sleep(time.Duration(50) * time.Millisecond)
 	assert.Equal(t, cache.GetTables(), table_list2)
 }
+
+func TestTableCacheRecordCollection(t *testing.T) {
+	tables := make(chan []string)
+	var cache TableCache
+	go cache.TableRefreshChanListener(tables)
+	tables <- []string{"trololo", "skata"}
+	time.Sleep(time.Duration(50) * time.Millisecond)
+
+	cache.RecordCollection("trololo", 100, nil)
+	info, ok := cache.GetTableInfo("trololo")
+	assert.True(t, ok)
+	assert.Equal(t, 100, info.SizeBytes)
+	assert.False(t, info.LastCollection.IsZero())
+
+	// Failed collections keep the last size
+	cache.RecordCollection("trololo", 0, fmt.Errorf("timeout"))
+	info, _ = cache.GetTableInfo("trololo")
+	assert.Equal(t, 100, info.SizeBytes)
+	assert.Equal(t, "timeout", info.LastCollectionError)
+
+	// Listed but not collected yet
+	info, ok = cache.GetTableInfo("skata")
+	assert.True(t, ok)
+	assert.True(t, info.LastCollection.IsZero())
+
+	// Removed tables are forgotten
+	tables <- []string{"skata"}
+	close(tables)
+	time.Sleep(time.Duration(50) * time.Millisecond)
+	_, ok = cache.GetTableInfo("trololo")
+	assert.False(t, ok)
+	assert.Len(t, cache.GetTablesInfo(), 1)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+Export the configs and schema of a table: hashes to alert on any change, and the settings
+that are commonly misconfigured (replication, retention, indexes).
+The schema comes with the configs from /tableConfigs, or from /schemas if it is missing.
+*/
+func collectTableConfig(ctx context.Context, controller PinotControllerInterface, tableCache *TableCache, table string, configs TableConfigs) error {
+	cluster := controller.String()
+	byType := configs.ByType()
+	schema := configs.Schema
+	if schema == nil {
+		schemaName := table
+		for _, config := range byType {
+			if config.SegmentsConfig.SchemaName != "" {
+				schemaName = config.SegmentsConfig.SchemaName
+			}
+		}
+		fetched, err := controller.GetSchema(ctx, schemaName)
+		if err != nil {
+			return err
+		}
+		schema = &fetched
+	}
+
+	schemaHash := schema.Hash()
+	configHashes := make(map[string]string, len(byType))
+	for tableType, config := range byType {
+		configHashes[tableType] = config.Hash()
+	}
+	previous, _ := tableCache.RecordConfig(table, configHashes, schemaHash)
+	for tableType, hash := range previous.ConfigHashes {
+		if _, exists := configHashes[tableType]; !exists {
+			deleteTableTypeMetrics(cluster, table, tableType)
+		} else if configHashes[tableType] != hash || previous.SchemaHash != schemaHash {
+			// Only the info series carries the hashes. Other collectors keep their series of this type
+			TableConfigInfo.DeleteLabelValues(cluster, table, tableType, hash, previous.SchemaHash)
+		}
+	}
+
+	TableSchemaColumns.WithLabelValues(cluster, table, "dimension").Set(float64(len(schema.DimensionFieldSpecs)))
+	TableSchemaColumns.WithLabelValues(cluster, table, "metric").Set(float64(len(schema.MetricFieldSpecs)))
+	TableSchemaColumns.WithLabelValues(cluster, table, "time").Set(float64(schema.TimeColumns()))
+	for tableType, config := range byType {
+		TableConfigInfo.WithLabelValues(cluster, table, tableType, configHashes[tableType], schemaHash).Set(1)
+		replication, err := config.Replication()
+		if err != nil {
+			logger.Warnf("Invalid replication of %s table %s in %s: %s", tableType, table, cluster, err)
+		} else {
+			TableReplication.WithLabelValues(cluster, table, tableType).Set(float64(replication))
+		}
+		retention, err := config.Retention()
+		if err != nil {
+			logger.Warnf("Invalid retention of %s table %s in %s: %s", tableType, table, cluster, err)
+		} else {
+			// Zero when the table is kept forever
+			TableRetentionSeconds.WithLabelValues(cluster, table, tableType).Set(retention.Seconds())
+		}
+		for index, columns := range config.IndexedColumns() {
+			TableIndexColumns.WithLabelValues(cluster, table, tableType, index).Set(float64(columns))
+		}
+	}
+	return nil
+}
+
+// The configs of the table by table type (OFFLINE, REALTIME)
+func (t TableConfigs) ByType() map[string]*TableConfig {
+	byType := make(map[string]*TableConfig)
+	if t.Offline != nil {
+		byType["OFFLINE"] = t.Offline
+	}
+	if t.Realtime != nil {
+		byType["REALTIME"] = t.Realtime
+	}
+	return byType
+}
+
+// Number of replicas of each segment. Realtime tables of older releases set replicasPerPartition instead
+func (t *TableConfig) Replication() (int, error) {
+	replication := t.SegmentsConfig.Replication
+	if t.TableType == "REALTIME" && t.SegmentsConfig.ReplicasPerPartition != "" {
+		replication = t.SegmentsConfig.ReplicasPerPartition
+	}
+	if replication == "" {
+		return 1, nil
+	}
+	return strconv.Atoi(replication)
+}
+
+// How long segments are kept. Zero when retention is not configured
+func (t *TableConfig) Retention() (time.Duration, error) {
+	if t.SegmentsConfig.RetentionTimeValue == "" || t.SegmentsConfig.RetentionTimeUnit == "" {
+		return 0, nil
+	}
+	value, err := strconv.Atoi(t.SegmentsConfig.RetentionTimeValue)
+	if err != nil {
+		return 0, err
+	}
+	units := map[string]time.Duration{
+		"NANOSECONDS":  time.Nanosecond,
+		"MICROSECONDS": time.Microsecond,
+		"MILLISECONDS": time.Millisecond,
+		"SECONDS":      time.Second,
+		"MINUTES":      time.Minute,
+		"HOURS":        time.Hour,
+		"DAYS":         24 * time.Hour,
+	}
+	unit, ok := units[strings.ToUpper(t.SegmentsConfig.RetentionTimeUnit)]
+	if !ok {
+		return 0, fmt.Errorf("unknown retention time unit %s", t.SegmentsConfig.RetentionTimeUnit)
+	}
+	return time.Duration(value) * unit, nil
+}
+
+// Number of columns with each kind of index
+func (t *TableConfig) IndexedColumns() map[string]int {
+	indexConfig := t.TableIndexConfig
+	indexes := map[string]int{
+		"sorted":        len(indexConfig.SortedColumn),
+		"inverted":      len(indexConfig.InvertedIndexColumns),
+		"range":         len(indexConfig.RangeIndexColumns),
+		"bloom_filter":  len(indexConfig.BloomFilterColumns),
+		"no_dictionary": len(indexConfig.NoDictionaryColumns),
+		"json":          len(indexConfig.JSONIndexColumns),
+		"star_tree":     len(indexConfig.StarTreeIndexConfigs),
+		"text":          0,
+		"fst":           0,
+		"h3":            0,
+	}
+	for _, field := range t.FieldConfigList {
+		indexTypes := field.IndexTypes
+		if field.IndexType != "" {
+			indexTypes = append(indexTypes, field.IndexType)
+		}
+		for _, indexType := range indexTypes {
+			index := strings.ToLower(indexType)
+			if _, known := indexes[index]; known {
+				indexes[index]++
+			}
+		}
+	}
+	return indexes
+}
+
+// Remove the config series of one type of a table, e.g. after its config changed or the type was dropped
+func deleteTableTypeMetrics(cluster string, table string, tableType string) {
+	for _, metric := range tableTypeMetrics() {
+		metric.DeletePartialMatch(prometheus.Labels{"cluster": cluster, "table": table, "table_type": tableType})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONHashIgnoresFormatting(t *testing.T) {
+	assert.Equal(t, jsonHash(json.RawMessage(`{"a": 1, "b": [1, 2]}`)), jsonHash(json.RawMessage(`{"b":[1,2],"a":1}`)))
+	assert.NotEqual(t, jsonHash(json.RawMessage(`{"a": 1}`)), jsonHash(json.RawMessage(`{"a": 2}`)))
+	assert.Equal(t, "", jsonHash(nil))
+}
+
+func TestTableConfigSettings(t *testing.T) {
+	var config TableConfig
+	err := json.Unmarshal([]byte(`{
+		"tableType": "REALTIME",
+		"segmentsConfig": {"replication": "1", "replicasPerPartition": "3", "retentionTimeUnit": "HOURS", "retentionTimeValue": "12"},
+		"tableIndexConfig": {"invertedIndexColumns": ["a", "b"], "starTreeIndexConfigs": [{}]},
+		"fieldConfigList": [{"name": "c", "indexType": "FST"}, {"name": "d", "indexTypes": ["TEXT", "H3"]}]
+	}`), &config)
+	assert.Nil(t, err)
+
+	replication, err := config.Replication()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, replication)
+	retention, err := config.Retention()
+	assert.Nil(t, err)
+	assert.Equal(t, 12*time.Hour, retention)
+	indexes := config.IndexedColumns()
+	assert.Equal(t, 2, indexes["inverted"])
+	assert.Equal(t, 1, indexes["star_tree"])
+	assert.Equal(t, 1, indexes["fst"])
+	assert.Equal(t, 1, indexes["text"])
+	assert.Equal(t, 1, indexes["h3"])
+	assert.Equal(t, 0, indexes["range"])
+
+	config.SegmentsConfig.RetentionTimeUnit = "FORTNIGHTS"
+	_, err = config.Retention()
+	assert.NotNil(t, err)
+}
+
+func TestCollectTableConfig(t *testing.T) {
+	fake := newFakePinot(t, fakePinotFixture)
+	controller := NewPinotController("drift", fake.URL())
+	tableCache := &TableCache{cluster: "drift", Tables: []string{"airlineStats"}}
+
+	configs, err := controller.GetTableConfigs(context.Background(), "airlineStats")
+	assert.Nil(t, err)
+	err = collectTableConfig(context.Background(), controller, tableCache, "airlineStats", configs)
+	assert.Nil(t, err)
+	info, _ := tableCache.GetTableInfo("airlineStats")
+	assert.Equal(t, []string{"OFFLINE", "REALTIME"}, info.TableTypes)
+	offlineHash := info.ConfigHashes["OFFLINE"]
+	realtimeHash := info.ConfigHashes["REALTIME"]
+	assert.NotEmpty(t, offlineHash)
+	assert.NotEqual(t, offlineHash, realtimeHash)
+	assert.Equal(t, 1.0, testutil.ToFloat64(TableConfigInfo.WithLabelValues("drift", "airlineStats", "OFFLINE", offlineHash, info.SchemaHash)))
+	assert.Equal(t, 2.0, testutil.ToFloat64(TableSchemaColumns.WithLabelValues("drift", "airlineStats", "dimension")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(TableSchemaColumns.WithLabelValues("drift", "airlineStats", "time")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(TableReplication.WithLabelValues("drift", "airlineStats", "REALTIME")))
+	assert.Equal(t, (5 * 24 * time.Hour).Seconds(), testutil.ToFloat64(TableRetentionSeconds.WithLabelValues("drift", "airlineStats", "REALTIME")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(TableIndexColumns.WithLabelValues("drift", "airlineStats", "OFFLINE", "inverted")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(TableIndexColumns.WithLabelValues("drift", "airlineStats", "OFFLINE", "text")))
+
+	// Drop the realtime part of the table: its series go, the offline ones stay
+	fake.update(func(cluster *fakePinotCluster) {
+		table := cluster.Tables["airlineStats"]
+		var configs map[string]json.RawMessage
+		json.Unmarshal(table.Config, &configs)
+		delete(configs, "REALTIME")
+		table.Config, _ = json.Marshal(configs)
+		cluster.Tables["airlineStats"] = table
+	})
+	configs, err = controller.GetTableConfigs(context.Background(), "airlineStats")
+	assert.Nil(t, err)
+	err = collectTableConfig(context.Background(), controller, tableCache, "airlineStats", configs)
+	assert.Nil(t, err)
+	info, _ = tableCache.GetTableInfo("airlineStats")
+	assert.Equal(t, offlineHash, info.ConfigHashes["OFFLINE"])
+	assert.Equal(t, []string{"OFFLINE"}, info.TableTypes)
+	assert.False(t, TableConfigInfo.DeleteLabelValues("drift", "airlineStats", "REALTIME", realtimeHash, info.SchemaHash))
+	assert.False(t, TableRetentionSeconds.DeleteLabelValues("drift", "airlineStats", "REALTIME"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(TableConfigInfo.WithLabelValues("drift", "airlineStats", "OFFLINE", offlineHash, info.SchemaHash)))
+
+	// A changed schema changes the info series of every type, and leaves the series of other collectors alone
+	TableSegments.WithLabelValues("drift", "airlineStats", "OFFLINE").Set(3)
+	fake.update(func(cluster *fakePinotCluster) {
+		cluster.Schemas["airlineStats"] = json.RawMessage(`{"schemaName": "airlineStats", "dimensionFieldSpecs": [{"name": "Carrier", "dataType": "STRING"}]}`)
+	})
+	previousSchemaHash := info.SchemaHash
+	configs, err = controller.GetTableConfigs(context.Background(), "airlineStats")
+	assert.Nil(t, err)
+	err = collectTableConfig(context.Background(), controller, tableCache, "airlineStats", configs)
+	assert.Nil(t, err)
+	info, _ = tableCache.GetTableInfo("airlineStats")
+	assert.NotEqual(t, previousSchemaHash, info.SchemaHash)
+	assert.False(t, TableConfigInfo.DeleteLabelValues("drift", "airlineStats", "OFFLINE", offlineHash, previousSchemaHash))
+	assert.Equal(t, 3.0, testutil.ToFloat64(TableSegments.WithLabelValues("drift", "airlineStats", "OFFLINE")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(TableSchemaColumns.WithLabelValues("drift", "airlineStats", "dimension")))
+
+	// Tables that are gone lose all their series
+	updates := make(chan []string)
+	done := make(chan struct{})
+	go func() {
+		tableCache.TableRefreshChanListener(updates)
+		close(done)
+	}()
+	updates <- []string{}
+	close(updates)
+	<-done
+	assert.False(t, TableSchemaColumns.DeleteLabelValues("drift", "airlineStats", "dimension"))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+/*
+Which tables to collect, under tables: in the config file. A table is collected when it
+matches one of the include patterns (or there are none), none of the exclude patterns,
+has one of the types and is on one of the server tenants, when those are set.
+*/
+type TableFilterConfig struct {
+	Include []string `json:"include" yaml:"include"`
+	Exclude []string `json:"exclude" yaml:"exclude"`
+	// OFFLINE or REALTIME. Hybrid tables have both
+	Types []string `json:"types" yaml:"types"`
+	// Server tenants
+	Tenants []string `json:"tenants" yaml:"tenants"`
+}
+
+func (c TableFilterConfig) IsValid() error {
+	for _, pattern := range slices.Concat(c.Include, c.Exclude) {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid table pattern %s: %w", pattern, err)
+		}
+	}
+	for _, tableType := range c.Types {
+		if !slices.Contains([]string{"OFFLINE", "REALTIME"}, strings.ToUpper(tableType)) {
+			return fmt.Errorf("unknown table type %s - should be one of 'OFFLINE' or 'REALTIME'", tableType)
+		}
+	}
+	return nil
+}
+
+/*
+Filters the listed tables of every cluster before they are collected.
+Shared by all clusters, and updated in place when the config is reloaded.
+*/
+type TableFilter struct {
+	mutex   sync.Mutex
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	types   []string
+	tenants []string
+}
+
+// Create a filter from a valid config
+func NewTableFilter(config TableFilterConfig) *TableFilter {
+	f := &TableFilter{}
+	f.Update(config)
+	return f
+}
+
+// Apply a new valid config
+func (f *TableFilter) Update(config TableFilterConfig) {
+	compile := func(patterns []string) []*regexp.Regexp {
+		var compiled []*regexp.Regexp
+		for _, pattern := range patterns {
+			compiled = append(compiled, regexp.MustCompile(pattern))
+		}
+		return compiled
+	}
+	var types []string
+	for _, tableType := range config.Types {
+		types = append(types, strings.ToUpper(tableType))
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.include = compile(config.Include)
+	f.exclude = compile(config.Exclude)
+	f.types = types
+	f.tenants = slices.Clone(config.Tenants)
+}
+
+/*
+Return the tables to collect. Filtering by type or tenant lists the tables of
+each type or tenant from the controller, so it costs one request per type or tenant.
+*/
+func (f *TableFilter) Apply(ctx context.Context, controller PinotControllerInterface, tables []string) ([]string, error) {
+	f.mutex.Lock()
+	include, exclude, types, tenants := f.include, f.exclude, f.types, f.tenants
+	f.mutex.Unlock()
+
+	// Sets, as clusters may have thousands of tables
+	ofTypes := make(map[string]struct{})
+	onTenants := make(map[string]struct{})
+	for _, tableType := range types {
+		typeTables, err := controller.ListTablesOfType(ctx, tableType)
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range typeTables {
+			ofTypes[table] = struct{}{}
+		}
+	}
+	for _, tenant := range tenants {
+		tenantTables, err := controller.ListTenantTables(ctx, tenant)
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range tenantTables {
+			onTenants[table] = struct{}{}
+		}
+	}
+
+	matchesAny := func(patterns []*regexp.Regexp, table string) bool {
+		return slices.ContainsFunc(patterns, func(pattern *regexp.Regexp) bool { return pattern.MatchString(table) })
+	}
+	var filtered []string
+	for _, table := range tables {
+		if len(include) > 0 && !matchesAny(include, table) {
+			continue
+		}
+		if matchesAny(exclude, table) {
+			continue
+		}
+		if _, ok := ofTypes[table]; len(types) > 0 && !ok {
+			continue
+		}
+		if _, ok := onTenants[table]; len(tenants) > 0 && !ok {
+			continue
+		}
+		filtered = append(filtered, table)
+	}
+	return filtered, nil
+}
+
+// List the tables that have the given type (OFFLINE or REALTIME), from GET /tables?type=
+func (c *PinotController) ListTablesOfType(ctx context.Context, tableType string) ([]string, error) {
+	var response struct {
+		Tables []string `json:"tables"`
+	}
+	err := c.getJSON(ctx, "", "/tables?type="+url.QueryEscape(strings.ToLower(tableType)), &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing %s tables of %s: %w", tableType, c, err)
+	}
+	return response.Tables, nil
+}
+
+// List the tables on a server tenant, from GET /tenants/{tenantName}/tables
+func (c *PinotController) ListTenantTables(ctx context.Context, tenant string) ([]string, error) {
+	var response struct {
+		Tables []string `json:"tables"`
+	}
+	err := c.getJSON(ctx, "", fmt.Sprintf("/tenants/%s/tables", url.PathEscape(tenant)), &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing tables of tenant %s of %s: %w", tenant, c, err)
+	}
+	// Some releases list the tables with their type
+	var tables []string
+	seen := make(map[string]struct{})
+	for _, tableNameWithType := range response.Tables {
+		table, _ := splitTableType(tableNameWithType)
+		if _, ok := seen[table]; !ok {
+			seen[table] = struct{}{}
+			tables = append(tables, table)
+		}
+	}
+	return tables, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableFilterConfigIsValid(t *testing.T) {
+	assert.Nil(t, TableFilterConfig{Include: []string{"^prod_"}, Types: []string{"realtime"}}.IsValid())
+	assert.NotNil(t, TableFilterConfig{Exclude: []string{"("}}.IsValid())
+	assert.NotNil(t, TableFilterConfig{Types: []string{"HYBRID"}}.IsValid())
+
+	config, err := NewConfigFromBytes([]byte(`
+tables:
+  include: ["^prod_"]
+  exclude: ["_test$"]
+  types: [REALTIME]
+  tenants: [events]
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, TableFilterConfig{Include: []string{"^prod_"}, Exclude: []string{"_test$"}, Types: []string{"REALTIME"}, Tenants: []string{"events"}}, config.Tables)
+}
+
+func TestTableFilter(t *testing.T) {
+	fake := newFakePinot(t, fakePinotFixture)
+	controller := NewPinotController("filter", fake.URL())
+	ctx := context.Background()
+	tables := []string{"airlineStats", "githubEvents"}
+	apply := func(config TableFilterConfig) []string {
+		filtered, err := NewTableFilter(config).Apply(ctx, controller, tables)
+		assert.Nil(t, err)
+		return filtered
+	}
+
+	assert.Equal(t, tables, apply(TableFilterConfig{}))
+	assert.Equal(t, []string{"githubEvents"}, apply(TableFilterConfig{Include: []string{"^git", "^nothing"}}))
+	assert.Equal(t, []string{"githubEvents"}, apply(TableFilterConfig{Exclude: []string{"Stats$"}}))
+	assert.Equal(t, []string{"airlineStats"}, apply(TableFilterConfig{Types: []string{"offline"}}))
+	// Hybrid tables are realtime too
+	assert.Equal(t, tables, apply(TableFilterConfig{Types: []string{"REALTIME"}}))
+	assert.Equal(t, []string{"githubEvents"}, apply(TableFilterConfig{Tenants: []string{"events"}}))
+	assert.Empty(t, apply(TableFilterConfig{Types: []string{"OFFLINE"}, Tenants: []string{"events"}}))
+}
+
+func TestRefreshTableCacheFiltersTables(t *testing.T) {
+	fake := newFakePinot(t, fakePinotFixture)
+	controller := NewPinotController("refreshfilter", fake.URL())
+	filter := NewTableFilter(TableFilterConfig{Exclude: []string{"^airline"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tables := make(chan []string)
+	go refreshTableCache(ctx, controller, &ClusterStatus{}, filter, 1, tables)
+
+	select {
+	case listed := <-tables:
+		assert.Equal(t, []string{"githubEvents"}, listed)
+	case <-time.After(3 * time.Second):
+		t.Fatal("No tables were listed")
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(TablesExcluded.WithLabelValues("refreshfilter")))
+
+	// Changes apply from the next listing
+	filter.Update(TableFilterConfig{})
+	select {
+	case listed := <-tables:
+		assert.Equal(t, []string{"airlineStats", "githubEvents"}, listed)
+	case <-time.After(3 * time.Second):
+		t.Fatal("No tables were listed")
+	}
+}